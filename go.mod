@@ -4,12 +4,10 @@ go 1.16
 
 require (
 	github.com/davecgh/go-spew v1.1.1
-	github.com/fatih/structs v1.1.0
 	github.com/go-kit/kit v0.10.0
 	github.com/hhio618/ya-go-client/ya-activity v0.0.0-00010101000000-000000000000
 	github.com/hhio618/ya-go-client/ya-market v0.0.0-00010101000000-000000000000
 	github.com/hhio618/ya-go-client/ya-payment v0.0.0-00010101000000-000000000000
-	github.com/mitchellh/mapstructure v1.1.2
 	github.com/pkg/errors v0.8.1
 	github.com/pmezard/go-difflib v1.0.0
 	github.com/r3labs/sse/v2 v2.3.2
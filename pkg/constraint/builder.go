@@ -0,0 +1,154 @@
+package constraint
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// And returns an expression holding when all of `exprs` hold, the nested
+// AndExpr are flattened.
+func And(exprs ...Expr) Expr {
+	flat := make([]Expr, 0, len(exprs))
+	for _, expr := range exprs {
+		if and, ok := expr.(*AndExpr); ok {
+			flat = append(flat, and.Exprs...)
+			continue
+		}
+		flat = append(flat, expr)
+	}
+	return &AndExpr{Exprs: flat}
+}
+
+// Or returns an expression holding when any of `exprs` holds.
+func Or(exprs ...Expr) Expr {
+	return &OrExpr{Exprs: exprs}
+}
+
+// Not returns an expression holding when `expr` does not.
+func Not(expr Expr) Expr {
+	return &NotExpr{Expr: expr}
+}
+
+// Eq returns an expression holding when the property with `key` equals
+// `value`.
+func Eq(key string, value interface{}) Expr {
+	return compareWith(key, OpEq, value)
+}
+
+// Ge returns an expression holding when the property with `key` is greater
+// than or equal to `value`.
+func Ge(key string, value interface{}) Expr {
+	return compareWith(key, OpGe, value)
+}
+
+// Le returns an expression holding when the property with `key` is less than
+// or equal to `value`.
+func Le(key string, value interface{}) Expr {
+	return compareWith(key, OpLe, value)
+}
+
+// Gt returns an expression holding when the property with `key` is greater
+// than `value`.
+func Gt(key string, value interface{}) Expr {
+	return compareWith(key, OpGt, value)
+}
+
+// Lt returns an expression holding when the property with `key` is less than
+// `value`.
+func Lt(key string, value interface{}) Expr {
+	return compareWith(key, OpLt, value)
+}
+
+// Present returns an expression holding when the property with `key` is set.
+func Present(key string) Expr {
+	return &PresentExpr{Key: key}
+}
+
+// Like returns an expression matching the property with `key` against
+// `pattern`, in which '*' matches any text.
+func Like(key string, pattern string) Expr {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return &CompareExpr{Key: key, Op: OpEq, Value: pattern}
+	}
+	if len(parts) == 2 && parts[0] == "" && parts[1] == "" {
+		return Present(key)
+	}
+	return &WildcardExpr{Key: key, Parts: parts}
+}
+
+func compareWith(key string, op Op, value interface{}) Expr {
+	return &CompareExpr{Key: key, Op: op, Value: FormatValue(value)}
+}
+
+// Validate checks that the keys of `expr` render to a well-formed
+// expression, the builders above accept any key.
+func Validate(expr Expr) error {
+	switch e := expr.(type) {
+	case *AndExpr:
+		return validateAll(e.Exprs)
+	case *OrExpr:
+		return validateAll(e.Exprs)
+	case *NotExpr:
+		return Validate(e.Expr)
+	case *CompareExpr:
+		return validateKey(e.Key)
+	case *PresentExpr:
+		return validateKey(e.Key)
+	case *WildcardExpr:
+		return validateKey(e.Key)
+	}
+	return nil
+}
+
+func validateAll(exprs []Expr) error {
+	for _, expr := range exprs {
+		if err := Validate(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateKey(key string) error {
+	if key == "" || strings.IndexFunc(key, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("=<>()*\\&|!", r)
+	}) >= 0 {
+		return fmt.Errorf("invalid constraint property key: %q", key)
+	}
+	return nil
+}
+
+// FormatValue formats a value as the market expects it in constraints, times
+// are milliseconds since the epoch.
+func FormatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return strconv.FormatInt(v.UnixNano()/int64(time.Millisecond), 10)
+	case fmt.Stringer:
+		return v.String()
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.String:
+		// Enums like props.RuntimeType.
+		return rv.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool())
+	}
+	return fmt.Sprint(value)
+}
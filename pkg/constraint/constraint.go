@@ -0,0 +1,342 @@
+// Package constraint parses the LDAP-style constraint expressions of Golem
+// demands and offers, renders them back canonically and evaluates them
+// against a set of properties.
+package constraint
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Op is the operator of a comparison.
+type Op string
+
+const (
+	OpEq Op = "="
+	OpGe Op = ">="
+	OpLe Op = "<="
+	OpGt Op = ">"
+	OpLt Op = "<"
+)
+
+// Expr is a node of a constraint expression.
+type Expr interface {
+	// String renders the expression canonically.
+	String() string
+	// Eval evaluates the expression against `properties`, when it does not
+	// hold the reasons list the comparisons which made it fail.
+	Eval(properties map[string]interface{}) (bool, []string)
+}
+
+// AndExpr holds when all of its expressions hold, an empty AndExpr always
+// holds and renders as "()".
+type AndExpr struct {
+	Exprs []Expr
+}
+
+// OrExpr holds when any of its expressions holds, an empty OrExpr never
+// holds.
+type OrExpr struct {
+	Exprs []Expr
+}
+
+// NotExpr holds when its expression does not.
+type NotExpr struct {
+	Expr Expr
+}
+
+// CompareExpr compares a property with a value.
+type CompareExpr struct {
+	Key   string
+	Op    Op
+	Value string
+}
+
+// PresentExpr holds when the property is set, it is written "(key=*)".
+type PresentExpr struct {
+	Key string
+}
+
+// WildcardExpr matches the property against a pattern, the parts are the
+// literal text between the '*' wildcards.
+type WildcardExpr struct {
+	Key   string
+	Parts []string
+}
+
+func (e *AndExpr) String() string {
+	if len(e.Exprs) == 0 {
+		return "()"
+	}
+	return "(&" + join(e.Exprs) + ")"
+}
+
+func (e *OrExpr) String() string {
+	if len(e.Exprs) == 0 {
+		// "(|)" is not well-formed, an empty OrExpr never holds.
+		return "(!())"
+	}
+	return "(|" + join(e.Exprs) + ")"
+}
+
+func (e *NotExpr) String() string {
+	return "(!" + e.Expr.String() + ")"
+}
+
+func (e *CompareExpr) String() string {
+	return "(" + e.Key + string(e.Op) + escape(e.Value) + ")"
+}
+
+func (e *PresentExpr) String() string {
+	return "(" + e.Key + "=*)"
+}
+
+func (e *WildcardExpr) String() string {
+	parts := make([]string, len(e.Parts))
+	for i, part := range e.Parts {
+		parts[i] = escape(part)
+	}
+	return "(" + e.Key + "=" + strings.Join(parts, "*") + ")"
+}
+
+func join(exprs []Expr) string {
+	rendered := make([]string, len(exprs))
+	for i, expr := range exprs {
+		rendered[i] = expr.String()
+	}
+	return strings.Join(rendered, "")
+}
+
+// escape escapes the characters which have a meaning in a value.
+func escape(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch r {
+		case '(', ')', '*', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (e *AndExpr) Eval(properties map[string]interface{}) (bool, []string) {
+	reasons := make([]string, 0)
+	for _, expr := range e.Exprs {
+		if ok, why := expr.Eval(properties); !ok {
+			reasons = append(reasons, why...)
+		}
+	}
+	return len(reasons) == 0, reasons
+}
+
+func (e *OrExpr) Eval(properties map[string]interface{}) (bool, []string) {
+	reasons := make([]string, 0)
+	for _, expr := range e.Exprs {
+		ok, why := expr.Eval(properties)
+		if ok {
+			return true, nil
+		}
+		reasons = append(reasons, why...)
+	}
+	return false, []string{fmt.Sprintf("%v: none holds (%v)", e, strings.Join(reasons, "; "))}
+}
+
+func (e *NotExpr) Eval(properties map[string]interface{}) (bool, []string) {
+	if ok, _ := e.Expr.Eval(properties); ok {
+		return false, []string{fmt.Sprintf("%v: %v holds", e, e.Expr)}
+	}
+	return true, nil
+}
+
+func (e *PresentExpr) Eval(properties map[string]interface{}) (bool, []string) {
+	if _, ok := properties[e.Key]; !ok {
+		return false, []string{fmt.Sprintf("%v: property is not set", e)}
+	}
+	return true, nil
+}
+
+func (e *CompareExpr) Eval(properties map[string]interface{}) (bool, []string) {
+	return evalValues(e, properties, e.Key, func(actual interface{}) bool {
+		return compare(actual, e.Op, e.Value)
+	})
+}
+
+func (e *WildcardExpr) Eval(properties map[string]interface{}) (bool, []string) {
+	return evalValues(e, properties, e.Key, func(actual interface{}) bool {
+		return matchWildcard(fmt.Sprint(actual), e.Parts)
+	})
+}
+
+// evalValues applies `match` to the property, a list property matches when
+// any of its items does.
+func evalValues(e Expr, properties map[string]interface{}, key string, match func(interface{}) bool) (bool, []string) {
+	value, ok := properties[key]
+	if !ok {
+		return false, []string{fmt.Sprintf("%v: property is not set", e)}
+	}
+	values := []interface{}{value}
+	switch list := value.(type) {
+	case []interface{}:
+		values = list
+	case []string:
+		values = make([]interface{}, len(list))
+		for i, item := range list {
+			values[i] = item
+		}
+	}
+	for _, item := range values {
+		if match(item) {
+			return true, nil
+		}
+	}
+	return false, []string{fmt.Sprintf("%v: property is %v", e, value)}
+}
+
+// compare compares the property value with the constraint value, as numbers
+// if both are numbers, as versions if both are dotted versions and as
+// strings otherwise.
+func compare(actual interface{}, op Op, expected string) bool {
+	var cmp int
+	if a, ok := number(actual); ok {
+		b, err := strconv.ParseFloat(expected, 64)
+		if err != nil {
+			return op == OpEq && fmt.Sprint(actual) == expected
+		}
+		cmp = compareFloats(a, b)
+	} else {
+		str := fmt.Sprint(actual)
+		if a, ok := version(str); ok {
+			if b, ok := version(expected); ok {
+				cmp = compareVersions(a, b)
+			} else {
+				cmp = strings.Compare(str, expected)
+			}
+		} else {
+			cmp = strings.Compare(str, expected)
+		}
+	}
+	switch op {
+	case OpEq:
+		return cmp == 0
+	case OpGe:
+		return cmp >= 0
+	case OpLe:
+		return cmp <= 0
+	case OpGt:
+		return cmp > 0
+	case OpLt:
+		return cmp < 0
+	}
+	return false
+}
+
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// version parses a dotted version made of numbers only, like "0.10.1".
+func version(value string) ([]int, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 {
+		return nil, false
+	}
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
+
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return compareFloats(float64(x), float64(y))
+		}
+	}
+	return 0
+}
+
+func matchWildcard(value string, parts []string) bool {
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[last])
+}
+
+// Keys returns the property keys the expression refers to, sorted.
+func Keys(expr Expr) []string {
+	seen := make(map[string]bool)
+	var walk func(Expr)
+	walk = func(expr Expr) {
+		switch e := expr.(type) {
+		case *AndExpr:
+			for _, child := range e.Exprs {
+				walk(child)
+			}
+		case *OrExpr:
+			for _, child := range e.Exprs {
+				walk(child)
+			}
+		case *NotExpr:
+			walk(e.Expr)
+		case *CompareExpr:
+			seen[e.Key] = true
+		case *PresentExpr:
+			seen[e.Key] = true
+		case *WildcardExpr:
+			seen[e.Key] = true
+		}
+	}
+	walk(expr)
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package constraint
+
+import (
+	"testing"
+
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+func TestParseCanonical(t *testing.T) {
+	testCases := []struct {
+		Input     string
+		Canonical string
+	}{
+		{"", "()"},
+		{"()", "()"},
+		{"(golem.inf.mem.gib>=0.5)", "(golem.inf.mem.gib>=0.5)"},
+		{"(&(golem.inf.mem.gib>=0.5)\n\t(golem.inf.storage.gib>=2.0)\n\t(golem.runtime.name=vm))",
+			"(&(golem.inf.mem.gib>=0.5)(golem.inf.storage.gib>=2.0)(golem.runtime.name=vm))"},
+		{"(| (a<1) (!(b>2)) )", "(|(a<1)(!(b>2)))"},
+		{"(a=*)", "(a=*)"},
+		{"(a=x*y\\*z*)", "(a=x*y\\*z*)"},
+		{"(a = spam )", "(a=spam)"},
+		{"(a<=\\(1\\))", "(a<=\\(1\\))"},
+	}
+	for _, tc := range testCases {
+		expr, err := Parse(tc.Input)
+		testutil.Ok(t, err, "parsing %q", tc.Input)
+		testutil.Equals(t, tc.Canonical, expr.String())
+		// The canonical form parses to the same expression.
+		reparsed, err := Parse(expr.String())
+		testutil.Ok(t, err)
+		testutil.Equals(t, expr, reparsed)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"(&(golem.inf.mem.gib>=0.5)\n\t(golem.inf.storage.gib>=2.0)\n\t(golem.runtime.name=vm)",
+		"(a>=1",
+		"a=1",
+		"(=1)",
+		"(a 1)",
+		"(a b=1)",
+		"(a>=1*)",
+		"(|)",
+		"(a=1))",
+		"(a=(1))",
+	} {
+		_, err := Parse(input)
+		_, ok := err.(*SyntaxError)
+		testutil.Assert(t, ok, "expected a syntax error for %q, got %v", input, err)
+	}
+}
+
+func TestEval(t *testing.T) {
+	offer := map[string]interface{}{
+		"golem.inf.mem.gib":                     8.0,
+		"golem.inf.cpu.cores":                   4.0,
+		"golem.runtime.name":                    "vm",
+		"golem.runtime.version":                 "0.10.1",
+		"golem.activity.caps.transfer.protocol": []interface{}{"http", "gftp"},
+		"golem.node.id.name":                    "worker-7.example",
+	}
+	testCases := []struct {
+		Constraint string
+		Matched    bool
+		Reasons    []string
+	}{
+		{"()", true, nil},
+		{"(&(golem.inf.mem.gib>=4)(golem.runtime.name=vm))", true, nil},
+		{"(golem.inf.cpu.cores>4)", false, []string{"(golem.inf.cpu.cores>4): property is 4"}},
+		{"(golem.runtime.version>=0.9.0)", true, nil},
+		{"(golem.activity.caps.transfer.protocol=gftp)", true, nil},
+		{"(golem.node.id.name=worker-*.example)", true, nil},
+		{"(golem.node.id.name=*.test)", false, []string{"(golem.node.id.name=*.test): property is worker-7.example"}},
+		{"(golem.inf.storage.gib=*)", false, []string{"(golem.inf.storage.gib=*): property is not set"}},
+		{"(!(golem.runtime.name=vm))", false, []string{"(!(golem.runtime.name=vm)): (golem.runtime.name=vm) holds"}},
+		{"(|(golem.inf.mem.gib>=16)(golem.inf.cpu.cores>=8))", false, []string{
+			"(|(golem.inf.mem.gib>=16)(golem.inf.cpu.cores>=8)): none holds ((golem.inf.mem.gib>=16): property is 8; (golem.inf.cpu.cores>=8): property is 4)",
+		}},
+		{"(&(golem.inf.mem.gib>=16)(golem.runtime.name=wasmtime))", false, []string{
+			"(golem.inf.mem.gib>=16): property is 8",
+			"(golem.runtime.name=wasmtime): property is vm",
+		}},
+	}
+	for _, tc := range testCases {
+		matched, reasons := MustParse(tc.Constraint).Eval(offer)
+		testutil.Equals(t, tc.Matched, matched)
+		if !tc.Matched {
+			testutil.Equals(t, tc.Reasons, reasons)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	expr := And(
+		Ge("golem.inf.mem.gib", float32(0.5)),
+		And(Le("golem.inf.storage.gib", 2.0), Lt("golem.inf.cpu.cores", 16)),
+		Or(Eq("golem.runtime.name", "vm"), Not(Gt("golem.runtime.version", "0.2.0"))),
+		Present("golem.node.id.name"),
+		Like("golem.node.debug.subnet", "dev*"),
+		Eq("golem.node.id.name", "a (b) *c*"),
+		Or(),
+	)
+	rendered := "(&(golem.inf.mem.gib>=0.5)(golem.inf.storage.gib<=2)(golem.inf.cpu.cores<16)" +
+		"(|(golem.runtime.name=vm)(!(golem.runtime.version>0.2.0)))(golem.node.id.name=*)" +
+		"(golem.node.debug.subnet=dev*)(golem.node.id.name=a \\(b\\) \\*c\\*)(!()))"
+	testutil.Equals(t, rendered, expr.String())
+	parsed, err := Parse(expr.String())
+	testutil.Ok(t, err)
+	testutil.Equals(t, rendered, parsed.String())
+
+	matched, _ := Eq("golem.node.id.name", "a (b) *c*").Eval(map[string]interface{}{"golem.node.id.name": "a (b) *c*"})
+	testutil.Assert(t, matched, "escaped value does not match itself")
+	matched, _ = Or().Eval(map[string]interface{}{})
+	testutil.Assert(t, !matched, "empty Or holds")
+
+	testutil.Ok(t, Validate(expr))
+	for _, invalid := range []Expr{
+		Eq("mem gib", 1),
+		Present(""),
+		Not(Like("golem.node.(id)", "a*b")),
+		And(Present("golem.node.id.name"), Or(Ge("a>b", 1))),
+	} {
+		testutil.NotOk(t, Validate(invalid))
+	}
+	testutil.Equals(t, `invalid constraint property key: "mem gib"`, Validate(Eq("mem gib", 1)).Error())
+}
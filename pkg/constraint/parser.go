@@ -0,0 +1,224 @@
+package constraint
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// SyntaxError is returned by Parse for malformed expressions.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("constraint syntax error at %d: %s", e.Pos, e.Msg)
+}
+
+type parser struct {
+	input []rune
+	pos   int
+}
+
+// Parse parses a constraint expression. Whitespace between the elements is
+// ignored, "()" and the empty string parse to an empty AndExpr.
+func Parse(input string) (Expr, error) {
+	p := &parser{input: []rune(input)}
+	p.skipSpace()
+	if p.eof() {
+		return &AndExpr{}, nil
+	}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q after the expression", p.peek())
+	}
+	return expr, nil
+}
+
+// MustParse is Parse panicking on errors, for expressions known to be valid.
+func MustParse(input string) Expr {
+	expr, err := Parse(input)
+	if err != nil {
+		panic(err)
+	}
+	return expr
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek() rune {
+	return p.input[p.pos]
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+func (p *parser) expect(r rune) error {
+	p.skipSpace()
+	if p.eof() {
+		return p.errorf("expected %q, got the end of the expression", r)
+	}
+	if p.peek() != r {
+		return p.errorf("expected %q, got %q", r, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) expr() (Expr, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf("unterminated expression")
+	}
+	var expr Expr
+	var err error
+	switch p.peek() {
+	case ')':
+		expr = &AndExpr{}
+	case '&':
+		p.pos++
+		var exprs []Expr
+		exprs, err = p.list()
+		expr = &AndExpr{Exprs: exprs}
+	case '|':
+		p.pos++
+		var exprs []Expr
+		exprs, err = p.list()
+		if err == nil && len(exprs) == 0 {
+			err = p.errorf("empty '|' expression")
+		}
+		expr = &OrExpr{Exprs: exprs}
+	case '!':
+		p.pos++
+		var inner Expr
+		inner, err = p.expr()
+		expr = &NotExpr{Expr: inner}
+	default:
+		expr, err = p.comparison()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func (p *parser) list() ([]Expr, error) {
+	exprs := make([]Expr, 0)
+	for {
+		p.skipSpace()
+		if p.eof() || p.peek() != '(' {
+			return exprs, nil
+		}
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+}
+
+func (p *parser) comparison() (Expr, error) {
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune("=<>()*\\", p.peek()) {
+		p.pos++
+	}
+	key := strings.TrimSpace(string(p.input[start:p.pos]))
+	if key == "" {
+		return nil, p.errorf("missing property key")
+	}
+	if strings.IndexFunc(key, unicode.IsSpace) >= 0 {
+		return nil, &SyntaxError{Pos: start, Msg: fmt.Sprintf("invalid property key %q", key)}
+	}
+	op, err := p.op()
+	if err != nil {
+		return nil, err
+	}
+	parts, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 {
+		return &CompareExpr{Key: key, Op: op, Value: parts[0]}, nil
+	}
+	if op != OpEq {
+		return nil, p.errorf("wildcards are only allowed with '='")
+	}
+	if len(parts) == 2 && parts[0] == "" && parts[1] == "" {
+		return &PresentExpr{Key: key}, nil
+	}
+	return &WildcardExpr{Key: key, Parts: parts}, nil
+}
+
+func (p *parser) op() (Op, error) {
+	if p.eof() {
+		return "", p.errorf("missing operator")
+	}
+	switch p.peek() {
+	case '=':
+		p.pos++
+		return OpEq, nil
+	case '<', '>':
+		op := string(p.peek())
+		p.pos++
+		if !p.eof() && p.peek() == '=' {
+			op += "="
+			p.pos++
+		}
+		return Op(op), nil
+	}
+	return "", p.errorf("expected an operator, got %q", p.peek())
+}
+
+// value reads the value up to the closing paren, split on the unescaped
+// wildcards.
+func (p *parser) value() ([]string, error) {
+	parts := make([]string, 0)
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return nil, p.errorf("unterminated value")
+		}
+		r := p.peek()
+		switch r {
+		case ')':
+			parts = append(parts, b.String())
+			parts[0] = strings.TrimLeftFunc(parts[0], unicode.IsSpace)
+			parts[len(parts)-1] = strings.TrimRightFunc(parts[len(parts)-1], unicode.IsSpace)
+			return parts, nil
+		case '(':
+			return nil, p.errorf("unescaped '(' in value")
+		case '*':
+			parts = append(parts, b.String())
+			b.Reset()
+		case '\\':
+			p.pos++
+			if p.eof() {
+				return nil, p.errorf("unterminated escape")
+			}
+			b.WriteRune(p.peek())
+		default:
+			b.WriteRune(r)
+		}
+		p.pos++
+	}
+}
@@ -1,6 +1,7 @@
 package event
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/hhio618/go-golem/pkg/props"
@@ -61,6 +62,16 @@ func (e *CollectFailed) ExtractExcInfo() (*ExcInfo, Event) {
 	return nil, e
 }
 
+type PropertyQueryReceived struct {
+	SubId             string
+	QueryId           string
+	QueriedProperties []string
+}
+
+func (e *PropertyQueryReceived) ExtractExcInfo() (*ExcInfo, Event) {
+	return nil, e
+}
+
 type ProposalEvent struct {
 	PropId string
 }
@@ -166,6 +177,7 @@ func (e *AgreementTerminated) ExtractExcInfo() (*ExcInfo, Event) {
 
 type DebitNoteReceived struct {
 	AgreementEvent
+	ActId  string
 	NoteId string
 	Amount string
 }
@@ -235,7 +247,42 @@ func (e *ActivityCreateFailed) ExtractExcInfo() (*ExcInfo, Event) {
 	return nil, e
 }
 
+type ActivityDestroyed struct {
+	AgreementEvent
+	ActId string
+}
+
+func (e *ActivityDestroyed) ExtractExcInfo() (*ExcInfo, Event) {
+	return nil, e
+}
+
+type ActivityStateChanged struct {
+	AgreementEvent
+	ActId    string
+	Previous string
+	State    string
+	Reason   string
+}
+
+func (e *ActivityStateChanged) ExtractExcInfo() (*ExcInfo, Event) {
+	return nil, e
+}
+
+type ActivityUsage struct {
+	AgreementEvent
+	ActId string
+	Usage map[props.Counter]float64
+	// Cost is the amount due for the usage so far, it is zero for activities
+	// without a known linear pricing model.
+	Cost float64
+}
+
+func (e *ActivityUsage) ExtractExcInfo() (*ExcInfo, Event) {
+	return nil, e
+}
+
 type TaskEvent struct {
+	TaskId   string
 	TaskData interface{}
 }
 
@@ -289,6 +336,8 @@ func (e *GettingResults) ExtractExcInfo() (*ExcInfo, Event) {
 
 type ScriptFinished struct {
 	ScriptEvent
+	// Cancelled is set when the script was stopped before all commands were executed.
+	Cancelled bool
 }
 
 func (e *ScriptFinished) ExtractExcInfo() (*ExcInfo, Event) {
@@ -309,21 +358,55 @@ type CommandEventContext struct {
 	Kwargs map[string]interface{}
 }
 
+// ComputationFinished reports whether the event ends a batch whose last command
+// has index `lastIndex`, either because that command was executed or because
+// a command failed.
 func (cec *CommandEventContext) ComputationFinished(lastIndex int) bool {
 	switch cec.EvtCls.(type) {
 	case CommandExecuted:
-		if v, ok := cec.Kwargs["cmd_idx"]; ok {
-			if v.(int) < lastIndex {
-				return false
-			}
-			if _, ok := cec.Kwargs["success"]; !ok {
-				return true
-			}
-		}
+		return cec.Idx() >= lastIndex || !cec.Bool("success")
 	default:
 		return false
 	}
-	return false
+}
+
+// Idx returns the index of the command the event refers to, -1 if unknown.
+func (cec *CommandEventContext) Idx() int {
+	if v, ok := cec.Kwargs["cmd_idx"].(int); ok {
+		return v
+	}
+	return -1
+}
+
+// String returns the string argument stored under `key`.
+func (cec *CommandEventContext) String(key string) string {
+	switch v := cec.Kwargs[key].(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// Bytes returns the output argument stored under `key`, binary captures are
+// kept as is while text is converted.
+func (cec *CommandEventContext) Bytes(key string) []byte {
+	switch v := cec.Kwargs[key].(type) {
+	case []byte:
+		return v
+	case nil:
+		return nil
+	default:
+		return []byte(cec.String(key))
+	}
+}
+
+// Bool returns the boolean argument stored under `key`.
+func (cec *CommandEventContext) Bool(key string) bool {
+	v, _ := cec.Kwargs[key].(bool)
+	return v
 }
 
 type CommandExecuted struct {
@@ -366,7 +449,9 @@ func (e *CommandStdErr) ExtractExcInfo() (*ExcInfo, Event) {
 
 type TaskAccepted struct {
 	TaskEvent
-	Result interface{}
+	AgreementEvent
+	ProviderId string
+	Result     interface{}
 }
 
 func (e *TaskAccepted) ExtractExcInfo() (*ExcInfo, Event) {
@@ -375,7 +460,9 @@ func (e *TaskAccepted) ExtractExcInfo() (*ExcInfo, Event) {
 
 type TaskRejected struct {
 	TaskEvent
-	Reason string
+	AgreementEvent
+	ProviderId string
+	Reason     string
 }
 
 func (e *TaskRejected) ExtractExcInfo() (*ExcInfo, Event) {
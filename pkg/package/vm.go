@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/hhio618/go-golem/pkg/constraint"
 	"github.com/hhio618/go-golem/pkg/props"
 	"github.com/pkg/errors"
 )
@@ -23,19 +24,26 @@ type vmConstrains struct {
 	cores         float32
 }
 
-func (v *vmConstrains) String() string {
+func (v *vmConstrains) Expr() constraint.Expr {
+	exprs := []constraint.Expr{
+		constraint.Ge(props.InfVmKeys[props.InfBaseMem], v.minMemGib),
+		constraint.Ge(props.InfVmKeys[props.InfBaseStorage], v.minStoargeGib),
+		constraint.Eq(props.InfVmKeys[props.InfBaseRuntime], props.RuntimeTypeVM),
+	}
+	if v.cores > 0 {
+		exprs = append(exprs, constraint.Ge(props.InfVmKeys[props.InfVmCores], v.cores))
+	}
+	return constraint.And(exprs...)
+}
 
-	return fmt.Sprintf("(&%v\n\t%v\n\t%v",
-		fmt.Sprintf("%v>=%v", props.InfVmKeys["mem"], v.minMemGib),
-		fmt.Sprintf("%v>=%v", props.InfVmKeys["storage"], v.minStoargeGib),
-		fmt.Sprintf("%v=%v", props.InfVmKeys["runtime"], string(props.RuntimeTypeVM)),
-	)
+func (v *vmConstrains) String() string {
+	return v.Expr().String()
 }
 
 type vmPackage struct {
 	repoUrl     string
 	imageHash   string
-	constraints string
+	constraints constraint.Expr
 }
 
 func (v *vmPackage) ResolveUrl() (string, error) {
@@ -67,7 +75,9 @@ func (v *vmPackage) DecorateDemand(demand *props.DemandBuilder) error {
 	if err != nil {
 		return err
 	}
-	demand.Ensure(v.constraints)
+	if err := demand.Ensure(v.constraints); err != nil {
+		return err
+	}
 	demand.Add(&props.VMRequest{
 		ExeUnitRequest: props.ExeUnitRequest{
 			PackageUrl: imageUrl,
@@ -89,7 +99,7 @@ func Repo(imageHash string, minMemGib float32, minStoargeGib float32) Package {
 		constraints: (&vmConstrains{
 			minMemGib:     minMemGib,
 			minStoargeGib: minStoargeGib,
-		}).String(),
+		}).Expr(),
 	}
 }
 
@@ -1,7 +1,6 @@
 package props
 
 import (
-	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
@@ -23,44 +22,6 @@ func (i InvalidPropertiesError) Error() string {
 	return msg
 }
 
-func asList(data interface{}) ([]string, error) {
-	v := reflect.TypeOf(data)
-	switch v.Kind() {
-	case reflect.Slice, reflect.Array:
-		return mapToStringSlice(data, func(in interface{}) string {
-			return fmt.Sprintf("%v", in)
-		}), nil
-	default:
-		var _data interface{}
-		err := json.Unmarshal([]byte(data.(string)), _data)
-		if err != nil {
-			return nil, fmt.Errorf("error when decoding '%s'", data)
-		}
-		switch reflect.ValueOf(_data).Kind() {
-		case reflect.Slice:
-			return mapToStringSlice(_data, func(in interface{}) string {
-				return fmt.Sprintf("%v", in)
-			}), nil
-		default:
-			return []string{fmt.Sprintf("%v", _data)}, nil
-		}
-	}
-}
-
-func mapToStringSlice(slice interface{}, mapFunc func(interface{}) string) []string {
-	s := reflect.ValueOf(slice)
-	if s.Kind() != reflect.Slice {
-		panic("mapToStringSlice() given a non-slice type")
-	}
-	ret := make([]string, s.Len())
-
-	for i := 0; i < s.Len(); i++ {
-		ret[i] = mapFunc(s.Index(i).Interface())
-	}
-
-	return ret
-}
-
 /*
 Initialize the model from a dictionary representation.
 
@@ -73,124 +34,116 @@ initialized from the same dictionary and all models will only load their own dat
 */
 
 func FromProperties(props Props, model Model) error {
-	// Model predefined keys.
-	modelKeys := model.Keys()
-	fields, values := getFields(model)
-	for i := 0; i < len(fields); i++ {
-		field := fields[i]
-		val := values[i]
-		var opt bool
-		if tag, ok := field.Tag.Lookup("field"); ok {
-			opt = optional(tag)
-		}
-		key, ok := modelKeys[field.Name]
+	if v := reflect.ValueOf(model); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("model must be a pointer to a struct, got %T", model)
+	}
+	for _, field := range modelFields(model) {
+		prop, ok := props[field.Key]
 		if !ok {
-			// Skip on unknown keys.
+			if !field.Optional {
+				return &PropertyError{Key: field.Key, Err: ErrMissingProperty}
+			}
 			continue
 		}
-		prop, ok := props[key]
-		if !ok && !opt {
-			return fmt.Errorf("missing 1 required positional argument: '%v'", key)
+		if !field.Value.CanSet() {
+			return fmt.Errorf("can't set value for field: %v", field.Name)
 		}
-		// Encoding values.
-		if ok {
-			if !val.CanSet() && !val.CanAddr() {
-				return fmt.Errorf("can't set value for field: %v", field.Name)
-			}
-			switch pValue := prop.(type) {
-			case int64:
-				val.SetInt(pValue)
-			case float64:
-				val.SetFloat(pValue)
-			case string:
-				val.SetString(pValue)
-			default:
-				val.Set(reflect.ValueOf(pValue))
-			}
-			// Call validate method if exists.
-			if _, ok := field.Type.MethodByName("Validate"); ok {
-				rets := reflect.ValueOf(val.Interface()).MethodByName("Validate").Call([]reflect.Value{})
-				err, ok := rets[0].Interface().(error)
-				if ok && err != nil {
-					return err
-				}
-			}
+		val, err := coerce(prop, field.Value.Type())
+		if err != nil {
+			return &PropertyError{Key: field.Key, Value: prop, Err: err}
 		}
+		field.Value.Set(val)
 	}
 	// Do custom mapping last.
-	return model.CustomMapping(props)
+	if mapper, ok := model.(CustomMapper); ok {
+		return mapper.CustomMapping(props)
+	}
+	return nil
 }
 
-func getFields(iface interface{}) ([]reflect.StructField, []reflect.Value) {
-	fields := make([]reflect.StructField, 0)
-	values := make([]reflect.Value, 0)
-
-	var ift reflect.Type
-	var ifv reflect.Value
-	tmp := reflect.ValueOf(iface)
-	switch tmp.Type().Kind() {
-	case reflect.Ptr:
-		ift = reflect.Indirect(tmp).Type()
-		ifv = tmp.Elem()
-	case reflect.Interface:
-		return []reflect.StructField{}, []reflect.Value{}
+// modelField is a model field tagged with a property key.
+type modelField struct {
+	Name     string
+	Key      string
+	Optional bool
+	Value    reflect.Value
+}
+
+// modelFields lists the tagged fields of the model, the fields of the
+// embedded structs included.
+func modelFields(model interface{}) []modelField {
+	v := reflect.Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		return nil
 	}
+	return structFields(v)
+}
 
-	for i := 0; i < ift.NumField(); i++ {
-		v := ifv.Field(i)
-		f := ift.Field(i)
-		switch v.Kind() {
-		case reflect.Struct:
-			f, v := getFields(v.Addr().Interface())
-			fields = append(fields, f...)
-			values = append(values, v...)
-		default:
-			fields = append(fields, f)
-			values = append(values, v)
+func structFields(v reflect.Value) []modelField {
+	fields := make([]modelField, 0)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("prop")
+		if !ok {
+			// Embedded property sets, times and decimals are plain fields.
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				fields = append(fields, structFields(v.Field(i))...)
+			}
+			continue
 		}
+		parts := strings.Split(tag, ",")
+		fields = append(fields, modelField{
+			Name:     f.Name,
+			Key:      strings.TrimSpace(parts[0]),
+			Optional: optional(parts[1:]),
+			Value:    v.Field(i),
+		})
 	}
-
-	return fields, values
+	return fields
 }
 
-// optional checks if an struct field contains an optional tag.
-func optional(tag string) bool {
-	parts := strings.Split(tag, ",")
-	if len(parts) == 0 {
-		return false
-	}
-	for _, part := range parts {
-		if strings.TrimSpace(part) == "optional" {
+// optional checks if the tag options contain optional.
+func optional(options []string) bool {
+	for _, option := range options {
+		if strings.TrimSpace(option) == "optional" {
 			return true
 		}
 	}
 	return false
 }
 
+// Keys returns a mapping between the model's field names and the property
+// keys, read from the `prop` tags of its fields.
+func Keys(model Model) map[string]string {
+	keys := make(map[string]string)
+	for _, field := range modelFields(model) {
+		keys[field.Name] = field.Key
+	}
+	return keys
+}
+
 /*
-Model is the base struct from which all property models embed.
+Model is a struct describing a set of properties, each of its fields is tagged
+with the key of its property and whether it is optional:
 
-Provides helper methods to load the property model data from a dictionary and
-to get a mapping of all the keys available in the given model.
+	type NodeInfo struct {
+		Name string `prop:"golem.node.id.name,optional"`
+	}
+
+The fields of the embedded structs are part of the model, the fields without a
+tag are ignored. FromProperties fills a model, which must then be a pointer,
+and ToProperties converts one back.
 */
-type Model interface {
-	/*
-		:return: a mapping between the model's field names and the property keys
-
-		example:
-		```python
-		>>> import dataclasses
-		>>> import typing
-		>>> from yapapi.properties.base import Model
-		>>> @dataclasses.dataclass
-		... class NodeInfo(Model):
-		...     name: typing.Optional[str] = \
-		...     dataclasses.field(default=None, metadata={"key": "golem.node.id.name"})
-		...
-		>>> NodeInfo.keys().name
-		'golem.node.id.name'
-		```
-	*/
-	Keys() map[string]string
+type Model interface{}
+
+// CustomMapper is implemented by the models with properties which can't be
+// mapped from a tag, CustomMapping is called last by FromProperties.
+type CustomMapper interface {
 	CustomMapping(props Props) error
 }
+
+// CustomEncoder is the counterpart of CustomMapper for ToProperties.
+type CustomEncoder interface {
+	CustomEncoding(props Props)
+}
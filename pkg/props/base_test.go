@@ -1,6 +1,7 @@
 package props
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/hhio618/go-golem/pkg/testutil"
@@ -8,7 +9,9 @@ import (
 
 type TestCase struct {
 	Properties Props
-	Err        string
+	// Key is the property reported by the PropertyError.
+	Key string
+	Err string
 }
 
 func TestProps(t *testing.T) {
@@ -48,7 +51,8 @@ func TestProps(t *testing.T) {
 				"golem.com.usage.vector": []string{"golem.usage.cpu_sec", "golem.usage.duration_sec"},
 				"golem.com.scheme":       "payu",
 			},
-			Err: "missing key: 'golem.com.pricing.model.linear.coeffs'",
+			Key: "golem.com.pricing.model.linear.coeffs",
+			Err: "property 'golem.com.pricing.model.linear.coeffs': missing required property",
 		},
 		{
 			Properties: map[string]interface{}{
@@ -57,7 +61,8 @@ func TestProps(t *testing.T) {
 				"golem.com.usage.vector":                []string{"golem.usage.cpu_sec", "golem.usage.duration_sec"},
 				"golem.com.scheme":                      "payu",
 			},
-			Err: "pop from empty list",
+			Key: "golem.com.pricing.model.linear.coeffs",
+			Err: "property 'golem.com.pricing.model.linear.coeffs': invalid value []string{}: expected 3 coefficients for the usage vector and the fixed price",
 		},
 		{
 			Properties: map[string]interface{}{
@@ -66,7 +71,8 @@ func TestProps(t *testing.T) {
 				"golem.com.usage.vector":                []string{"golem.usage.cpu_sec"},
 				"golem.com.scheme":                      "payu",
 			},
-			Err: "list index out of range",
+			Key: "golem.com.pricing.model.linear.coeffs",
+			Err: "property 'golem.com.pricing.model.linear.coeffs': invalid value []float32{0.001, 0.002, 0}: expected 2 coefficients for the usage vector and the fixed price",
 		},
 		{
 			Properties: map[string]interface{}{
@@ -75,16 +81,28 @@ func TestProps(t *testing.T) {
 				"golem.com.usage.vector":                []string{"golem.usage.cpu_sec", "golem.usage.duration_sec"},
 				"golem.com.scheme":                      "payu",
 			},
-			Err: "could not convert string to float",
+			Key: "golem.com.pricing.model.linear.coeffs",
+			Err: "property 'golem.com.pricing.model.linear.coeffs': invalid value []interface {}{\"spam\", 0.002, 0}: item 0: expected a number",
 		},
 		{
 			Properties: map[string]interface{}{
 				"golem.com.pricing.model":               "linear",
-				"golem.com.pricing.model.linear.coeffs": []interface{}{"spam", 0.002, 0.0},
+				"golem.com.pricing.model.linear.coeffs": []float32{0.001, 0.002, 0.0},
 				"golem.com.usage.vector":                "not a vector",
 				"golem.com.scheme":                      "payu",
 			},
-			Err: "error when decoding 'not a vector'",
+			Key: "golem.com.usage.vector",
+			Err: "property 'golem.com.usage.vector': invalid value \"not a vector\": expected a list",
+		},
+		{
+			Properties: map[string]interface{}{
+				"golem.com.pricing.model":               "linear",
+				"golem.com.pricing.model.linear.coeffs": []float32{0.001, 0.002, 0.0},
+				"golem.com.usage.vector":                []string{"golem.usage.cpu_sec", "golem.usage.unknown"},
+				"golem.com.scheme":                      "payu",
+			},
+			Key: "golem.com.usage.vector",
+			Err: "property 'golem.com.usage.vector': invalid value []string{\"golem.usage.cpu_sec\", \"golem.usage.unknown\"}: item 1: unknown enum value: golem.usage.unknown",
 		},
 	}
 	for _, testCase := range testCases {
@@ -95,8 +113,40 @@ func TestProps(t *testing.T) {
 			t.Logf("TestCase data: %v", model)
 		} else {
 			t.Logf("TestCase error: %v", testCase.Err)
-			testutil.NotOk(t, err)
+			var propertyErr *PropertyError
+			testutil.Assert(t, errors.As(err, &propertyErr), "expected a property error, got %v", err)
+			testutil.Equals(t, testCase.Key, propertyErr.Key)
 			testutil.Equals(t, testCase.Err, err.Error())
 		}
 	}
 }
+
+type testModel struct {
+	NodeInfo
+	Label   string  `prop:"golem.test.label"`
+	Weight  float32 `prop:"golem.test.weight,optional"`
+	Ignored string
+}
+
+func TestTaggedModel(t *testing.T) {
+	testutil.Equals(t, map[string]string{
+		NodeInfoName:      "golem.node.id.name",
+		NodeInfoSubnetTag: "golem.node.debug.subnet",
+		NodeInfoPublicKey: "golem.node.id.pubkey",
+		"Label":           "golem.test.label",
+		"Weight":          "golem.test.weight",
+	}, Keys(&testModel{}))
+	testutil.Equals(t, "golem.inf.mem.gib", InfVmKeys[InfBaseMem])
+	testutil.Equals(t, "golem.inf.cpu.cores", InfVmKeys[InfVmCores])
+
+	model := &testModel{NodeInfo: NodeInfo{Name: "a node"}, Label: "spam", Ignored: "eggs"}
+	properties := ToProperties(model)
+	testutil.Equals(t, Props{"golem.node.id.name": "a node", "golem.test.label": "spam"}, properties)
+	decoded := &testModel{}
+	testutil.Ok(t, FromProperties(properties, decoded))
+	testutil.Equals(t, &testModel{NodeInfo: NodeInfo{Name: "a node"}, Label: "spam"}, decoded)
+
+	err := FromProperties(Props{"golem.test.weight": 1.0}, &testModel{})
+	testutil.Equals(t, &PropertyError{Key: "golem.test.label", Err: ErrMissingProperty}, err)
+	testutil.NotOk(t, FromProperties(properties, testModel{}))
+}
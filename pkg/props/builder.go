@@ -2,14 +2,13 @@ package props
 
 import (
 	"fmt"
-	"strings"
 
-	"github.com/fatih/structs"
+	"github.com/hhio618/go-golem/pkg/constraint"
 )
 
 type DemandBuilder struct {
 	properties  map[string]interface{}
-	constraints []string
+	constraints []constraint.Expr
 }
 
 /*Builds a dictionary of properties and constraints from high-level models.
@@ -39,47 +38,58 @@ example usage:
 */
 func NewDemandBuilder() *DemandBuilder {
 	return &DemandBuilder{
-		constraints: make([]string, 0),
+		constraints: make([]constraint.Expr, 0),
 		properties:  make(map[string]interface{}),
 	}
 }
 
 func (db *DemandBuilder) String() string {
-	return fmt.Sprintf("properties: %v, properties: %v", db.properties, db.constraints)
+	return fmt.Sprintf("properties: %v, constraints: %v", db.properties, db.Constraints())
 }
 
 func (db *DemandBuilder) Properties() map[string]interface{} {
 	return db.properties
 }
 
+// Constraints renders the constraints of the demand, they are always
+// well-formed.
 func (db *DemandBuilder) Constraints() string {
-	cList := db.constraints
-	var cValue string
-	if len(cList) == 0 {
-		cValue = "()"
-	} else if len(cList) == 1 {
-		cValue = cList[0]
-	} else {
-		rules := strings.Join(cList, "\n\t")
-		cValue = fmt.Sprintf("(&%v)", rules)
+	if len(db.constraints) == 1 {
+		return db.constraints[0].String()
 	}
-	return cValue
+	return constraint.And(db.constraints...).String()
 }
 
-func (db *DemandBuilder) Ensure(constraint string) {
-	db.constraints = append(db.constraints, constraint)
+// Ensure adds constraints the offers have to satisfy, none are added if one
+// of them has a key which would not render well-formed.
+func (db *DemandBuilder) Ensure(exprs ...constraint.Expr) error {
+	for _, expr := range exprs {
+		if err := constraint.Validate(expr); err != nil {
+			return err
+		}
+	}
+	db.constraints = append(db.constraints, exprs...)
+	return nil
+}
+
+// EnsureRaw parses `expr` and adds it to the constraints.
+func (db *DemandBuilder) EnsureRaw(expr string) error {
+	parsed, err := constraint.Parse(expr)
+	if err != nil {
+		return err
+	}
+	return db.Ensure(parsed)
+}
+
+// Set sets the property with `key`.
+func (db *DemandBuilder) Set(key string, value interface{}) {
+	db.properties[key] = value
 }
 
+// Add adds the properties of the model to the demand.
 func (db *DemandBuilder) Add(m Model) {
-	kv := m.Keys()
-	base := structs.Map(m)
-	for name := range kv {
-		propId := kv[name]
-		value := base[name]
-		if value == nil {
-			continue
-		}
-		db.properties[propId] = value
+	for key, value := range ToProperties(m) {
+		db.properties[key] = value
 	}
 }
 
@@ -0,0 +1,26 @@
+package props
+
+import (
+	"testing"
+
+	"github.com/hhio618/go-golem/pkg/constraint"
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+func TestDemandBuilderConstraints(t *testing.T) {
+	builder := NewDemandBuilder()
+	testutil.Equals(t, "()", builder.Constraints())
+
+	testutil.Ok(t, builder.Ensure(constraint.Ge(InfVmKeys[InfBaseMem], float32(0.5))))
+	testutil.Equals(t, "(golem.inf.mem.gib>=0.5)", builder.Constraints())
+
+	testutil.Ok(t, builder.Ensure(constraint.Eq(InfVmKeys[InfBaseRuntime], RuntimeTypeVM)))
+	testutil.Ok(t, builder.EnsureRaw("(&(golem.inf.storage.gib>=2)\n\t(golem.inf.cpu.cores>=2))"))
+	testutil.Equals(t, "(&(golem.inf.mem.gib>=0.5)(golem.runtime.name=vm)(golem.inf.storage.gib>=2)(golem.inf.cpu.cores>=2))",
+		builder.Constraints())
+
+	testutil.NotOk(t, builder.EnsureRaw("(&(golem.inf.mem.gib>=0.5)"))
+	testutil.NotOk(t, builder.Ensure(constraint.Present("golem.inf.cpu.cores"), constraint.Eq("cpu cores", 2)))
+	_, err := constraint.Parse(builder.Constraints())
+	testutil.Ok(t, err)
+}
@@ -0,0 +1,270 @@
+package props
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// ErrMissingProperty is the cause of the PropertyError returned for a
+// required property which is not set.
+var ErrMissingProperty = errors.New("missing required property")
+
+// PropertyError is returned by FromProperties when the property with Key is
+// missing or can't be converted to the type of its field.
+type PropertyError struct {
+	Key   string
+	Value interface{}
+	Err   error
+}
+
+func (e *PropertyError) Error() string {
+	if e.Err == ErrMissingProperty {
+		return fmt.Sprintf("property '%v': %v", e.Key, e.Err)
+	}
+	return fmt.Sprintf("property '%v': invalid value %#v: %v", e.Key, e.Value, e.Err)
+}
+
+// Cause returns the underlying error, for errors.Cause.
+func (e *PropertyError) Cause() error {
+	return e.Err
+}
+
+type validator interface {
+	Validate() error
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	decimalType = reflect.TypeOf(decimal.Decimal{})
+)
+
+/*
+coerce converts a property value to `typ`.
+
+The values come either from the market API, where JSON numbers are float64
+and lists are []interface{} or JSON-encoded strings, or from ToProperties.
+Times are milliseconds since the epoch and decimals are strings or numbers.
+Numbers are converted only when they fit in `typ` without loss, and the
+values implementing Validate, like the enums, are validated.
+*/
+func coerce(prop interface{}, typ reflect.Type) (reflect.Value, error) {
+	val, err := convert(prop, typ)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if v, ok := val.Interface().(validator); ok {
+		if err := v.Validate(); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+	return val, nil
+}
+
+// coerceProperty converts the required property with `key` to `typ`, the
+// errors are PropertyErrors.
+func coerceProperty(props Props, key string, typ reflect.Type) (reflect.Value, error) {
+	prop, ok := props[key]
+	if !ok {
+		return reflect.Value{}, &PropertyError{Key: key, Err: ErrMissingProperty}
+	}
+	val, err := coerce(prop, typ)
+	if err != nil {
+		return reflect.Value{}, &PropertyError{Key: key, Value: prop, Err: err}
+	}
+	return val, nil
+}
+
+func convert(prop interface{}, typ reflect.Type) (reflect.Value, error) {
+	if prop == nil {
+		return reflect.Value{}, fmt.Errorf("expected %v, got null", typ)
+	}
+	switch typ {
+	case timeType:
+		if t, ok := prop.(time.Time); ok {
+			return reflect.ValueOf(t), nil
+		}
+		millis, err := toInt(prop)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("expected milliseconds since the epoch: %v", err)
+		}
+		return reflect.ValueOf(time.Unix(0, millis*int64(time.Millisecond)).UTC()), nil
+	case decimalType:
+		switch v := prop.(type) {
+		case decimal.Decimal:
+			return reflect.ValueOf(v), nil
+		case string:
+			d, err := decimal.NewFromString(v)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("expected a decimal: %v", err)
+			}
+			return reflect.ValueOf(d), nil
+		}
+		f, err := toFloat(prop)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("expected a decimal: %v", err)
+		}
+		return reflect.ValueOf(decimal.NewFromFloat(f)), nil
+	}
+
+	val := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Bool:
+		switch v := prop.(type) {
+		case bool:
+			val.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("expected a boolean")
+			}
+			val.SetBool(b)
+		default:
+			return reflect.Value{}, fmt.Errorf("expected a boolean, got %T", prop)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := toInt(prop)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if val.OverflowInt(i) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %v", i, typ)
+		}
+		val.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := toInt(prop)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if i < 0 || val.OverflowUint(uint64(i)) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %v", i, typ)
+		}
+		val.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat(prop)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if val.OverflowFloat(f) {
+			return reflect.Value{}, fmt.Errorf("%v overflows %v", f, typ)
+		}
+		val.SetFloat(f)
+	case reflect.String:
+		// Enums may be given as such or as plain strings.
+		rv := reflect.ValueOf(prop)
+		if rv.Kind() != reflect.String {
+			return reflect.Value{}, fmt.Errorf("expected a string, got %T", prop)
+		}
+		val.SetString(rv.String())
+	case reflect.Slice:
+		items, err := toList(prop)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		val.Set(reflect.MakeSlice(typ, len(items), len(items)))
+		for i, item := range items {
+			itemVal, err := coerce(item, typ.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("item %d: %v", i, err)
+			}
+			val.Index(i).Set(itemVal)
+		}
+	default:
+		v := reflect.ValueOf(prop)
+		if !v.Type().AssignableTo(typ) {
+			return reflect.Value{}, fmt.Errorf("expected %v, got %T", typ, prop)
+		}
+		val.Set(v)
+	}
+	return val, nil
+}
+
+// toInt converts a number, or a string holding one, to an int64 if it is
+// integral.
+func toInt(prop interface{}) (int64, error) {
+	switch v := prop.(type) {
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected an integer")
+		}
+		return i, nil
+	case json.Number:
+		return toInt(string(v))
+	}
+	rv := reflect.ValueOf(prop)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return 0, fmt.Errorf("%v overflows int64", rv.Uint())
+		}
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, fmt.Errorf("expected an integer, got %v", f)
+		}
+		return int64(f), nil
+	}
+	return 0, fmt.Errorf("expected an integer, got %T", prop)
+}
+
+// toFloat converts a number, or a string holding one, to a float64.
+func toFloat(prop interface{}) (float64, error) {
+	switch v := prop.(type) {
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected a number")
+		}
+		return f, nil
+	case json.Number:
+		return toFloat(string(v))
+	case float32:
+		// Through its shortest representation so that 0.1 stays 0.1.
+		return strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+	}
+	rv := reflect.ValueOf(prop)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	return 0, fmt.Errorf("expected a number, got %T", prop)
+}
+
+// toList returns the items of a slice or of a string holding a JSON list, a
+// string holding any other JSON value is a list of one item.
+func toList(prop interface{}) ([]interface{}, error) {
+	if s, ok := prop.(string); ok {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(s), &decoded); err != nil {
+			return nil, fmt.Errorf("expected a list")
+		}
+		if list, ok := decoded.([]interface{}); ok {
+			return list, nil
+		}
+		return []interface{}{decoded}, nil
+	}
+	rv := reflect.ValueOf(prop)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, got %T", prop)
+	}
+	items := make([]interface{}, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, nil
+}
@@ -0,0 +1,87 @@
+package props
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/testutil"
+	"github.com/pkg/errors"
+)
+
+func TestFromPropertiesCoercion(t *testing.T) {
+	var offer Props
+	testutil.Ok(t, json.Unmarshal([]byte(`{
+		"golem.inf.mem.gib": 0.5,
+		"golem.inf.storage.gib": "2.5",
+		"golem.inf.cpu.cores": 4.0,
+		"golem.runtime.name": "vm",
+		"golem.activity.caps.transfer.protocol": "[\"http\", \"gftp\"]",
+		"golem.activity.cost_cap": "12.345",
+		"golem.activity.cost_warning": 10,
+		"golem.activity.timeout_secs": "60",
+		"golem.srv.comp.expiration": 1601655628772,
+		"golem.srv.caps.multi-activity": "true"
+	}`), &offer))
+
+	infVm := &InfVm{}
+	testutil.Ok(t, FromProperties(offer, infVm))
+	testutil.Equals(t, &InfVm{
+		InfBase: InfBase{Mem: 0.5, Runtime: RuntimeTypeVM, Storage: 2.5, Transfers: []string{"http", "gftp"}},
+		Cores:   4,
+	}, infVm)
+
+	activity := &Activity{}
+	testutil.Ok(t, FromProperties(offer, activity))
+	testutil.Equals(t, "12.345", activity.CostCap.String())
+	testutil.Equals(t, "10", activity.CostWarning.String())
+	testutil.Equals(t, float32(60), activity.TimeoutSecs)
+	testutil.Assert(t, activity.Expiration.Equal(time.Unix(1601655628, 772*int64(time.Millisecond))),
+		"unexpected expiration %v", activity.Expiration)
+	testutil.Equals(t, true, activity.MultiActivity)
+}
+
+func TestFromPropertiesErrors(t *testing.T) {
+	valid := Props{
+		"golem.inf.mem.gib":   0.5,
+		"golem.inf.cpu.cores": 4.0,
+		"golem.runtime.name":  "vm",
+	}
+	testCases := []struct {
+		Key   string
+		Value interface{}
+		Err   string
+	}{
+		{"golem.inf.cpu.cores", 2.5, "property 'golem.inf.cpu.cores': invalid value 2.5: expected an integer, got 2.5"},
+		{"golem.inf.cpu.cores", "many", "property 'golem.inf.cpu.cores': invalid value \"many\": expected an integer"},
+		{"golem.inf.mem.gib", 1e40, "property 'golem.inf.mem.gib': invalid value 1e+40: 1e+40 overflows float32"},
+		{"golem.runtime.name", "docker", "property 'golem.runtime.name': invalid value \"docker\": unknown enum value: docker"},
+		{"golem.runtime.name", 1.0, "property 'golem.runtime.name': invalid value 1: expected a string, got float64"},
+		{"golem.activity.caps.transfer.protocol", "http", "property 'golem.activity.caps.transfer.protocol': invalid value \"http\": expected a list"},
+		{"golem.activity.caps.transfer.protocol", []interface{}{"http", nil}, "property 'golem.activity.caps.transfer.protocol': invalid value []interface {}{\"http\", interface {}(nil)}: item 1: expected string, got null"},
+		{"golem.inf.mem.gib", nil, "property 'golem.inf.mem.gib': invalid value <nil>: expected float32, got null"},
+	}
+	for _, tc := range testCases {
+		properties := Props{}
+		for key, value := range valid {
+			properties[key] = value
+		}
+		properties[tc.Key] = tc.Value
+		err := FromProperties(properties, &InfVm{})
+		testutil.NotOk(t, err, "key %v, value %v", tc.Key, tc.Value)
+		propErr, ok := err.(*PropertyError)
+		testutil.Assert(t, ok, "expected a PropertyError, got %T", err)
+		testutil.Equals(t, tc.Key, propErr.Key)
+		testutil.Equals(t, tc.Err, err.Error())
+	}
+
+	err := FromProperties(Props{"golem.inf.mem.gib": 0.5}, &InfVm{})
+	testutil.Equals(t, ErrMissingProperty, errors.Cause(err))
+
+	activity := &Activity{}
+	err = FromProperties(Props{"golem.srv.comp.expiration": "tomorrow"}, activity)
+	testutil.Equals(t, "property 'golem.srv.comp.expiration': invalid value \"tomorrow\": expected milliseconds since the epoch: expected an integer", err.Error())
+	err = FromProperties(Props{"golem.activity.cost_cap": "cheap"}, activity)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "golem.activity.cost_cap", err.(*PropertyError).Key)
+}
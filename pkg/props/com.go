@@ -2,8 +2,7 @@ package props
 
 import (
 	"fmt"
-	"log"
-	"strconv"
+	"reflect"
 )
 
 const (
@@ -70,87 +69,70 @@ const (
 )
 
 type Com struct {
-	Scheme     BillingScheme `field:"optional"`
-	PriceModel PriceModel    `field:"optional"`
-}
-
-func (c *Com) Keys() map[string]string {
-	return map[string]string{
-		ComScheme:     SCHEME,
-		ComPriceModel: PRICE_MODEL,
-	}
+	Scheme     BillingScheme `prop:"golem.com.scheme,optional"`
+	PriceModel PriceModel    `prop:"golem.com.pricing.model,optional"`
 }
 
 type ComLinear struct {
 	Com
 	FixedPrice float32
 	PriceFor   map[Counter]float32
+	// UsageVector lists the counters in the order in which an activity reports its usage.
+	UsageVector []Counter
 }
 
-func (cl *ComLinear) Keys() map[string]string {
-	baseKeys := cl.Com.Keys()
-	return baseKeys
-}
-
+// CustomMapping reads the coefficients, the last of which is the fixed price,
+// and the usage vector they are given in the order of.
 func (cl *ComLinear) CustomMapping(props Props) error {
 	if cl.PriceModel != PriceModelLINEAR {
-		log.Fatal("expected linear pricing model")
+		return &PropertyError{Key: PRICE_MODEL, Value: string(cl.PriceModel), Err: fmt.Errorf("expected linear pricing model")}
 	}
-	_coeffs, ok := props[LINEAR_COEFFS]
-	if !ok {
-		return fmt.Errorf("missing key: '%v'", LINEAR_COEFFS)
-	}
-	_usages, ok := props[DEFINED_USAGES]
-	if !ok {
-		return fmt.Errorf("missing key: '%v'", DEFINED_USAGES)
-	}
-	coeffs, err := asList(_coeffs)
+	coeffs, err := coerceProperty(props, LINEAR_COEFFS, reflect.TypeOf([]float64{}))
 	if err != nil {
 		return err
 	}
-	usages, err := asList(_usages)
+	usages, err := coerceProperty(props, DEFINED_USAGES, reflect.TypeOf([]Counter{}))
 	if err != nil {
 		return err
 	}
-	// Pop from coeffs.
-	if len(coeffs) == 0 {
-		return fmt.Errorf("pop from empty list")
-	}
-	// Make sure there are coressponding values for input coeffs.
-	if len(coeffs) < len(usages) {
-		return fmt.Errorf("list index out of range")
-	}
-
-	_fixedPrice, coeffs := coeffs[len(coeffs)-1], coeffs[:len(coeffs)-1]
-	fixedPrice, err := getFloat(_fixedPrice)
-	if err != nil {
-		return err
+	usageVector := usages.Interface().([]Counter)
+	prices := coeffs.Interface().([]float64)
+	if len(prices) != len(usageVector)+1 {
+		return &PropertyError{Key: LINEAR_COEFFS, Value: props[LINEAR_COEFFS],
+			Err: fmt.Errorf("expected %d coefficients for the usage vector and the fixed price", len(usageVector)+1)}
 	}
 	priceFor := make(map[Counter]float32)
-	for i := range coeffs {
-		coeff, err := getFloat(coeffs[i])
-		if err != nil {
-			return fmt.Errorf("could not convert string to float")
-		}
+	for i, counter := range usageVector {
 		// Skip on zero coeffs.
-		if coeff == 0 {
+		if prices[i] == 0 {
 			continue
 		}
-		if len(usages) <= i {
-			return fmt.Errorf("list index out of range")
-		}
-		priceFor[Counter(fmt.Sprintf("%v", usages[i]))] = float32(coeff)
+		priceFor[counter] = float32(prices[i])
 	}
-	cl.FixedPrice = float32(fixedPrice)
+	cl.FixedPrice = float32(prices[len(usageVector)])
 	cl.PriceFor = priceFor
+	cl.UsageVector = usageVector
 	return nil
 }
 
-func getFloat(v string) (float64, error) {
-	errMsg := "could not convert string to float"
-	x, err := strconv.ParseFloat(v, 64)
-	if err != nil {
-		return 0, fmt.Errorf(errMsg)
+// CustomEncoding writes the coefficients in the order of the usage vector,
+// followed by the fixed price.
+func (cl *ComLinear) CustomEncoding(props Props) {
+	coeffs := make([]interface{}, 0, len(cl.UsageVector)+1)
+	usages := make([]interface{}, len(cl.UsageVector))
+	for i, counter := range cl.UsageVector {
+		coeffs = append(coeffs, cl.PriceFor[counter])
+		usages[i] = string(counter)
+	}
+	props[LINEAR_COEFFS] = append(coeffs, cl.FixedPrice)
+	props[DEFINED_USAGES] = usages
+}
+
+// Cost returns the amount due for `usage` under the linear pricing model.
+func (cl *ComLinear) Cost(usage map[Counter]float64) float64 {
+	cost := float64(cl.FixedPrice)
+	for counter, value := range usage {
+		cost += float64(cl.PriceFor[counter]) * value
 	}
-	return x, nil
+	return cost
 }
@@ -0,0 +1,52 @@
+package props
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+/*
+ToProperties is the counterpart of FromProperties, it converts the model to
+its dictionary representation.
+
+Times are encoded as milliseconds since the epoch, decimals as strings, enums
+as their plain string values and slices as lists of encoded items. Optional
+fields left to their zero value are omitted.
+*/
+func ToProperties(model Model) Props {
+	props := make(Props)
+	for _, field := range modelFields(model) {
+		if field.Optional && field.Value.IsZero() {
+			continue
+		}
+		props[field.Key] = encodeValue(field.Value)
+	}
+	if encoder, ok := model.(CustomEncoder); ok {
+		encoder.CustomEncoding(props)
+	}
+	return props
+}
+
+// encodeValue converts a field value to the representation Golem expects.
+func encodeValue(val reflect.Value) interface{} {
+	switch v := val.Interface().(type) {
+	case time.Time:
+		return v.UnixNano() / int64(time.Millisecond)
+	case decimal.Decimal:
+		return v.String()
+	}
+	switch val.Kind() {
+	case reflect.String:
+		// Enums like RuntimeType.
+		return val.String()
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, val.Len())
+		for i := range list {
+			list[i] = encodeValue(val.Index(i))
+		}
+		return list
+	}
+	return val.Interface()
+}
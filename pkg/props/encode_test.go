@@ -0,0 +1,108 @@
+package props
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestToPropertiesRoundTrip(t *testing.T) {
+	expiration := time.Unix(1601655628, 772*int64(time.Millisecond)).UTC()
+	testCases := []struct {
+		Model      Model
+		Decoded    Model
+		Properties Props
+	}{
+		{
+			Model:   &NodeInfo{Name: "a node", SubnetTag: "testnet"},
+			Decoded: &NodeInfo{},
+			Properties: Props{
+				"golem.node.id.name":      "a node",
+				"golem.node.debug.subnet": "testnet",
+			},
+		},
+		{
+			Model: &Activity{
+				CostCap:       decimal.RequireFromString("1.5"),
+				TimeoutSecs:   60,
+				Expiration:    expiration,
+				MultiActivity: true,
+			},
+			Decoded: &Activity{},
+			Properties: Props{
+				"golem.activity.cost_cap":       "1.5",
+				"golem.activity.timeout_secs":   float32(60),
+				"golem.srv.comp.expiration":     int64(1601655628772),
+				"golem.srv.caps.multi-activity": true,
+			},
+		},
+		{
+			Model: &InfVm{
+				InfBase: InfBase{Mem: 0.5, Runtime: RuntimeTypeVM, Storage: 2, Transfers: []string{"http", "gftp"}},
+				Cores:   4,
+			},
+			Decoded: &InfVm{},
+			Properties: Props{
+				"golem.inf.mem.gib":                     float32(0.5),
+				"golem.runtime.name":                    "vm",
+				"golem.inf.storage.gib":                 float32(2),
+				"golem.activity.caps.transfer.protocol": []interface{}{"http", "gftp"},
+				"golem.inf.cpu.cores":                   4,
+			},
+		},
+		{
+			Model: &VMRequest{
+				ExeUnitRequest: ExeUnitRequest{PackageUrl: "hash:sha3:abc:http://repo/abc.gvmi"},
+				PackageFormat:  VmPackageFormatGVMKIT_SQUASH,
+			},
+			Decoded: &VMRequest{},
+			Properties: Props{
+				"golem.srv.comp.task_package":      "hash:sha3:abc:http://repo/abc.gvmi",
+				"golem.srv.comp.vm.package_format": "gvmkit-squash",
+			},
+		},
+		{
+			Model: &ComLinear{
+				Com:         Com{Scheme: BillingSchemePAYU, PriceModel: PriceModelLINEAR},
+				FixedPrice:  0.5,
+				PriceFor:    map[Counter]float32{CounterCPU: 0.1},
+				UsageVector: []Counter{CounterCPU, CounterTIME},
+			},
+			Decoded: &ComLinear{},
+			Properties: Props{
+				"golem.com.scheme":                      "payu",
+				"golem.com.pricing.model":               "linear",
+				"golem.com.pricing.model.linear.coeffs": []interface{}{float32(0.1), float32(0), float32(0.5)},
+				"golem.com.usage.vector":                []interface{}{"golem.usage.cpu_sec", "golem.usage.duration_sec"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		properties := ToProperties(tc.Model)
+		testutil.Equals(t, tc.Properties, properties)
+		testutil.Ok(t, FromProperties(properties, tc.Decoded))
+		testutil.Equals(t, tc.Model, tc.Decoded)
+
+		// The properties survive their trip through the market API.
+		encoded, err := json.Marshal(properties)
+		testutil.Ok(t, err)
+		var decoded Props
+		testutil.Ok(t, json.Unmarshal(encoded, &decoded))
+		testutil.Ok(t, FromProperties(decoded, tc.Decoded))
+		testutil.Equals(t, tc.Model, tc.Decoded)
+	}
+}
+
+func TestDemandBuilderAdd(t *testing.T) {
+	builder := NewDemandBuilder()
+	builder.Add(&NodeInfo{Name: "a node", SubnetTag: "testnet"})
+	builder.Add(&Activity{Expiration: time.Unix(1601655628, 772*int64(time.Millisecond))})
+	testutil.Equals(t, map[string]interface{}{
+		"golem.node.id.name":        "a node",
+		"golem.node.debug.subnet":   "testnet",
+		"golem.srv.comp.expiration": int64(1601655628772),
+	}, builder.Properties())
+}
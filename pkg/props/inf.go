@@ -53,19 +53,10 @@ const (
 )
 
 type InfBase struct {
-	Mem       float32
-	Runtime   RuntimeType
-	Storage   float32  `field:"optional"`
-	Transfers []string `field:"optional"`
-}
-
-func (ib *InfBase) Keys() map[string]string {
-	return map[string]string{
-		InfBaseMem:       INF_MEM,
-		InfBaseRuntime:   "golem.runtime.name",
-		InfBaseStorage:   INF_STORAGE,
-		InfBaseTransfers: TRANSFER_CAPS,
-	}
+	Mem       float32     `prop:"golem.inf.mem.gib"`
+	Runtime   RuntimeType `prop:"golem.runtime.name"`
+	Storage   float32     `prop:"golem.inf.storage.gib,optional"`
+	Transfers []string    `prop:"golem.activity.caps.transfer.protocol,optional"`
 }
 
 const (
@@ -74,33 +65,26 @@ const (
 
 type InfVm struct {
 	InfBase
-	Cores int
+	Cores int `prop:"golem.inf.cpu.cores"`
 }
 
-func (iv *InfVm) Keys() map[string]string {
-	baseMap := iv.InfBase.Keys()
-	baseMap[InfVmCores] = INF_CORES
-	return baseMap
+func (iv *InfVm) CustomMapping(props Props) error {
+	iv.Runtime = RuntimeTypeVM
+	return nil
 }
 
-func (iv *InfVm) CustomMapping(props Props) {
-	iv.Runtime = RuntimeTypeVM
+func (iv *InfVm) CustomEncoding(props Props) {
+	props[InfVmKeys[InfBaseRuntime]] = string(RuntimeTypeVM)
 }
 
-var InfVmKeys = (&InfVm{}).Keys()
+var InfVmKeys = Keys(&InfVm{})
 
 const (
 	ExeUnitRequestPackageUrl = "PackageUrl"
 )
 
 type ExeUnitRequest struct {
-	PackageUrl string
-}
-
-func (eur *ExeUnitRequest) Keys() map[string]string {
-	return map[string]string{
-		ExeUnitRequestPackageUrl: "golem.srv.comp.task_package",
-	}
+	PackageUrl string `prop:"golem.srv.comp.task_package"`
 }
 
 type VmPackageFormat string
@@ -125,15 +109,5 @@ const (
 
 type VMRequest struct {
 	ExeUnitRequest
-	PackageFormat VmPackageFormat
-}
-
-func (vmr *VMRequest) Keys() map[string]string {
-	baseKeys := vmr.ExeUnitRequest.Keys()
-	baseKeys[VMRequestPackageFormat] = "golem.srv.comp.vm.package_format"
-	return baseKeys
-
-}
-func (vmr *VMRequest) CustomMapping(props Props) error {
-	return nil
+	PackageFormat VmPackageFormat `prop:"golem.srv.comp.vm.package_format"`
 }
@@ -1,44 +1,59 @@
 package rest
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"io"
+	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	level "github.com/go-kit/kit/log/level"
 	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/script"
 	activity "github.com/hhio618/ya-go-client/ya-activity"
 	sse "github.com/r3labs/sse/v2"
 )
 
 // ActivityService
 type ActivityService struct {
-	ctx    context.Context
-	client *activity.APIClient
-	api    *activity.RequestorControlApiService
-	state  *activity.RequestorStateApiService
-	logger log.Logger
+	ctx     context.Context
+	client  *activity.APIClient
+	api     *activity.RequestorControlApiService
+	state   *activity.RequestorStateApiService
+	logger  log.Logger
+	backoff Backoff
 }
 
 func NewActivityService(ctx context.Context, client *activity.APIClient, logger log.Logger) *ActivityService {
 	return &ActivityService{
-		ctx:    ctx,
-		client: client,
-		api:    client.RequestorControlApi,
-		state:  client.RequestorStateApi,
-		logger: logger,
+		ctx:     ctx,
+		client:  client,
+		api:     client.RequestorControlApi,
+		state:   client.RequestorStateApi,
+		logger:  logger,
+		backoff: DefaultBackoff,
 	}
 }
 
+// SetBackoff sets the backoff of the batches polled for their results.
+func (as *ActivityService) SetBackoff(backoff Backoff) {
+	as.backoff = backoff
+}
+
 func (as *ActivityService) NewActivity(agreementId string) (*Activity, error) {
 	res, _, err := as.api.CreateActivity(as.ctx).AgreementId(agreementId).Execute()
 	if err != nil {
 		level.Error(as.logger).Log("msg", "creating activity", "err", err)
+		return nil, err
 	}
 	activityId, err := strconv.Unquote(res.(string))
 	if err != nil {
@@ -48,25 +63,75 @@ func (as *ActivityService) NewActivity(agreementId string) (*Activity, error) {
 
 }
 
+// Activity states as reported by the exe-unit.
+const (
+	ActivityStateNew          = "New"
+	ActivityStateInitialized  = "Initialized"
+	ActivityStateDeployed     = "Deployed"
+	ActivityStateReady        = "Ready"
+	ActivityStateTerminated   = "Terminated"
+	ActivityStateUnresponsive = "Unresponsive"
+)
+
 type Activity struct {
 	*ActivityService
-	id string
+	id          string
+	usageVector []props.Counter
 }
 
 func (a *Activity) Id() string {
 	return a.id
 }
 
+// SetUsageVector sets the counters reported by the activity, in the order of
+// the agreement's `golem.com.usage.vector` property.
+func (a *Activity) SetUsageVector(usageVector []props.Counter) {
+	a.usageVector = usageVector
+}
+
 func (a *Activity) State() (*activity.ActivityState, error) {
 	res, _, err := a.state.GetActivityState(a.ctx, a.id).Execute()
 	if err != nil {
 		level.Error(a.logger).Log("msg", "getting activity state", "err", err)
+		return nil, err
 	}
 	return &res, nil
 }
 
-func (a *Activity) Send(script []map[string]interface{}, stream bool, deadline time.Time) (Poller, error) {
-	scriptText, err := json.Marshal(script)
+// CurrentState returns the current state of the activity, e.g. "Ready".
+func (a *Activity) CurrentState() (string, error) {
+	state, err := a.State()
+	if err != nil {
+		return "", err
+	}
+	if len(state.State) == 0 || state.State[0] == nil {
+		return "", fmt.Errorf("missing state of activity %v", a.id)
+	}
+	return *state.State[0], nil
+}
+
+// Usage returns the current usage of the activity keyed by counter, the
+// values are matched against the usage vector set with SetUsageVector.
+func (a *Activity) Usage() (map[props.Counter]float64, error) {
+	res, _, err := a.state.GetActivityUsage(a.ctx, a.id).Execute()
+	if err != nil {
+		level.Error(a.logger).Log("msg", "getting activity usage", "err", err)
+		return nil, err
+	}
+	currentUsage := res.GetCurrentUsage()
+	if len(currentUsage) > len(a.usageVector) {
+		return nil, fmt.Errorf("usage of activity %v has %v values, usage vector has %v counters",
+			a.id, len(currentUsage), len(a.usageVector))
+	}
+	usage := make(map[props.Counter]float64, len(currentUsage))
+	for i, value := range currentUsage {
+		usage[a.usageVector[i]] = float64(value)
+	}
+	return usage, nil
+}
+
+func (a *Activity) Send(commands script.Script, stream bool, deadline time.Time) (Poller, error) {
+	scriptText, err := json.Marshal(commands)
 	if err != nil {
 		return nil, err
 	}
@@ -81,9 +146,13 @@ func (a *Activity) Send(script []map[string]interface{}, stream bool, deadline t
 		return nil, err
 	}
 	if stream {
-		return NewStreamingBatch(a.logger, a.client, a.api, a.id, batchId, len(script), deadline), nil
+		sb := NewStreamingBatch(a.logger, a.client, a.api, a.id, batchId, len(commands), deadline)
+		sb.SetBackoff(a.backoff)
+		return sb, nil
 	}
-	return NewPollingBatch(a.logger, a.api, a.id, batchId, len(script), deadline), nil
+	pb := NewPollingBatch(a.logger, a.api, a.id, batchId, len(commands), deadline)
+	pb.SetBackoff(a.backoff)
+	return pb, nil
 }
 
 func (a *Activity) DestroyActivity(excType, excVal, excTb interface{}) {
@@ -124,6 +193,17 @@ func (b *BatchTimeoutError) Error() string {
 	return "batch timeout error"
 }
 
+// BatchCancelledError is sent by a Poller whose batch was cancelled before it finished.
+type BatchCancelledError struct {
+}
+
+func (b *BatchCancelledError) Error() string {
+	return "batch cancelled"
+}
+
+// interruptTimeout bounds the calls made to stop a cancelled batch.
+const interruptTimeout = 10 * time.Second
+
 type Batch struct {
 	logger     log.Logger
 	api        *activity.RequestorControlApiService
@@ -131,10 +211,100 @@ type Batch struct {
 	batchId    string
 	size       int
 	deadline   time.Time
+
+	lock          sync.Mutex
+	cancel        context.CancelFunc
+	cancelled     bool
+	interruptOnce sync.Once
+	interruptErr  error
+	destroyed     bool
 }
 
 type Poller interface {
-	Poll(ctx context.Context) (eventCh chan *executer.CommandEventContext, errCh chan error)
+	Poll(ctx context.Context) (eventCh chan *event.CommandEventContext, errCh chan error)
+	// Cancel stops polling and interrupts the batch on the activity.
+	Cancel() error
+	// Cancelled reports whether the batch was cancelled.
+	Cancelled() bool
+	// Destroyed reports whether the activity had to be destroyed to stop the batch.
+	Destroyed() bool
+}
+
+// start derives the polling context, which is cancelled by Cancel.
+func (b *Batch) start(ctx context.Context) context.Context {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ctx, b.cancel = context.WithCancel(ctx)
+	if b.cancelled {
+		b.cancel()
+	}
+	return ctx
+}
+
+// stop is called once polling ends, a batch which was cut short by its
+// context is interrupted and reported as cancelled on `errCh`.
+func (b *Batch) stop(ctx context.Context, finished bool, errCh chan error) {
+	if finished || ctx.Err() == nil {
+		return
+	}
+	b.lock.Lock()
+	b.cancelled = true
+	b.lock.Unlock()
+	b.interrupt()
+	select {
+	case errCh <- &BatchCancelledError{}:
+	default:
+	}
+}
+
+func (b *Batch) Cancel() error {
+	b.lock.Lock()
+	b.cancelled = true
+	cancel := b.cancel
+	b.lock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return b.interrupt()
+}
+
+func (b *Batch) Cancelled() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.cancelled
+}
+
+func (b *Batch) Destroyed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.destroyed
+}
+
+// interrupt terminates the runtime so that the activity can be deployed again,
+// the activity is destroyed if it does not accept the terminate command.
+func (b *Batch) interrupt() error {
+	b.interruptOnce.Do(func() {
+		ctx, cncl := context.WithTimeout(context.Background(), interruptTimeout)
+		defer cncl()
+		terminate, _ := json.Marshal(script.Script{&script.Terminate{}})
+		req := activity.NewExeScriptRequest(string(terminate))
+		_, _, err := b.api.Exec(ctx, b.activityId).Script(*req).Execute()
+		if err == nil {
+			level.Debug(b.logger).Log("msg", "batch interrupted", "batchId", b.batchId)
+			return
+		}
+		level.Debug(b.logger).Log("msg", "terminating runtime", "batchId", b.batchId, "err", err)
+		_, err = b.api.DestroyActivity(ctx, b.activityId).Execute()
+		if err != nil {
+			level.Error(b.logger).Log("msg", "destroying activity", "id", b.activityId, "err", err)
+			b.interruptErr = err
+			return
+		}
+		b.lock.Lock()
+		b.destroyed = true
+		b.lock.Unlock()
+	})
+	return b.interruptErr
 }
 
 func (b *Batch) SecondsLeft() float32 {
@@ -144,8 +314,47 @@ func (b *Batch) Id() string {
 	return b.batchId
 }
 
+// Backoff configures the delays between the requests of a PollingBatch.
+type Backoff struct {
+	// Initial is the delay after the first request without new results.
+	Initial time.Duration
+	// Max bounds the delay between two requests.
+	Max time.Duration
+	// Multiplier grows the delay after every request without new results.
+	Multiplier float64
+	// MaxRetries bounds the number of consecutive network errors, zero
+	// means retrying until the deadline of the batch.
+	MaxRetries int
+}
+
+// DefaultBackoff is the backoff used unless set with SetBackoff.
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        3 * time.Second,
+	Multiplier: 2,
+}
+
+func (b Backoff) next(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		return b.Initial
+	}
+	delay = time.Duration(float64(delay) * b.Multiplier)
+	if delay > b.Max {
+		return b.Max
+	}
+	return delay
+}
+
+const (
+	// pollTimeoutMax bounds the time the API may hold a single results request.
+	pollTimeoutMax = 5 * time.Second
+	// pollRequestSlack is added to the client side timeout of a results request.
+	pollRequestSlack = 2 * time.Second
+)
+
 type PollingBatch struct {
 	Batch
+	backoff Backoff
 }
 
 func NewPollingBatch(logger log.Logger, api *activity.RequestorControlApiService, activityId, batchId string, size int, deadline time.Time) *PollingBatch {
@@ -158,85 +367,162 @@ func NewPollingBatch(logger log.Logger, api *activity.RequestorControlApiService
 			size:       size,
 			deadline:   deadline,
 		},
+		backoff: DefaultBackoff,
 	}
 }
 
-func (pb *PollingBatch) Poll(ctx context.Context) (eventCh chan *executer.CommandEventContext, errCh chan error) {
-	errCh = make(chan error)
+// SetBackoff sets the delays between the requests for results.
+func (pb *PollingBatch) SetBackoff(backoff Backoff) {
+	pb.backoff = backoff
+}
+
+// Poll fetches the results of the batch until the last command was executed,
+// a command failed, the deadline passed or `ctx` is done. Both channels are
+// closed once polling ends, an error is sent on `errCh` before it is closed.
+func (pb *PollingBatch) Poll(ctx context.Context) (eventCh chan *event.CommandEventContext, errCh chan error) {
+	errCh = make(chan error, 1)
 	eventCh = make(chan *event.CommandEventContext)
-	lastIdx := 0
+	ctx = pb.start(ctx)
 	go func() {
-		for lastIdx < pb.size {
-			select {
-			case <-ctx.Done():
-				return
-			default:
+		finished := false
+		defer close(eventCh)
+		defer close(errCh)
+		defer func() {
+			pb.stop(ctx, finished, errCh)
+		}()
+		var err error
+		finished, err = pb.poll(ctx, 0, eventCh)
+		if err != nil {
+			errCh <- err
+		}
+	}()
+	return eventCh, errCh
+}
+
+// poll sends the results of the commands from index `lastIdx` on to
+// `eventCh`, it returns true once the batch is finished.
+func (pb *PollingBatch) poll(ctx context.Context, lastIdx int, eventCh chan *event.CommandEventContext) (bool, error) {
+	failures := 0
+	var delay time.Duration
+	for {
+		timeout := time.Until(pb.deadline)
+		if timeout <= 0 {
+			return false, &BatchTimeoutError{}
+		}
+		if timeout > pollTimeoutMax {
+			timeout = pollTimeoutMax
+		}
+		results, resp, err := pb.fetch(ctx, timeout)
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if err != nil {
+			if resp != nil && resp.StatusCode == 408 {
+				// The API had no new results within the timeout.
+				continue
 			}
-			timeout := pb.SecondsLeft()
-			if timeout <= 0 {
-				errCh <- &BatchTimeoutError{}
-				break
+			if resp != nil {
+				return false, err
 			}
-			getBatchCtx, cncl := context.WithTimeout(ctx, time.Second*time.Duration(math.Min(float64(timeout), 5)))
-			defer cncl()
-			results, resp, err := pb.api.GetExecBatchResults(getBatchCtx, pb.activityId, pb.batchId).Execute()
-			select {
-			case <-getBatchCtx.Done():
-				continue
-			default:
+			failures++
+			if pb.backoff.MaxRetries > 0 && failures > pb.backoff.MaxRetries {
+				return false, err
 			}
-			if err != nil {
-				if resp.StatusCode == 408 {
-					continue
-				}
-				errCh <- err
-				break
+			level.Debug(pb.logger).Log("msg", "polling batch results", "batchId", pb.batchId, "attempt", failures, "err", err)
+			delay = pb.backoff.next(delay)
+			if !sleep(ctx, delay, pb.deadline) {
+				return false, nil
 			}
-			anyNew := false
-			results = results[lastIdx:]
-			for _, result := range results {
-				anyNew = true
-				if lastIdx != int(result.Index) {
-					errCh <- fmt.Errorf("expected %v, got %v", lastIdx, result.Index)
-					break
-				}
-				message := ""
-				if result.Message != nil {
-					message = *result.Message
-				} else if result.Stdout != nil || result.Stderr != nil {
-					_message, err := json.Marshal(map[string]string{"stdout": *result.Stdout, "stderr": *result.Stderr})
-					if err != nil {
-						errCh <- err
-					}
-					message = string(_message)
-				}
-				kwargs := map[string]interface{}{
-					"cmd_idx": result.Index,
-					"message": message,
-					"success": (strings.ToLower(result.Result) == "ok"),
-				}
-				eventCh <- &event.CommandEventContext{
-					EvtCls: event.CommandExecuted,
-					Kwargs: kwargs,
-				}
-				lastIdx = int(result.Index + 1)
-				if *result.IsBatchFinished {
-					break
-				}
-
+			continue
+		}
+		failures = 0
+		if len(results) <= lastIdx {
+			delay = pb.backoff.next(delay)
+			if !sleep(ctx, delay, pb.deadline) {
+				return false, nil
 			}
-			if !anyNew {
-				delay := int(math.Min(3, math.Max(0, float64(pb.SecondsLeft()))))
-				time.Sleep(time.Duration(delay) * time.Second)
+			continue
+		}
+		delay = 0
+		for _, result := range results[lastIdx:] {
+			if lastIdx != int(result.Index) {
+				return false, fmt.Errorf("expected %v, got %v", lastIdx, result.Index)
+			}
+			select {
+			case eventCh <- commandExecutedCtx(result):
+			case <-ctx.Done():
+				return false, nil
+			}
+			lastIdx++
+			if result.GetIsBatchFinished() || lastIdx >= pb.size {
+				return true, nil
 			}
 		}
-	}()
-	return eventCh, errCh
+	}
+}
+
+func (pb *PollingBatch) fetch(ctx context.Context, timeout time.Duration) ([]activity.ExeScriptCommandResult, *http.Response, error) {
+	reqCtx, cncl := context.WithTimeout(ctx, timeout+pollRequestSlack)
+	defer cncl()
+	return pb.api.GetExecBatchResults(reqCtx, pb.activityId, pb.batchId).
+		Timeout(float32(timeout.Seconds())).
+		Execute()
+}
+
+// sleep waits for `delay` without passing `deadline`, it returns false if
+// `ctx` is done first.
+func sleep(ctx context.Context, delay time.Duration, deadline time.Time) bool {
+	if left := time.Until(deadline); delay > left {
+		delay = left
+	}
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
 
+func commandExecutedCtx(result activity.ExeScriptCommandResult) *event.CommandEventContext {
+	var stdout, stderr string
+	if result.Stdout != nil {
+		stdout = *result.Stdout
+	}
+	if result.Stderr != nil {
+		stderr = *result.Stderr
+	}
+	message := ""
+	if result.Message != nil {
+		message = *result.Message
+	} else if result.Stdout != nil || result.Stderr != nil {
+		_message, _ := json.Marshal(map[string]string{"stdout": stdout, "stderr": stderr})
+		message = string(_message)
+	}
+	return &event.CommandEventContext{
+		EvtCls: event.CommandExecuted{},
+		Kwargs: map[string]interface{}{
+			"cmd_idx":    int(result.Index),
+			"message":    message,
+			"success":    strings.ToLower(result.Result) == "ok",
+			"stdout":     stdout,
+			"stderr":     stderr,
+			"event_date": result.EventDate,
+		},
+	}
+}
+
+// errStreamUnsupported is returned when the API does not serve the batch as an event stream.
+var errStreamUnsupported = errors.New("event stream not supported")
+
 type StreamingBatch struct {
 	Batch
-	client *activity.APIClient
+	client  *activity.APIClient
+	backoff Backoff
 }
 
 func NewStreamingBatch(logger log.Logger, client *activity.APIClient, api *activity.RequestorControlApiService, activityId, batchId string, size int, deadline time.Time) *StreamingBatch {
@@ -249,61 +535,238 @@ func NewStreamingBatch(logger log.Logger, client *activity.APIClient, api *activ
 			size:       size,
 			deadline:   deadline,
 		},
-		client: client,
+		client:  client,
+		backoff: DefaultBackoff,
 	}
 }
 
-func (sb *StreamingBatch) Poll(ctx context.Context) (eventCh chan *executer.CommandEventContext, errCh chan error) {
-	errCh = make(chan error)
+// SetBackoff sets the delays between reconnections, it is also used when
+// falling back to polling.
+func (sb *StreamingBatch) SetBackoff(backoff Backoff) {
+	sb.backoff = backoff
+}
+
+// Poll streams the events of the batch until the last command was executed,
+// a command failed, the deadline passed or `ctx` is done. A dropped stream is
+// resumed and the batch is polled for its results if the API does not serve
+// event streams. Both channels are closed once polling ends, an error is sent
+// on `errCh` before it is closed.
+func (sb *StreamingBatch) Poll(ctx context.Context) (eventCh chan *event.CommandEventContext, errCh chan error) {
+	errCh = make(chan error, 1)
 	eventCh = make(chan *event.CommandEventContext)
-	lastIdx := 0
-	host := sb.client.GetConfig().Host
-	client := sse.NewClient(fmt.Sprintf("%v/activity/%v/exec/%v", host, sb.activityId, sb.batchId))
-	//TODO: emulate         api_client.update_params_for_auth(headers, None, ["app_key"]).
-	client.Headers = sb.client.GetConfig().DefaultHeader
-
-	var getBatchCtx context.Context
-	var cncl context.CancelFunc
-	sseCh := make(chan *sse.Event)
+	ctx = sb.start(ctx)
+	go func() {
+		finished := false
+		defer close(eventCh)
+		defer close(errCh)
+		defer func() {
+			sb.stop(ctx, finished, errCh)
+		}()
+		var err error
+		finished, err = sb.stream(ctx, eventCh)
+		if err != nil {
+			errCh <- err
+		}
+	}()
+	return eventCh, errCh
+}
+
+// streamState tracks the progress of a batch across reconnections.
+type streamState struct {
+	// next is the index of the first command which was not executed yet.
+	next int
+	// started is the index of the last command whose start was sent.
+	started     int
+	lastEventId string
+}
+
+func (sb *StreamingBatch) stream(ctx context.Context, eventCh chan *event.CommandEventContext) (bool, error) {
+	state := &streamState{started: -1}
+	failures := 0
+	var delay time.Duration
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
+		if time.Until(sb.deadline) <= 0 {
+			return false, &BatchTimeoutError{}
 		}
-		getBatchCtx, cncl = context.WithTimeout(ctx, time.Duration(sb.SecondsLeft())*time.Second)
-		defer cncl()
-		err := client.SubscribeChanWithContext(getBatchCtx, "", sseCh)
-		if err != nil {
-			// Retrying in 5 seconds.
-			time.Sleep(5 * time.Second)
-			continue
+		next := state.next
+		finished, retry, err := sb.connect(ctx, state, eventCh)
+		if finished || ctx.Err() != nil {
+			return finished, nil
+		}
+		if time.Until(sb.deadline) <= 0 {
+			return false, &BatchTimeoutError{}
+		}
+		if errors.Is(err, errStreamUnsupported) {
+			level.Debug(sb.logger).Log("msg", "falling back to polling", "batchId", sb.batchId)
+			pb := NewPollingBatch(sb.logger, sb.api, sb.activityId, sb.batchId, sb.size, sb.deadline)
+			pb.SetBackoff(sb.backoff)
+			return pb.poll(ctx, state.next, eventCh)
+		}
+		if !retry {
+			return false, err
+		}
+		if state.next > next {
+			failures = 0
+			delay = 0
+		}
+		failures++
+		if sb.backoff.MaxRetries > 0 && failures > sb.backoff.MaxRetries {
+			return false, err
+		}
+		level.Debug(sb.logger).Log("msg", "event stream dropped", "batchId", sb.batchId, "attempt", failures, "err", err)
+		delay = sb.backoff.next(delay)
+		if !sleep(ctx, delay, sb.deadline) {
+			return false, nil
 		}
-		break
 	}
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-			case <-getBatchCtx.Done():
-				return
-			case evt := <-sseCh:
-				{
-					evtCtx, err := commandEventCtx(evt)
-					if err != nil {
-						level.Debug(sb.logger).Log("msg", "event stream exception", "batchId", sb.batchId, err, "err")
-					}
-					if evtCtx.ComputationFinished(lastIdx) {
-						return
-					}
+}
 
-				}
+// connect opens the event stream of the batch, resuming after the last
+// received event, and forwards its events until the stream ends. It returns
+// true once the batch is finished and whether a failed stream may be retried.
+func (sb *StreamingBatch) connect(ctx context.Context, state *streamState, eventCh chan *event.CommandEventContext) (bool, bool, error) {
+	streamCtx, cncl := context.WithDeadline(ctx, sb.deadline)
+	defer cncl()
+	streamUrl, err := sb.url()
+	if err != nil {
+		return false, false, err
+	}
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, streamUrl, nil)
+	if err != nil {
+		return false, false, err
+	}
+	// Authenticate the same way as the API client.
+	cfg := sb.client.GetConfig()
+	if cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", cfg.UserAgent)
+	}
+	for key, value := range cfg.DefaultHeader {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if state.lastEventId != "" {
+		req.Header.Set("Last-Event-ID", state.lastEventId)
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, true, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound,
+		resp.StatusCode == http.StatusMethodNotAllowed,
+		resp.StatusCode == http.StatusNotAcceptable,
+		resp.StatusCode == http.StatusNotImplemented:
+		return false, false, errStreamUnsupported
+	case resp.StatusCode >= 500:
+		return false, true, fmt.Errorf("opening event stream: %v", resp.Status)
+	case resp.StatusCode >= 300:
+		return false, false, fmt.Errorf("opening event stream: %v", resp.Status)
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"):
+		return false, false, errStreamUnsupported
+	}
+	return sb.read(streamCtx, resp.Body, state, eventCh)
+}
+
+func (sb *StreamingBatch) read(ctx context.Context, body io.Reader, state *streamState, eventCh chan *event.CommandEventContext) (bool, bool, error) {
+	lastIdx := sb.size - 1
+	reader := sse.NewEventStreamReader(body)
+	for {
+		msg, err := reader.ReadEvent()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
+			return false, true, err
+		}
+		evt := parseEvent(msg)
+		if len(evt.ID) > 0 {
+			state.lastEventId = string(evt.ID)
+		}
+		if len(evt.Data) == 0 {
+			continue
+		}
+		evtCtx, err := commandEventCtx(evt)
+		if err != nil {
+			level.Debug(sb.logger).Log("msg", "event stream exception", "batchId", sb.batchId, "err", err)
+			continue
+		}
+		// Skip the events replayed by a stream which could not be resumed.
+		idx := evtCtx.Idx()
+		if idx < state.next {
+			continue
 		}
+		if _, ok := evtCtx.EvtCls.(event.CommandStarted); ok {
+			if idx <= state.started {
+				continue
+			}
+			state.started = idx
+		}
+		select {
+		case eventCh <- evtCtx:
+		case <-ctx.Done():
+			return false, false, ctx.Err()
+		}
+		if _, ok := evtCtx.EvtCls.(event.CommandExecuted); ok {
+			state.next = idx + 1
+		}
+		if evtCtx.ComputationFinished(lastIdx) {
+			return true, false, nil
+		}
+	}
+}
 
-	}()
+// url returns the address of the batch's event stream, built the same way as
+// the API client builds its request addresses.
+func (sb *StreamingBatch) url() (string, error) {
+	cfg := sb.client.GetConfig()
+	if len(cfg.Servers) == 0 {
+		return "", errors.New("missing activity API server")
+	}
+	base, err := url.Parse(cfg.Servers[0].URL)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Host != "" {
+		base.Host = cfg.Host
+	}
+	if cfg.Scheme != "" {
+		base.Scheme = cfg.Scheme
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + fmt.Sprintf("/activity/%v/exec/%v", sb.activityId, sb.batchId)
+	return base.String(), nil
+}
 
-	return eventCh, errCh
+// parseEvent splits a raw message of an event stream into its fields.
+func parseEvent(msg []byte) *sse.Event {
+	evt := &sse.Event{}
+	data := make([][]byte, 0)
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		field, value := line, []byte{}
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], bytes.TrimPrefix(line[i+1:], []byte(" "))
+		}
+		switch string(field) {
+		case "id":
+			evt.ID = value
+		case "event":
+			evt.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			evt.Retry = value
+		}
+	}
+	if len(data) > 0 {
+		evt.Data = bytes.Join(data, []byte("\n"))
+	}
+	return evt
 }
 
 func commandEventCtx(evt *sse.Event) (*event.CommandEventContext, error) {
@@ -320,9 +783,13 @@ func commandEventCtx(evt *sse.Event) (*event.CommandEventContext, error) {
 		return nil, fmt.Errorf("missing kind")
 	}
 	var evtKind string
-	var evtCls event.CommandClass
+	var evtCls interface{}
+	index, ok := evtMap["index"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("missing index")
+	}
 	Kwargs := map[string]interface{}{
-		"cmd_id": evtMap["index"],
+		"cmd_idx": int(index),
 	}
 	switch concreteVal := evtKinds.(type) {
 	case map[string]interface{}:
@@ -343,7 +810,7 @@ func commandEventCtx(evt *sse.Event) (*event.CommandEventContext, error) {
 				if !ok {
 					return nil, fmt.Errorf("invalid CommandStarted event: missing 'command'")
 				}
-				evtCls = event.Event
+				evtCls = event.CommandStarted{}
 				Kwargs["command"] = command
 			default:
 				return nil, fmt.Errorf("invalid CommandStarted event: missing 'command'")
@@ -359,7 +826,7 @@ func commandEventCtx(evt *sse.Event) (*event.CommandEventContext, error) {
 				if err != nil {
 					return nil, err
 				}
-				evtCls = event.CommandExecuted
+				evtCls = event.CommandExecuted{}
 				Kwargs["success"] = return_code == 0
 				msg, ok := x["message"]
 				if ok {
@@ -369,12 +836,18 @@ func commandEventCtx(evt *sse.Event) (*event.CommandEventContext, error) {
 				return nil, fmt.Errorf("invalid CommandStarted event: missing 'return_code'")
 			}
 		case "stdout":
-			evtCls = event.CommandStdOut
-			Kwargs["output"] = fmt.Sprintf("%v", evtData)
+			evtCls = event.CommandStdOut{}
+			Kwargs["output"], err = commandOutput(evtData)
+			if err != nil {
+				return nil, err
+			}
 
 		case "stderr":
-			evtCls = event.CommandStdErr
-			Kwargs["output"] = fmt.Sprintf("%v", evtData)
+			evtCls = event.CommandStdErr{}
+			Kwargs["output"], err = commandOutput(evtData)
+			if err != nil {
+				return nil, err
+			}
 		default:
 			return nil, fmt.Errorf("unsupported runtime event: %v", evtKind)
 		}
@@ -384,3 +857,28 @@ func commandEventCtx(evt *sse.Event) (*event.CommandEventContext, error) {
 	return &event.CommandEventContext{EvtCls: evtCls, Kwargs: Kwargs}, nil
 
 }
+
+// commandOutput unwraps a chunk of streamed output which is sent either as a
+// plain string, as `{"str": "..."}` or, for binary captures, as `{"bin": [...]}`.
+func commandOutput(data interface{}) (interface{}, error) {
+	switch x := data.(type) {
+	case string:
+		return x, nil
+	case map[string]interface{}:
+		if str, ok := x["str"]; ok {
+			return fmt.Sprintf("%v", str), nil
+		}
+		if bin, ok := x["bin"].([]interface{}); ok {
+			output := make([]byte, len(bin))
+			for i, b := range bin {
+				v, ok := b.(float64)
+				if !ok {
+					return nil, fmt.Errorf("invalid binary output: %v", b)
+				}
+				output[i] = byte(v)
+			}
+			return output, nil
+		}
+	}
+	return fmt.Sprintf("%v", data), nil
+}
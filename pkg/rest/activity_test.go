@@ -0,0 +1,521 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/testutil"
+	activity "github.com/hhio618/ya-go-client/ya-activity"
+)
+
+var testBackoff = Backoff{
+	Initial:    time.Millisecond,
+	Max:        5 * time.Millisecond,
+	Multiplier: 2,
+}
+
+// requestLog records the requests served by a test handler, so that they are
+// checked on the test goroutine.
+type requestLog struct {
+	lock     sync.Mutex
+	requests []*http.Request
+}
+
+// wrap returns `handler` recording its requests.
+func (l *requestLog) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l.lock.Lock()
+		l.requests = append(l.requests, r.Clone(context.Background()))
+		l.lock.Unlock()
+		handler(w, r)
+	}
+}
+
+// Header returns the `key` header of each recorded request.
+func (l *requestLog) Header(key string) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	values := make([]string, len(l.requests))
+	for i, r := range l.requests {
+		values[i] = r.Header.Get(key)
+	}
+	return values
+}
+
+// Paths returns the path of each recorded request.
+func (l *requestLog) Paths() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	paths := make([]string, len(l.requests))
+	for i, r := range l.requests {
+		paths[i] = r.URL.Path
+	}
+	return paths
+}
+
+// repeat returns `n` copies of `value`.
+func repeat(value string, n int) []string {
+	values := make([]string, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func newTestPollingBatch(t *testing.T, handler http.HandlerFunc, size int, timeout time.Duration) *PollingBatch {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg := activity.NewConfiguration()
+	cfg.Servers = activity.ServerConfigurations{{URL: srv.URL}}
+	client := activity.NewAPIClient(cfg)
+	pb := NewPollingBatch(log.NewNopLogger(), client.RequestorControlApi, "act", "batch", size, time.Now().Add(timeout))
+	pb.SetBackoff(testBackoff)
+	return pb
+}
+
+func commandResult(idx int, result string, finished bool) activity.ExeScriptCommandResult {
+	stdout := "out"
+	return activity.ExeScriptCommandResult{
+		Index:           int32(idx),
+		EventDate:       time.Now(),
+		Result:          result,
+		Stdout:          &stdout,
+		IsBatchFinished: &finished,
+	}
+}
+
+func writeResults(w http.ResponseWriter, results []activity.ExeScriptCommandResult) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// dropConnection simulates a network error.
+func dropConnection(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+// collect drains the channels of a poller, which have to be closed once polling ends.
+func collect(t *testing.T, pb *PollingBatch) ([]*event.CommandEventContext, error) {
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	eventCh, errCh := pb.Poll(ctx)
+	events := make([]*event.CommandEventContext, 0)
+	for evt := range eventCh {
+		events = append(events, evt)
+	}
+	var err error
+	for e := range errCh {
+		testutil.Assert(t, err == nil, "more than one error: %v, %v", err, e)
+		err = e
+	}
+	testutil.Ok(t, ctx.Err())
+	return events, err
+}
+
+func TestPollingBatchResults(t *testing.T) {
+	var requests int32
+	reqs := &requestLog{}
+	pb := newTestPollingBatch(t, reqs.wrap(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			writeResults(w, []activity.ExeScriptCommandResult{})
+		case 2:
+			writeResults(w, []activity.ExeScriptCommandResult{commandResult(0, "Ok", false)})
+		default:
+			writeResults(w, []activity.ExeScriptCommandResult{
+				commandResult(0, "Ok", false),
+				commandResult(1, "Ok", true),
+			})
+		}
+	}), 2, time.Minute)
+	events, err := collect(t, pb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(events))
+	for i, evt := range events {
+		testutil.Equals(t, event.CommandExecuted{}, evt.EvtCls)
+		testutil.Equals(t, i, evt.Idx())
+		testutil.Equals(t, true, evt.Bool("success"))
+		testutil.Equals(t, "out", evt.String("stdout"))
+	}
+	testutil.Equals(t, int32(3), atomic.LoadInt32(&requests))
+	testutil.Equals(t, repeat("/activity/act/exec/batch", 3), reqs.Paths())
+}
+
+func TestPollingBatchFailedCommand(t *testing.T) {
+	pb := newTestPollingBatch(t, func(w http.ResponseWriter, r *http.Request) {
+		writeResults(w, []activity.ExeScriptCommandResult{commandResult(0, "Error", true)})
+	}, 3, time.Minute)
+	events, err := collect(t, pb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(events))
+	testutil.Equals(t, false, events[0].Bool("success"))
+	testutil.Equals(t, true, events[0].ComputationFinished(2))
+}
+
+func TestPollingBatchRequestTimeout(t *testing.T) {
+	var requests int32
+	pb := newTestPollingBatch(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 3 {
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		writeResults(w, []activity.ExeScriptCommandResult{commandResult(0, "Ok", true)})
+	}, 1, time.Minute)
+	events, err := collect(t, pb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(events))
+	testutil.Equals(t, int32(4), atomic.LoadInt32(&requests))
+}
+
+func TestPollingBatchNetworkErrors(t *testing.T) {
+	var requests int32
+	pb := newTestPollingBatch(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			dropConnection(w)
+			return
+		}
+		writeResults(w, []activity.ExeScriptCommandResult{commandResult(0, "Ok", true)})
+	}, 1, time.Minute)
+	events, err := collect(t, pb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(events))
+}
+
+func TestPollingBatchMaxRetries(t *testing.T) {
+	pb := newTestPollingBatch(t, func(w http.ResponseWriter, r *http.Request) {
+		dropConnection(w)
+	}, 1, time.Minute)
+	backoff := testBackoff
+	backoff.MaxRetries = 2
+	pb.SetBackoff(backoff)
+	events, err := collect(t, pb)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 0, len(events))
+	var timedOut *BatchTimeoutError
+	testutil.Assert(t, !errors.As(err, &timedOut), "unexpected timeout")
+}
+
+func TestPollingBatchServerError(t *testing.T) {
+	var requests int32
+	pb := newTestPollingBatch(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}, 1, time.Minute)
+	events, err := collect(t, pb)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 0, len(events))
+	testutil.Equals(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestPollingBatchDeadline(t *testing.T) {
+	pb := newTestPollingBatch(t, func(w http.ResponseWriter, r *http.Request) {
+		writeResults(w, []activity.ExeScriptCommandResult{})
+	}, 1, 50*time.Millisecond)
+	events, err := collect(t, pb)
+	testutil.Equals(t, 0, len(events))
+	var timedOut *BatchTimeoutError
+	testutil.Assert(t, errors.As(err, &timedOut), "expected a timeout, got %v", err)
+}
+
+// interruptedActivity serves a batch whose results never come, `execStatus`
+// is the status of the exec of the terminate command.
+type interruptedActivity struct {
+	lock       sync.Mutex
+	execStatus int
+	polling    chan struct{}
+	pollOnce   sync.Once
+	scripts    []string
+	requests   []string
+}
+
+func newInterruptedActivity(execStatus int) *interruptedActivity {
+	return &interruptedActivity{execStatus: execStatus, polling: make(chan struct{})}
+}
+
+func (a *interruptedActivity) serve(w http.ResponseWriter, r *http.Request) {
+	a.lock.Lock()
+	a.requests = append(a.requests, r.Method+" "+r.URL.Path)
+	a.lock.Unlock()
+	switch {
+	case r.Method == http.MethodGet:
+		// The poll is held until the client gives up on it.
+		a.pollOnce.Do(func() { close(a.polling) })
+		<-r.Context().Done()
+	case r.Method == http.MethodPost && r.URL.Path == "/activity/act/exec":
+		var req activity.ExeScriptRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		a.lock.Lock()
+		a.scripts = append(a.scripts, req.Text)
+		a.lock.Unlock()
+		if a.execStatus != http.StatusOK {
+			w.WriteHeader(a.execStatus)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode("terminate-batch")
+	case r.Method == http.MethodDelete && r.URL.Path == "/activity/act":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Interrupts returns the scripts executed and the requests made besides polling.
+func (a *interruptedActivity) Interrupts() ([]string, []string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	requests := make([]string, 0)
+	for _, r := range a.requests {
+		if !strings.HasPrefix(r, http.MethodGet) {
+			requests = append(requests, r)
+		}
+	}
+	return append([]string{}, a.scripts...), requests
+}
+
+// cancelPoll polls `pb` and calls `cancel` once the batch is polled, it
+// returns the error sent once both channels are closed.
+func cancelPoll(t *testing.T, ctx context.Context, pb *PollingBatch, a *interruptedActivity, cancel func()) error {
+	eventCh, errCh := pb.Poll(ctx)
+	select {
+	case <-a.polling:
+	case <-time.After(10 * time.Second):
+		t.Fatal("batch not polled")
+	}
+	cancel()
+	timeout := time.After(10 * time.Second)
+	var err error
+	for eventCh != nil || errCh != nil {
+		select {
+		case evt, ok := <-eventCh:
+			testutil.Assert(t, !ok, "unexpected event %v", evt)
+			eventCh = nil
+		case e, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+			testutil.Assert(t, err == nil, "more than one error: %v, %v", err, e)
+			err = e
+		case <-timeout:
+			t.Fatal("channels not closed")
+		}
+	}
+	return err
+}
+
+func TestPollingBatchCancel(t *testing.T) {
+	for _, viaContext := range []bool{false, true} {
+		a := newInterruptedActivity(http.StatusOK)
+		pb := newTestPollingBatch(t, a.serve, 2, time.Minute)
+		ctx, cncl := context.WithCancel(context.Background())
+		err := cancelPoll(t, ctx, pb, a, func() {
+			if viaContext {
+				cncl()
+				return
+			}
+			testutil.Ok(t, pb.Cancel())
+		})
+		cncl()
+		var cancelled *BatchCancelledError
+		testutil.Assert(t, errors.As(err, &cancelled), "expected a cancellation, got %v", err)
+		testutil.Assert(t, pb.Cancelled(), "batch not cancelled")
+		testutil.Assert(t, !pb.Destroyed(), "activity destroyed")
+
+		scripts, requests := a.Interrupts()
+		testutil.Equals(t, []string{"POST /activity/act/exec"}, requests)
+		testutil.Equals(t, `[{"terminate":{}}]`, scripts[0])
+		// The batch is interrupted only once.
+		testutil.Ok(t, pb.Cancel())
+		_, requests = a.Interrupts()
+		testutil.Equals(t, 1, len(requests))
+	}
+}
+
+func TestPollingBatchCancelDestroy(t *testing.T) {
+	a := newInterruptedActivity(http.StatusInternalServerError)
+	pb := newTestPollingBatch(t, a.serve, 2, time.Minute)
+	err := cancelPoll(t, context.Background(), pb, a, func() {
+		testutil.Ok(t, pb.Cancel())
+	})
+	var cancelled *BatchCancelledError
+	testutil.Assert(t, errors.As(err, &cancelled), "expected a cancellation, got %v", err)
+	// The activity is destroyed when it does not take the terminate command.
+	testutil.Assert(t, pb.Destroyed(), "activity not destroyed")
+	_, requests := a.Interrupts()
+	testutil.Equals(t, []string{"POST /activity/act/exec", "DELETE /activity/act"}, requests)
+}
+
+func newTestStreamingBatch(t *testing.T, handler http.HandlerFunc, size int, timeout time.Duration) *StreamingBatch {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg := activity.NewConfiguration()
+	cfg.Servers = activity.ServerConfigurations{{URL: srv.URL}}
+	cfg.DefaultHeader["Authorization"] = "Bearer app-key"
+	client := activity.NewAPIClient(cfg)
+	sb := NewStreamingBatch(log.NewNopLogger(), client, client.RequestorControlApi, "act", "batch", size, time.Now().Add(timeout))
+	sb.SetBackoff(testBackoff)
+	return sb
+}
+
+// runtimeEvent formats a runtime event of the activity API as a message of an event stream.
+func runtimeEvent(id string, idx int, kind string, data interface{}) string {
+	evt, _ := json.Marshal(map[string]interface{}{
+		"batchId":   "batch",
+		"index":     idx,
+		"timestamp": time.Now().Format(time.RFC3339),
+		"kind":      map[string]interface{}{kind: data},
+	})
+	return fmt.Sprintf("id: %v\nevent: runtime\ndata: %s\n\n", id, evt)
+}
+
+func commandEvents(idx int, stdout string, returnCode int) []string {
+	return []string{
+		runtimeEvent(fmt.Sprintf("%v-0", idx), idx, "started", map[string]interface{}{"command": map[string]interface{}{"run": map[string]interface{}{}}}),
+		runtimeEvent(fmt.Sprintf("%v-1", idx), idx, "stdout", stdout),
+		runtimeEvent(fmt.Sprintf("%v-2", idx), idx, "stderr", map[string]interface{}{"str": "err"}),
+		runtimeEvent(fmt.Sprintf("%v-3", idx), idx, "finished", map[string]interface{}{"return_code": returnCode}),
+	}
+}
+
+func writeStream(w http.ResponseWriter, events []string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	for _, evt := range events {
+		fmt.Fprint(w, evt)
+		w.(http.Flusher).Flush()
+	}
+}
+
+func collectStream(t *testing.T, sb *StreamingBatch) ([]*event.CommandEventContext, error) {
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	eventCh, errCh := sb.Poll(ctx)
+	events := make([]*event.CommandEventContext, 0)
+	for evt := range eventCh {
+		events = append(events, evt)
+	}
+	var err error
+	for e := range errCh {
+		testutil.Assert(t, err == nil, "more than one error: %v, %v", err, e)
+		err = e
+	}
+	testutil.Ok(t, ctx.Err())
+	return events, err
+}
+
+func eventClasses(events []*event.CommandEventContext) []interface{} {
+	classes := make([]interface{}, len(events))
+	for i, evt := range events {
+		classes[i] = evt.EvtCls
+	}
+	return classes
+}
+
+var commandEventClasses = []interface{}{
+	event.CommandStarted{},
+	event.CommandStdOut{},
+	event.CommandStdErr{},
+	event.CommandExecuted{},
+}
+
+func TestStreamingBatchEvents(t *testing.T) {
+	reqs := &requestLog{}
+	sb := newTestStreamingBatch(t, reqs.wrap(func(w http.ResponseWriter, r *http.Request) {
+		writeStream(w, append(commandEvents(0, "hello", 0), commandEvents(1, "world", 0)...))
+	}), 2, time.Minute)
+	events, err := collectStream(t, sb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, append(commandEventClasses, commandEventClasses...), eventClasses(events))
+	testutil.Equals(t, "hello", events[1].String("output"))
+	testutil.Equals(t, "err", events[2].String("output"))
+	testutil.Equals(t, true, events[3].Bool("success"))
+	testutil.Equals(t, "world", events[5].String("output"))
+	testutil.Equals(t, 1, events[7].Idx())
+	testutil.Equals(t, []string{"/activity/act/exec/batch"}, reqs.Paths())
+	testutil.Equals(t, []string{"text/event-stream"}, reqs.Header("Accept"))
+	testutil.Equals(t, []string{"Bearer app-key"}, reqs.Header("Authorization"))
+}
+
+func TestStreamingBatchFailedCommand(t *testing.T) {
+	sb := newTestStreamingBatch(t, func(w http.ResponseWriter, r *http.Request) {
+		writeStream(w, commandEvents(0, "", 1))
+	}, 3, time.Minute)
+	events, err := collectStream(t, sb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, commandEventClasses, eventClasses(events))
+	testutil.Equals(t, false, events[3].Bool("success"))
+}
+
+func TestStreamingBatchResume(t *testing.T) {
+	var connections int32
+	reqs := &requestLog{}
+	sb := newTestStreamingBatch(t, reqs.wrap(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&connections, 1) {
+		case 1:
+			// The stream drops in the middle of the second command.
+			writeStream(w, append(commandEvents(0, "hello", 0), commandEvents(1, "world", 0)[:2]...))
+		default:
+			writeStream(w, commandEvents(1, "world", 0)[2:])
+		}
+	}), 2, time.Minute)
+	events, err := collectStream(t, sb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, append(commandEventClasses, commandEventClasses...), eventClasses(events))
+	testutil.Equals(t, int32(2), atomic.LoadInt32(&connections))
+	testutil.Equals(t, []string{"", "1-1"}, reqs.Header("Last-Event-ID"))
+	testutil.Equals(t, repeat("Bearer app-key", 2), reqs.Header("Authorization"))
+}
+
+func TestStreamingBatchReplay(t *testing.T) {
+	var connections int32
+	sb := newTestStreamingBatch(t, func(w http.ResponseWriter, r *http.Request) {
+		events := append(commandEvents(0, "hello", 0), commandEvents(1, "world", 0)...)
+		if atomic.AddInt32(&connections, 1) == 1 {
+			events = events[:5]
+		}
+		// The stream always starts over, the events already received are skipped.
+		writeStream(w, events)
+	}, 2, time.Minute)
+	events, err := collectStream(t, sb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, append(commandEventClasses, commandEventClasses...), eventClasses(events))
+	testutil.Equals(t, int32(2), atomic.LoadInt32(&connections))
+}
+
+func TestStreamingBatchFallback(t *testing.T) {
+	var polled int32
+	reqs := &requestLog{}
+	sb := newTestStreamingBatch(t, reqs.wrap(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "text/event-stream" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		atomic.AddInt32(&polled, 1)
+		writeResults(w, []activity.ExeScriptCommandResult{
+			commandResult(0, "Ok", false),
+			commandResult(1, "Ok", true),
+		})
+	}), 2, time.Minute)
+	events, err := collectStream(t, sb)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []interface{}{event.CommandExecuted{}, event.CommandExecuted{}}, eventClasses(events))
+	testutil.Equals(t, int32(1), atomic.LoadInt32(&polled))
+	accept := reqs.Header("Accept")
+	testutil.Equals(t, 2, len(accept))
+	testutil.Equals(t, "text/event-stream", accept[0])
+}
@@ -5,13 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/hhio618/go-golem/pkg/event"
 	"github.com/hhio618/go-golem/pkg/props"
 	yam "github.com/hhio618/ya-go-client/ya-market"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 )
 
@@ -41,7 +43,7 @@ type Agreement struct {
 	ctx          context.Context
 	logger       log.Logger
 	api          *yam.RequestorApiService
-	subscription Subscription
+	subscription *Subscription
 	id           string
 }
 
@@ -86,7 +88,7 @@ func (a *Agreement) Terminate(reason map[string]interface{}) error {
 	if err != nil {
 		level.Debug(a.logger).Log("msg", "terminate agreement", "err", err)
 
-		if resp.StatusCode == 410 {
+		if resp != nil && resp.StatusCode == 410 {
 			var jsonObj map[string]interface{}
 			bodyBytes, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
@@ -119,7 +121,17 @@ type OfferProposal struct {
 	ctx          context.Context
 	logger       log.Logger
 	proposal     *yam.ProposalEvent
-	subscription Subscription
+	subscription *Subscription
+}
+
+// NewOfferProposal returns the proposal of `proposalEvent` received on `subscription`.
+func NewOfferProposal(subscription *Subscription, proposalEvent *yam.ProposalEvent) *OfferProposal {
+	return &OfferProposal{
+		ctx:          subscription.ctx,
+		logger:       subscription.logger,
+		proposal:     proposalEvent,
+		subscription: subscription,
+	}
 }
 
 func (o *OfferProposal) Issuer() string {
@@ -130,8 +142,21 @@ func (o *OfferProposal) Id() string {
 	return o.proposal.Proposal.ProposalId
 }
 
+// Subscription returns the subscription on which the proposal was received.
+func (o *OfferProposal) Subscription() *Subscription {
+	return o.subscription
+}
+
 func (o *OfferProposal) Props() props.Props {
-	return o.proposal.Proposal.Properties.(props.Props)
+	// Decoded proposals hold a plain map rather than props.Props.
+	switch properties := o.proposal.Proposal.Properties.(type) {
+	case props.Props:
+		return properties
+	case map[string]interface{}:
+		return properties
+	default:
+		return nil
+	}
 }
 
 func (o *OfferProposal) IsDraft() bool {
@@ -199,11 +224,25 @@ type Subscription struct {
 	logger  log.Logger
 	api     *yam.RequestorApiService
 	id      string
-	open    bool
+	closed  int32
 	deleted bool
 	details *yam.Demand
+	emitter func(interface{})
+	// expiration is when the demand expires on the market, zero if unknown.
+	expiration time.Time
+	retryDelay time.Duration
+	lock       sync.Mutex
+	err        error
 }
 
+const (
+	// maxCollectFailures is the number of consecutive failed collects after
+	// which a subscription is considered dead.
+	maxCollectFailures = 5
+	// collectRetryDelayDefault is the delay after a failed collect.
+	collectRetryDelayDefault = 1 * time.Second
+)
+
 func NewSubscription(logger log.Logger, ctx context.Context, api *yam.RequestorApiService,
 	id string,
 	open bool,
@@ -214,7 +253,6 @@ func NewSubscription(logger log.Logger, ctx context.Context, api *yam.RequestorA
 		ctx:     ctx,
 		api:     api,
 		id:      id,
-		open:    true,
 		deleted: false,
 		details: details,
 	}
@@ -224,8 +262,52 @@ func (s *Subscription) Id() string {
 	return s.id
 }
 
+// SetEmitter sets the emitter of the events collected on the subscription
+// which are not proposals.
+func (s *Subscription) SetEmitter(emitter func(interface{})) {
+	s.emitter = emitter
+}
+
+func (s *Subscription) emit(evt interface{}) {
+	if s.emitter != nil {
+		s.emitter(evt)
+	}
+}
+
+// SetExpiration sets when the demand expires, Events stops collecting then.
+func (s *Subscription) SetExpiration(expiration time.Time) {
+	s.expiration = expiration
+}
+
+// SetRetryDelay sets the delay after a failed collect.
+func (s *Subscription) SetRetryDelay(delay time.Duration) {
+	s.retryDelay = delay
+}
+
+// Err returns the reason why the subscription stopped collecting offers, it
+// is nil as long as it collects them or if it was closed.
+func (s *Subscription) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// fail marks the subscription as dead and emits CollectFailed.
+func (s *Subscription) fail(err error) {
+	s.lock.Lock()
+	s.err = err
+	s.lock.Unlock()
+	level.Warn(s.logger).Log("msg", "subscription failed", "subscription", s.id, "err", err)
+	s.emit(&event.CollectFailed{SubId: s.id, Reason: err.Error()})
+}
+
 func (s *Subscription) Close() {
-	s.open = false
+	atomic.StoreInt32(&s.closed, 1)
+}
+
+// IsOpen reports whether the subscription still collects offers.
+func (s *Subscription) IsOpen() bool {
+	return atomic.LoadInt32(&s.closed) == 0
 }
 
 func (s *Subscription) Start() error {
@@ -243,8 +325,18 @@ func (s *Subscription) ValidateDetails() error {
 	return nil
 }
 
+// Properties returns the properties of the demand, they are only known for
+// the subscriptions listed by Market.Subscriptions.
+func (s *Subscription) Properties() props.Props {
+	if s.details == nil {
+		return nil
+	}
+	properties, _ := s.details.Properties.(map[string]interface{})
+	return properties
+}
+
 func (s *Subscription) Delete() error {
-	s.open = false
+	s.Close()
 	if !s.deleted {
 		_, err := s.api.UnsubscribeDemand(s.ctx, s.id).Execute()
 		if err != nil {
@@ -254,72 +346,258 @@ func (s *Subscription) Delete() error {
 	return nil
 }
 
+// Events collects the offers of the subscription until it is closed or `ctx`
+// is done, or until the subscription dies, in which case Err tells why. The
+// channel is closed then.
 func (s *Subscription) Events(ctx context.Context) chan *OfferProposal {
 	proposalCh := make(chan *OfferProposal)
 	go func() {
-		for s.open {
+		defer close(proposalCh)
+		failures := 0
+		retryDelay := s.retryDelay
+		if retryDelay == 0 {
+			retryDelay = collectRetryDelayDefault
+		}
+		for s.IsOpen() {
 			select {
 			case <-ctx.Done():
 				return
 			default:
 			}
-			_, resp, err := s.api.CollectOffers(ctx, s.id).Timeout(10).
-				MaxEvents(10).Execute()
-			if err != nil {
-				//TODO: log this.
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			var events []map[string]interface{}
-			bodyBytes, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				//TODO: log this.
-				time.Sleep(1 * time.Second)
-				continue
+			if !s.expiration.IsZero() && time.Now().After(s.expiration) {
+				s.fail(errors.Wrapf(ErrSubscriptionExpired, "expired at %v", s.expiration))
+				return
 			}
-			err = json.Unmarshal(bodyBytes, &events)
+			events, err := s.collect(ctx)
 			if err != nil {
-				//TODO: log this.
-				time.Sleep(1 * time.Second)
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				failures++
+				if errors.Cause(err) == errSubscriptionGone || failures >= maxCollectFailures {
+					s.fail(err)
+					return
+				}
+				level.Debug(s.logger).Log("msg", "collect offers", "subscription", s.id, "err", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retryDelay):
+				}
 				continue
 			}
+			failures = 0
 
 			for _, ev := range events {
-				if eType, ok := ev["eventType"]; ok {
-					switch eType {
-					case "ProposalEvent":
-						_, ok := ev["proposal"]
-						if !ok {
-							//TODO: log this.
-							time.Sleep(1 * time.Second)
-							continue
-						}
-						proposalEvent := &yam.ProposalEvent{}
-						err := mapstructure.Decode(ev, proposalEvent)
-						if err != nil {
-							//TODO: log this.
-							time.Sleep(1 * time.Second)
-							continue
-						}
-						proposalCh <- &OfferProposal{proposal: proposalEvent}
-					default:
-						time.Sleep(1 * time.Second)
-						continue
-					}
+				proposal := s.handleEvent(ev)
+				if proposal == nil {
+					continue
+				}
+				select {
+				case proposalCh <- proposal:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
-
 	}()
 	return proposalCh
 }
 
+var errSubscriptionGone = errors.New("subscription is gone from the market")
+
+// ErrSubscriptionExpired is the cause of Err once the expiration set with
+// SetExpiration has passed.
+var ErrSubscriptionExpired = errors.New("subscription expired")
+
+// collect fetches the next events of the subscription.
+func (s *Subscription) collect(ctx context.Context) ([]map[string]interface{}, error) {
+	_, resp, err := s.api.CollectOffers(ctx, s.id).Timeout(10).
+		MaxEvents(10).Execute()
+	if err != nil {
+		if resp != nil && (resp.StatusCode == 404 || resp.StatusCode == 410) {
+			return nil, errors.Wrap(errSubscriptionGone, err.Error())
+		}
+		return nil, err
+	}
+	var events []map[string]interface{}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(bodyBytes, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// handleEvent turns a collected event into an offer proposal, the events
+// which are not proposals are emitted and nil is returned.
+func (s *Subscription) handleEvent(ev map[string]interface{}) *OfferProposal {
+	switch eType := ev["eventType"]; eType {
+	case "ProposalEvent":
+		if _, ok := ev["proposal"]; !ok {
+			level.Debug(s.logger).Log("msg", "proposal event without proposal", "subscription", s.id)
+			return nil
+		}
+		// The event is decoded through JSON for its dates to be parsed.
+		data, err := json.Marshal(ev)
+		if err != nil {
+			level.Debug(s.logger).Log("msg", "encode proposal event", "err", err)
+			return nil
+		}
+		proposalEvent := &yam.ProposalEvent{}
+		if err := json.Unmarshal(data, proposalEvent); err != nil {
+			level.Debug(s.logger).Log("msg", "decode proposal event", "err", err)
+			return nil
+		}
+		return NewOfferProposal(s, proposalEvent)
+	case "ProposalRejectedEvent":
+		proposalId, _ := ev["proposalId"].(string)
+		reason := eventReason(ev["reason"])
+		s.emit(&event.ProposalRejected{
+			ProposalEvent: event.ProposalEvent{PropId: proposalId},
+			Reason:        reason["message"],
+		})
+	case "PropertyQueryEvent":
+		query, _ := ev["propertyQuery"].(map[string]interface{})
+		queryId, _ := query["queryId"].(string)
+		queried := make([]string, 0)
+		if properties, ok := query["queriedProperties"].([]interface{}); ok {
+			for _, property := range properties {
+				queried = append(queried, fmt.Sprint(property))
+			}
+		}
+		s.emit(&event.PropertyQueryReceived{
+			SubId:             s.id,
+			QueryId:           queryId,
+			QueriedProperties: queried,
+		})
+	default:
+		level.Debug(s.logger).Log("msg", "unhandled subscription event", "type", fmt.Sprint(eType), "subscription", s.id)
+	}
+	return nil
+}
+
+// eventReason converts the reason object of a market event to a map of
+// strings, a reason given as a plain string is stored under "message".
+func eventReason(reason interface{}) map[string]string {
+	converted := make(map[string]string)
+	switch r := reason.(type) {
+	case string:
+		converted["message"] = r
+	case map[string]interface{}:
+		for k, v := range r {
+			if str, ok := v.(string); ok {
+				converted[k] = str
+				continue
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			converted[k] = string(data)
+		}
+	}
+	return converted
+}
+
 type Market struct {
 	ctx    context.Context
 	logger log.Logger
 	api    *yam.RequestorApiService
 }
 
+func NewMarket(ctx context.Context, client *yam.APIClient, logger log.Logger) *Market {
+	return &Market{
+		ctx:    ctx,
+		logger: logger,
+		api:    client.RequestorApi,
+	}
+}
+
+// Agreement event types reported by the market API.
+const (
+	AgreementEventApproved   = "AgreementApprovedEvent"
+	AgreementEventRejected   = "AgreementRejectedEvent"
+	AgreementEventCancelled  = "AgreementCancelledEvent"
+	AgreementEventTerminated = "AgreementTerminatedEvent"
+)
+
+// The sides which may terminate an agreement, see AgreementEvent.Terminator.
+const (
+	TerminatorRequestor = "Requestor"
+	TerminatorProvider  = "Provider"
+)
+
+// AgreementEvent is a change of state of an agreement of the requestor.
+type AgreementEvent struct {
+	EventType   string
+	EventDate   time.Time
+	AgreementId string
+	// Terminator is the side which terminated the agreement, it is only set
+	// for AgreementTerminatedEvent.
+	Terminator string
+	Reason     map[string]string
+}
+
+// AgreementEvents collects the agreement events of the requestor until `ctx`
+// is done, the channel is closed then.
+func (m *Market) AgreementEvents(ctx context.Context) chan *AgreementEvent {
+	agreementCh := make(chan *AgreementEvent)
+	go func() {
+		defer close(agreementCh)
+		after := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			_, resp, err := m.api.CollectAgreementEvents(ctx).Timeout(10).
+				AfterTimestamp(after).MaxEvents(10).Execute()
+			var events []map[string]interface{}
+			if err == nil {
+				var bodyBytes []byte
+				bodyBytes, err = ioutil.ReadAll(resp.Body)
+				if err == nil {
+					err = json.Unmarshal(bodyBytes, &events)
+				}
+			}
+			if err != nil {
+				level.Debug(m.logger).Log("msg", "collect agreement events", "err", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(1 * time.Second):
+				}
+				continue
+			}
+			for _, ev := range events {
+				agreementEvent := &AgreementEvent{Reason: eventReason(ev["reason"])}
+				agreementEvent.EventType, _ = ev["eventType"].(string)
+				agreementEvent.AgreementId, _ = ev["agreementId"].(string)
+				agreementEvent.Terminator, _ = ev["terminator"].(string)
+				if date, ok := ev["eventDate"].(string); ok {
+					agreementEvent.EventDate, _ = time.Parse(time.RFC3339Nano, date)
+				}
+				if agreementEvent.EventDate.After(after) {
+					after = agreementEvent.EventDate
+				}
+				select {
+				case agreementCh <- agreementEvent:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return agreementCh
+}
+
 func (m *Market) Subscribe(props props.Props, constraints string) (*Subscription, error) {
 	proposal := yam.DemandOfferBase{
 		Properties:  props,
@@ -330,8 +608,10 @@ func (m *Market) Subscribe(props props.Props, constraints string) (*Subscription
 		return nil, err
 	}
 	return &Subscription{
-		api: m.api,
-		id:  id,
+		ctx:    m.ctx,
+		logger: m.logger,
+		api:    m.api,
+		id:     id,
 	}, nil
 }
 
@@ -341,12 +621,37 @@ func (m *Market) Subscriptions() ([]Subscription, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, d := range demands {
+	for i := range demands {
 		subscriptions = append(subscriptions, Subscription{
+			ctx:     m.ctx,
+			logger:  m.logger,
 			api:     m.api,
-			details: &d,
-			id:      d.DemandId,
+			details: &demands[i],
+			id:      demands[i].DemandId,
 		})
 	}
 	return subscriptions, nil
 }
+
+// Agreements lists the agreements of the requestor in `state`, or all of them
+// if it is empty.
+func (m *Market) Agreements(state string) ([]*Agreement, error) {
+	request := m.api.ListAgreements(m.ctx)
+	if state != "" {
+		request = request.State(state)
+	}
+	entries, _, err := request.Execute()
+	if err != nil {
+		return nil, err
+	}
+	agreements := make([]*Agreement, 0, len(entries))
+	for _, entry := range entries {
+		agreements = append(agreements, &Agreement{
+			ctx:    m.ctx,
+			logger: m.logger,
+			api:    m.api,
+			id:     entry.Id,
+		})
+	}
+	return agreements, nil
+}
@@ -0,0 +1,194 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/testutil"
+	yam "github.com/hhio618/ya-go-client/ya-market"
+)
+
+func newTestMarketClient(t *testing.T, handler http.HandlerFunc) *yam.APIClient {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg := yam.NewConfiguration()
+	cfg.Servers = yam.ServerConfigurations{{URL: srv.URL}}
+	return yam.NewAPIClient(cfg)
+}
+
+func writeEvents(w http.ResponseWriter, events ...map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if events == nil {
+		events = []map[string]interface{}{}
+	}
+	json.NewEncoder(w).Encode(events)
+}
+
+// parseTimestamp parses a timestamp query parameter, which is formatted
+// either as RFC 3339 or with Time.String.
+func parseTimestamp(value string) (time.Time, error) {
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return ts, nil
+	}
+	return time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", value)
+}
+
+func TestSubscriptionEvents(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	client := newTestMarketClient(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		first := requests == 1
+		lock.Unlock()
+		if r.URL.Path != "/demands/sub/events" || !first {
+			writeEvents(w)
+			return
+		}
+		writeEvents(w,
+			map[string]interface{}{
+				"eventType":  "ProposalRejectedEvent",
+				"eventDate":  time.Now().Format(time.RFC3339),
+				"proposalId": "proposal-1",
+				"reason":     map[string]interface{}{"message": "too expensive", "code": 7},
+			},
+			map[string]interface{}{
+				"eventType": "PropertyQueryEvent",
+				"eventDate": time.Now().Format(time.RFC3339),
+				"propertyQuery": map[string]interface{}{
+					"queryId":           "query-1",
+					"queriedProperties": []interface{}{"golem.node.id.name", "golem.inf.mem.gib"},
+				},
+			},
+			// A proposal event without a proposal is dropped.
+			map[string]interface{}{"eventType": "ProposalEvent"},
+			map[string]interface{}{
+				"eventType": "ProposalEvent",
+				"eventDate": time.Now().Format(time.RFC3339),
+				"proposal": map[string]interface{}{
+					"proposalId": "proposal-2",
+					"issuerId":   "provider",
+					"properties": map[string]interface{}{"golem.node.id.name": "node"},
+				},
+			},
+		)
+	})
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	subscription := NewSubscription(log.NewNopLogger(), ctx, client.RequestorApi, "sub", true, false, nil)
+	emitted := make(chan interface{}, 10)
+	subscription.SetEmitter(func(evt interface{}) {
+		emitted <- evt
+	})
+	proposals := subscription.Events(ctx)
+
+	proposal := <-proposals
+	testutil.Equals(t, "provider", proposal.Issuer())
+	testutil.Equals(t, "proposal-2", proposal.Id())
+	testutil.Equals(t, subscription, proposal.Subscription())
+	testutil.Equals(t, "node", proposal.Props()["golem.node.id.name"])
+	// The other events were emitted before the proposal was handed out.
+	testutil.Equals(t, &event.ProposalRejected{
+		ProposalEvent: event.ProposalEvent{PropId: "proposal-1"},
+		Reason:        "too expensive",
+	}, <-emitted)
+	testutil.Equals(t, &event.PropertyQueryReceived{
+		SubId:             "sub",
+		QueryId:           "query-1",
+		QueriedProperties: []string{"golem.node.id.name", "golem.inf.mem.gib"},
+	}, <-emitted)
+
+	subscription.Close()
+	for range proposals {
+	}
+	testutil.Equals(t, 0, len(emitted))
+}
+
+func TestMarketAgreementEvents(t *testing.T) {
+	started := time.Now()
+	terminated := started.Add(time.Hour).UTC()
+	approved := started.Add(30 * time.Minute).UTC()
+	var lock sync.Mutex
+	after := make([]string, 0)
+	client := newTestMarketClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/agreementEvents" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lock.Lock()
+		after = append(after, r.URL.Query().Get("afterTimestamp"))
+		first := len(after) == 1
+		lock.Unlock()
+		if !first {
+			time.Sleep(10 * time.Millisecond)
+			writeEvents(w)
+			return
+		}
+		writeEvents(w,
+			map[string]interface{}{
+				"eventType":   AgreementEventTerminated,
+				"eventDate":   terminated.Format(time.RFC3339Nano),
+				"agreementId": "agr-1",
+				"terminator":  TerminatorProvider,
+				"reason":      map[string]interface{}{"message": "Shutting down", "golem.provider.code": "Shutdown"},
+			},
+			map[string]interface{}{
+				"eventType":   AgreementEventApproved,
+				"eventDate":   approved.Format(time.RFC3339Nano),
+				"agreementId": "agr-2",
+			},
+		)
+	})
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	events := NewMarket(ctx, client, log.NewNopLogger()).AgreementEvents(ctx)
+
+	testutil.Equals(t, &AgreementEvent{
+		EventType:   AgreementEventTerminated,
+		EventDate:   terminated,
+		AgreementId: "agr-1",
+		Terminator:  TerminatorProvider,
+		Reason:      map[string]string{"message": "Shutting down", "golem.provider.code": "Shutdown"},
+	}, <-events)
+	testutil.Equals(t, &AgreementEvent{
+		EventType:   AgreementEventApproved,
+		EventDate:   approved,
+		AgreementId: "agr-2",
+		Reason:      map[string]string{},
+	}, <-events)
+
+	// The next collect only asks for the events after the latest one.
+	for {
+		lock.Lock()
+		n := len(after)
+		lock.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cncl()
+	for range events {
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	first, err := parseTimestamp(after[0])
+	testutil.Ok(t, err)
+	testutil.Assert(t, !first.Before(started.Truncate(time.Second)), "first collect after %v, before the start", first)
+	for _, value := range after[1:] {
+		ts, err := parseTimestamp(value)
+		testutil.Ok(t, err)
+		testutil.Assert(t, ts.Equal(terminated), "collect after %v, expected %v", ts, terminated)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/hhio618/go-golem/pkg/props"
 	yap "github.com/hhio618/ya-go-client/ya-payment"
+	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 )
 
@@ -75,6 +77,9 @@ type Allocation struct {
 	PaymentPlatform string
 	PaymentAddress  string
 	Expires         time.Time
+	// Created is when the allocation was made, it is only set on the
+	// allocations listed by Payment.Allocations.
+	Created time.Time
 }
 
 func (a *Allocation) Details() (*AllocationDetails, error) {
@@ -199,11 +204,13 @@ func (p *Payment) Allocations(ctx context.Context) ([]Allocation, error) {
 			return nil, err
 		}
 		allocations = append(allocations, Allocation{
+			link:            link{ctx: ctx, api: p.api},
 			Id:              a.AllocationId,
 			Amount:          amount,
 			PaymentPlatform: *a.PaymentPlatform,
 			PaymentAddress:  *a.Address,
 			Expires:         *a.Timeout,
+			Created:         a.Timestamp,
 		})
 	}
 	return allocations, nil
@@ -240,6 +247,25 @@ func (p *Payment) DecorateDemand(ctx context.Context, ids []string) (*yap.Market
 	return &res, err
 }
 
+// Decorate adds the payment properties and constraints for the allocations
+// with `ids` to the demand, the constraints are parsed so that a malformed
+// one is rejected before subscribing.
+func (p *Payment) Decorate(ctx context.Context, ids []string, demand *props.DemandBuilder) error {
+	decoration, err := p.DecorateDemand(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, constraint := range decoration.Constraints {
+		if err := demand.EnsureRaw(constraint); err != nil {
+			return errors.Wrapf(err, "payment decoration constraint %q", constraint)
+		}
+	}
+	for _, property := range decoration.Properties {
+		demand.Set(property.Key, property.Value)
+	}
+	return nil
+}
+
 func (p *Payment) DebitNote(ctx context.Context, debitNoteId string) (*DebitNote, error) {
 	res, _, err := p.api.GetDebitNote(ctx, debitNoteId).Execute()
 	return &DebitNote{
@@ -0,0 +1,112 @@
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type CaptureMode string
+
+const (
+	Head     CaptureMode = "head"
+	Tail     CaptureMode = "tail"
+	HeadTail CaptureMode = "headTail"
+	Stream   CaptureMode = "stream"
+)
+
+type CaptureFormat string
+
+const (
+	Bin CaptureFormat = "bin"
+	Str CaptureFormat = "str"
+)
+
+// CaptureContext describes how a single output stream of a Run command is captured.
+type CaptureContext struct {
+	mode  CaptureMode
+	limit *int
+	fmt   *CaptureFormat
+}
+
+func NewCaptureContext(mode CaptureMode,
+	limit *int,
+	_fmt *CaptureFormat) (*CaptureContext, error) {
+	switch mode {
+	case "", "all":
+		return newCaptureContext(Head, nil, _fmt), nil
+	case Head, Tail, HeadTail, Stream:
+		return newCaptureContext(mode, limit, _fmt), nil
+	default:
+		return nil, fmt.Errorf("invalid output capture mode: %v", mode)
+	}
+
+}
+
+func newCaptureContext(mode CaptureMode,
+	limit *int,
+	fmt *CaptureFormat) *CaptureContext {
+	return &CaptureContext{
+		mode:  mode,
+		limit: limit,
+		fmt:   fmt,
+	}
+}
+
+func (self *CaptureContext) Mode() CaptureMode {
+	return self.mode
+}
+
+func (self *CaptureContext) Limit() *int {
+	return self.limit
+}
+
+func (self *CaptureContext) Format() *CaptureFormat {
+	return self.fmt
+}
+
+func (self *CaptureContext) IsStreaming() bool {
+	return self != nil && self.mode == Stream
+}
+
+// Validate checks the capture settings, a nil context is valid and captures nothing.
+func (self *CaptureContext) Validate() error {
+	if self == nil {
+		return nil
+	}
+	switch self.mode {
+	case Head, Tail, HeadTail, Stream:
+	default:
+		return fmt.Errorf("invalid output capture mode: %v", self.mode)
+	}
+	if self.limit != nil && *self.limit <= 0 {
+		return fmt.Errorf("invalid output capture limit: %v", *self.limit)
+	}
+	if self.fmt != nil {
+		switch *self.fmt {
+		case Bin, Str:
+		default:
+			return fmt.Errorf("invalid output capture format: %v", *self.fmt)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON serializes the context as either
+// `{"stream": {"limit": N, "format": F}}` or
+// `{"atEnd": {"part": {"<mode>": N}, "format": F}}`.
+func (self *CaptureContext) MarshalJSON() ([]byte, error) {
+	inner := make(map[string]interface{})
+	if self.fmt != nil {
+		inner["format"] = string(*self.fmt)
+	}
+	if self.IsStreaming() {
+		if self.limit != nil {
+			inner["limit"] = *self.limit
+		}
+		return json.Marshal(map[string]interface{}{"stream": inner})
+	}
+	if self.limit != nil {
+		inner["part"] = map[string]int{string(self.mode): *self.limit}
+	}
+	return json.Marshal(map[string]interface{}{"atEnd": inner})
+}
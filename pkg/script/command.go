@@ -0,0 +1,178 @@
+package script
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Command is a single ExeScript command.
+type Command interface {
+	// Name is the key under which the command is serialized, e.g. "run".
+	Name() string
+	// Validate checks that the command can be submitted to an activity.
+	Validate() error
+}
+
+// Deploy asks the exe-unit to deploy the package named in the agreement.
+type Deploy struct{}
+
+func (d *Deploy) Name() string {
+	return "deploy"
+}
+
+func (d *Deploy) Validate() error {
+	return nil
+}
+
+// Start starts the deployed runtime.
+type Start struct {
+	Args []string `json:"args,omitempty"`
+}
+
+func (s *Start) Name() string {
+	return "start"
+}
+
+func (s *Start) Validate() error {
+	return nil
+}
+
+// Run executes a program inside the runtime.
+type Run struct {
+	EntryPoint string            `json:"entry_point"`
+	Args       []string          `json:"args"`
+	Env        map[string]string `json:"env,omitempty"`
+	Capture    *Capture          `json:"capture,omitempty"`
+}
+
+func (r *Run) Name() string {
+	return "run"
+}
+
+// MarshalJSON always emits `args`, since the exe-unit rejects a missing list.
+func (r *Run) MarshalJSON() ([]byte, error) {
+	type run Run
+	out := run(*r)
+	if out.Args == nil {
+		out.Args = []string{}
+	}
+	return json.Marshal(&out)
+}
+
+func (r *Run) Validate() error {
+	if r.EntryPoint == "" {
+		return &ValidationError{Command: r.Name(), Reason: "missing entry point"}
+	}
+	if r.Capture != nil {
+		if err := r.Capture.Stdout.Validate(); err != nil {
+			return &ValidationError{Command: r.Name(), Reason: fmt.Sprintf("stdout: %v", err)}
+		}
+		if err := r.Capture.Stderr.Validate(); err != nil {
+			return &ValidationError{Command: r.Name(), Reason: fmt.Sprintf("stderr: %v", err)}
+		}
+	}
+	return nil
+}
+
+// Capture selects how the output streams of a Run command are captured.
+type Capture struct {
+	Stdout *CaptureContext `json:"stdout,omitempty"`
+	Stderr *CaptureContext `json:"stderr,omitempty"`
+}
+
+// Transfer copies a file between the requestor storage and the container.
+type Transfer struct {
+	From string                 `json:"from"`
+	To   string                 `json:"to"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+func (t *Transfer) Name() string {
+	return "transfer"
+}
+
+func (t *Transfer) Validate() error {
+	if t.From == "" {
+		return &ValidationError{Command: t.Name(), Reason: "missing source"}
+	}
+	if t.To == "" {
+		return &ValidationError{Command: t.Name(), Reason: "missing destination"}
+	}
+	return nil
+}
+
+// Terminate stops the runtime.
+type Terminate struct{}
+
+func (t *Terminate) Name() string {
+	return "terminate"
+}
+
+func (t *Terminate) Validate() error {
+	return nil
+}
+
+// Sign asks the exe-unit to sign the script of the batch and the outputs of
+// the commands preceding it. The command's stdout is a JSON object holding the
+// executed script as `output`, the stdout and stderr of each command as
+// `results`, the hex encoded signature over the SHA-256 digest of `output`
+// followed by `results` as `signature` and the hex encoded key of the signer
+// as `pubKey`.
+type Sign struct{}
+
+func (s *Sign) Name() string {
+	return "sign"
+}
+
+func (s *Sign) Validate() error {
+	return nil
+}
+
+// ValidationError is returned when a command is not fit for submission.
+type ValidationError struct {
+	Command string
+	Index   int
+	Reason  string
+}
+
+func (v *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %v command at index %v: %v", v.Command, v.Index, v.Reason)
+}
+
+// Script is an ordered list of commands sent to an activity as one batch.
+type Script []Command
+
+// Validate checks every command in the script.
+func (s Script) Validate() error {
+	if len(s) == 0 {
+		return errors.New("empty script")
+	}
+	for i, cmd := range s {
+		if cmd == nil {
+			return &ValidationError{Index: i, Reason: "nil command"}
+		}
+		if err := cmd.Validate(); err != nil {
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				verr.Index = i
+				return verr
+			}
+			return &ValidationError{Command: cmd.Name(), Index: i, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// MarshalJSON serializes the script into the ExeScript wire format, i.e. a
+// list of single-key objects such as `[{"deploy": {}}, {"start": {}}]`.
+func (s Script) MarshalJSON() ([]byte, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	cmds := make([]map[string]Command, len(s))
+	for i, cmd := range s {
+		cmds[i] = map[string]Command{cmd.Name(): cmd}
+	}
+	return json.Marshal(cmds)
+}
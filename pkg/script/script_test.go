@@ -0,0 +1,137 @@
+package script
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func captureContext(t *testing.T, mode CaptureMode, limit int, format CaptureFormat) *CaptureContext {
+	var l *int
+	if limit > 0 {
+		l = &limit
+	}
+	var f *CaptureFormat
+	if format != "" {
+		f = &format
+	}
+	c, err := NewCaptureContext(mode, l, f)
+	testutil.Ok(t, err)
+	return c
+}
+
+func TestScriptGolden(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Script Script
+	}{
+		{
+			Name:   "init",
+			Script: Script{&Deploy{}, &Start{}},
+		},
+		{
+			Name: "run_stream",
+			Script: Script{
+				&Run{
+					EntryPoint: "/bin/sh",
+					Args:       []string{"-c", "echo hello"},
+					Capture: &Capture{
+						Stdout: captureContext(t, Stream, 0, Str),
+						Stderr: captureContext(t, Stream, 0, Str),
+					},
+				},
+			},
+		},
+		{
+			Name: "run_at_end",
+			Script: Script{
+				&Run{
+					EntryPoint: "/golem/entrypoints/run",
+					Capture: &Capture{
+						Stdout: captureContext(t, Head, 1024, Bin),
+						Stderr: captureContext(t, "all", 0, ""),
+					},
+				},
+			},
+		},
+		{
+			Name: "run_env",
+			Script: Script{
+				&Run{
+					EntryPoint: "/golem/entrypoints/run",
+					Args:       []string{"--verbose"},
+					Env:        map[string]string{"TASK_ID": "7", "LANG": "C"},
+				},
+			},
+		},
+		{
+			Name: "transfer",
+			Script: Script{
+				&Transfer{From: "gftp://0xabc/src", To: "container:/golem/input/data.json"},
+				&Transfer{From: "container:/golem/output/out.txt", To: "gftp://0xabc/dst"},
+			},
+		},
+		{
+			Name:   "terminate_sign",
+			Script: Script{&Sign{}, &Terminate{}},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			got, err := json.MarshalIndent(testCase.Script, "", "  ")
+			testutil.Ok(t, err)
+			golden := filepath.Join("testdata", testCase.Name+".golden")
+			if *update {
+				testutil.Ok(t, ioutil.WriteFile(golden, append(got, '\n'), 0644))
+			}
+			exp, err := ioutil.ReadFile(golden)
+			testutil.Ok(t, err)
+			testutil.Equals(t, string(exp), string(got)+"\n")
+		})
+	}
+}
+
+func TestScriptValidate(t *testing.T) {
+	negative := -1
+	testCases := []struct {
+		Script Script
+		Err    string
+	}{
+		{
+			Script: Script{},
+			Err:    "empty script",
+		},
+		{
+			Script: Script{&Deploy{}, &Run{}},
+			Err:    "invalid run command at index 1: missing entry point",
+		},
+		{
+			Script: Script{&Transfer{To: "container:/golem/input"}},
+			Err:    "invalid transfer command at index 0: missing source",
+		},
+		{
+			Script: Script{&Transfer{From: "gftp://0xabc/src"}},
+			Err:    "invalid transfer command at index 0: missing destination",
+		},
+		{
+			Script: Script{&Run{
+				EntryPoint: "/bin/ls",
+				Capture:    &Capture{Stdout: newCaptureContext(Tail, &negative, nil)},
+			}},
+			Err: "invalid run command at index 0: stdout: invalid output capture limit: -1",
+		},
+	}
+	for _, testCase := range testCases {
+		err := testCase.Script.Validate()
+		testutil.NotOk(t, err)
+		testutil.Equals(t, testCase.Err, err.Error())
+		_, err = json.Marshal(testCase.Script)
+		testutil.NotOk(t, err)
+	}
+}
@@ -0,0 +1,268 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hhio618/go-golem/pkg/rest"
+	activity "github.com/hhio618/ya-go-client/ya-activity"
+)
+
+// fakeBatch is a batch sent to the fake activity API.
+type fakeBatch struct {
+	ActivityId string
+	Id         string
+	// Commands lists the names of the commands of the batch.
+	Commands []string
+	Script   []map[string]json.RawMessage
+}
+
+// fakeActivityApi serves the requestor side of the activity API. Failed
+// checks of the handlers are recorded and reported on the test goroutine
+// when the test ends.
+type fakeActivityApi struct {
+	t    *testing.T
+	srv  *httptest.Server
+	lock sync.Mutex
+	errs []string
+
+	created   []string
+	destroyed []string
+	batches   []*fakeBatch
+	states    map[string]string
+	usage     []float32
+
+	// exec, if set, returns the status of the exec request of a batch,
+	// zero accepts it.
+	exec func(batch *fakeBatch) int
+	// results, if set, returns the results of a polled batch, nil results
+	// keep the batch running. All commands succeed by default.
+	results func(batch *fakeBatch) []activity.ExeScriptCommandResult
+	// stream, if set, returns the events streamed for a batch, otherwise
+	// event streams are not served and batches are polled.
+	stream func(batch *fakeBatch) []string
+}
+
+func newFakeActivityApi(t *testing.T) *fakeActivityApi {
+	f := &fakeActivityApi{
+		t:      t,
+		states: make(map[string]string),
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(func() {
+		f.srv.Close()
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		for _, err := range f.errs {
+			t.Error(err)
+		}
+	})
+	return f
+}
+
+func (f *fakeActivityApi) errorf(format string, args ...interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.errs = append(f.errs, fmt.Sprintf(format, args...))
+}
+
+// service returns an activity service bound to the fake API.
+func (f *fakeActivityApi) service() *rest.ActivityService {
+	cfg := activity.NewConfiguration()
+	cfg.Servers = activity.ServerConfigurations{{URL: f.srv.URL}}
+	service := rest.NewActivityService(context.Background(), activity.NewAPIClient(cfg), log.NewNopLogger())
+	service.SetBackoff(rest.Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond, Multiplier: 2})
+	return service
+}
+
+func (f *fakeActivityApi) setState(activityId, state string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.states[activityId] = state
+}
+
+func (f *fakeActivityApi) setUsage(usage ...float32) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.usage = usage
+}
+
+// Created returns the ids of the created activities.
+func (f *fakeActivityApi) Created() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.created...)
+}
+
+// Destroyed returns the ids of the destroyed activities.
+func (f *fakeActivityApi) Destroyed() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.destroyed...)
+}
+
+// Scripts returns the command names of the batches sent so far.
+func (f *fakeActivityApi) Scripts() [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	scripts := make([][]string, len(f.batches))
+	for i, batch := range f.batches {
+		scripts[i] = batch.Commands
+	}
+	return scripts
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeActivityApi) serve(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 1:
+		f.lock.Lock()
+		activityId := fmt.Sprintf("act-%d", len(f.created)+1)
+		f.created = append(f.created, activityId)
+		f.lock.Unlock()
+		writeJson(w, strconv.Quote(activityId))
+	case r.Method == http.MethodDelete && len(parts) == 2:
+		f.lock.Lock()
+		f.destroyed = append(f.destroyed, parts[1])
+		f.states[parts[1]] = rest.ActivityStateTerminated
+		f.lock.Unlock()
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "state":
+		f.lock.Lock()
+		state, ok := f.states[parts[1]]
+		f.lock.Unlock()
+		if !ok {
+			state = rest.ActivityStateReady
+		}
+		writeJson(w, activity.ActivityState{State: []*string{&state, nil}})
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "usage":
+		f.lock.Lock()
+		usage := f.usage
+		f.lock.Unlock()
+		writeJson(w, activity.ActivityUsage{CurrentUsage: &usage})
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "exec":
+		f.serveExec(w, r, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[2] == "exec":
+		f.serveResults(w, r, parts[1], parts[3])
+	default:
+		f.errorf("unexpected request: %v %v", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeActivityApi) serveExec(w http.ResponseWriter, r *http.Request, activityId string) {
+	req := &activity.ExeScriptRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		f.errorf("decoding exec request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	batch := &fakeBatch{ActivityId: activityId}
+	if err := json.Unmarshal([]byte(req.Text), &batch.Script); err != nil {
+		f.errorf("decoding script %v: %v", req.Text, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, cmd := range batch.Script {
+		for name := range cmd {
+			batch.Commands = append(batch.Commands, name)
+		}
+	}
+	if f.exec != nil {
+		if status := f.exec(batch); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	f.lock.Lock()
+	batch.Id = fmt.Sprintf("batch-%d", len(f.batches)+1)
+	f.batches = append(f.batches, batch)
+	f.lock.Unlock()
+	writeJson(w, strconv.Quote(batch.Id))
+}
+
+func (f *fakeActivityApi) batch(batchId string) *fakeBatch {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, batch := range f.batches {
+		if batch.Id == batchId {
+			return batch
+		}
+	}
+	return nil
+}
+
+func (f *fakeActivityApi) serveResults(w http.ResponseWriter, r *http.Request, activityId, batchId string) {
+	batch := f.batch(batchId)
+	if batch == nil || batch.ActivityId != activityId {
+		f.errorf("results of unknown batch %v of %v", batchId, activityId)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Accept") == "text/event-stream" {
+		if f.stream == nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for _, evt := range f.stream(batch) {
+			fmt.Fprint(w, evt)
+			w.(http.Flusher).Flush()
+		}
+		return
+	}
+	results := okResults(batch)
+	if f.results != nil {
+		results = f.results(batch)
+	}
+	if results == nil {
+		// The batch is still running, hold the request for a while.
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		results = []activity.ExeScriptCommandResult{}
+	}
+	writeJson(w, results)
+}
+
+// okResults returns successful results for all commands of the batch.
+func okResults(batch *fakeBatch) []activity.ExeScriptCommandResult {
+	results := make([]activity.ExeScriptCommandResult, len(batch.Commands))
+	for i := range batch.Commands {
+		finished := i == len(batch.Commands)-1
+		results[i] = activity.ExeScriptCommandResult{
+			Index:           int32(i),
+			EventDate:       time.Now(),
+			Result:          "Ok",
+			IsBatchFinished: &finished,
+		}
+	}
+	return results
+}
+
+// runtimeEvent formats a runtime event of the batch as a message of an event stream.
+func runtimeEvent(batch *fakeBatch, seq int, idx int, kind string, data interface{}) string {
+	evt, _ := json.Marshal(map[string]interface{}{
+		"batchId":   batch.Id,
+		"index":     idx,
+		"timestamp": time.Now().Format(time.RFC3339),
+		"kind":      map[string]interface{}{kind: data},
+	})
+	return fmt.Sprintf("id: %v\nevent: runtime\ndata: %s\n\n", seq, evt)
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math"
-	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/go-kit/kit/log/level"
 	"github.com/hhio618/go-golem/pkg/event"
 	"github.com/hhio618/go-golem/pkg/props"
 	"github.com/hhio618/go-golem/pkg/rest"
@@ -27,47 +27,158 @@ type Task interface {
 }
 type bufferedAgreement struct {
 	agreement        *rest.Agreement
+	providerId       string
 	nodeInfo         *props.NodeInfo
+	pricing          *props.ComLinear
 	workerTask       Task
 	hasMultiActivity bool
+	// score is the score of the proposal the agreement was made from.
+	score float32
+	// busy is set while the agreement is handed out by UseAgreement, until it
+	// is released.
+	busy bool
 }
 
+const (
+	offerTTLDefault           = 5 * time.Minute
+	emptyBufferTimeoutDefault = 3 * time.Minute
+)
+
+// AgreementPool buffers the scored proposals and hands out agreements made
+// from them, all of its methods are safe for concurrent use.
 type AgreementPool struct {
 	emitter           func(interface{})
 	offerBuffer       map[string]bufferedProposal
-	agreements        map[string]bufferedAgreement
+	agreements        map[string]*bufferedAgreement
 	log               *sync.Mutex
 	rejectedProviders map[string]bool
 	confirmed         int
+	policy            SelectionPolicy
+	// maxAgreements bounds the number of agreements held at once, including
+	// the ones being negotiated, zero means no limit.
+	maxAgreements int
+	negotiating   int
+	// changed is closed and replaced whenever an agreement or a proposal may
+	// have become available.
+	changed chan struct{}
+	// offerTTL is the age after which a buffered proposal is evicted.
+	offerTTL time.Duration
+	// emptyBufferTimeout is how long the buffer may stay empty before
+	// NoProposalsConfirmed is emitted.
+	emptyBufferTimeout time.Duration
+	emptySince         time.Time
+	emptyReported      bool
+	received           int
 }
 
 func NewAgreementPool(emitter func(interface{})) *AgreementPool {
 	return &AgreementPool{
-		emitter:           emitter,
-		offerBuffer:       make(map[string]bufferedProposal),
-		agreements:        make(map[string]bufferedAgreement),
-		log:               &sync.Mutex{},
-		rejectedProviders: make(map[string]bool),
-		confirmed:         1,
+		emitter:            emitter,
+		offerBuffer:        make(map[string]bufferedProposal),
+		agreements:         make(map[string]*bufferedAgreement),
+		log:                &sync.Mutex{},
+		rejectedProviders:  make(map[string]bool),
+		confirmed:          1,
+		policy:             NewHighestScorePolicy(nil),
+		changed:            make(chan struct{}),
+		offerTTL:           offerTTLDefault,
+		emptyBufferTimeout: emptyBufferTimeoutDefault,
+		emptySince:         time.Now(),
 	}
 }
 
-func (self *AgreementPool) Cycle() {
-	agreementsFrozenSet := make(map[string]bool)
-	for agreementId := range self.agreements {
-		agreementsFrozenSet[agreementId] = true
-	}
-	for agreementId := range agreementsFrozenSet {
-		bufferedAgreement, ok := self.agreements[agreementId]
-		if !ok {
+// SetMaxAgreements bounds the number of agreements held at once, zero means
+// no limit.
+func (self *AgreementPool) SetMaxAgreements(max int) {
+	self.log.Lock()
+	defer self.log.Unlock()
+	self.maxAgreements = max
+	self.notify()
+}
+
+// SetSelectionPolicy sets the policy deciding which agreement is handed out.
+func (self *AgreementPool) SetSelectionPolicy(policy SelectionPolicy) {
+	self.log.Lock()
+	defer self.log.Unlock()
+	self.policy = policy
+}
+
+// SetOfferTTL sets the age after which buffered proposals are evicted.
+func (self *AgreementPool) SetOfferTTL(ttl time.Duration) {
+	self.log.Lock()
+	defer self.log.Unlock()
+	self.offerTTL = ttl
+}
+
+// SetEmptyBufferTimeout sets how long the buffer may stay empty before
+// NoProposalsConfirmed is emitted.
+func (self *AgreementPool) SetEmptyBufferTimeout(timeout time.Duration) {
+	self.log.Lock()
+	defer self.log.Unlock()
+	self.emptyBufferTimeout = timeout
+}
+
+// evictProposals drops the proposals older than the TTL and the ones whose
+// subscription was closed, it has to be called with the lock held. It returns
+// the NoProposalsConfirmed event to emit once the lock is released, if the
+// buffer has been empty for too long.
+func (self *AgreementPool) evictProposals() *event.NoProposalsConfirmed {
+	for issuer, bp := range self.offerBuffer {
+		subscription := bp.proposal.Subscription()
+		if time.Since(bp.ts) <= self.offerTTL && (subscription == nil || subscription.IsOpen()) {
 			continue
 		}
+		delete(self.offerBuffer, issuer)
+	}
+	if len(self.offerBuffer) > 0 {
+		return nil
+	}
+	if self.emptySince.IsZero() {
+		self.emptySince = time.Now()
+		return nil
+	}
+	if self.emptyReported || time.Since(self.emptySince) <= self.emptyBufferTimeout {
+		return nil
+	}
+	self.emptyReported = true
+	return &event.NoProposalsConfirmed{
+		NumOffers: self.received,
+		Timeout:   self.emptyBufferTimeout,
+	}
+}
+
+// notify wakes up the callers waiting in UseAgreement, it has to be called
+// with the lock held.
+func (self *AgreementPool) notify() {
+	close(self.changed)
+	self.changed = make(chan struct{})
+}
+
+func (self *AgreementPool) emit(evt interface{}) {
+	if self.emitter != nil {
+		self.emitter(evt)
+	}
+}
+
+// Cycle evicts the stale proposals and releases the agreements whose worker
+// task is done.
+func (self *AgreementPool) Cycle() {
+	self.log.Lock()
+	noProposals := self.evictProposals()
+	finished := make(map[string]Task)
+	for agreementId, bufferedAgreement := range self.agreements {
 		task := bufferedAgreement.workerTask
-		if task != nil && !task.Done() {
-			//TODO: double check this behaviour.
-			self.ReleaseAgreement(bufferedAgreement.agreement.Id(), task.Error() != nil)
+		if task != nil && task.Done() {
+			finished[agreementId] = task
 		}
 	}
+	self.log.Unlock()
+	if noProposals != nil {
+		self.emit(noProposals)
+	}
+	for agreementId, task := range finished {
+		self.ReleaseAgreement(agreementId, task.Error() == nil)
+	}
 }
 
 func (self *AgreementPool) AddProposal(score float32, proposal *rest.OfferProposal) {
@@ -78,24 +189,68 @@ func (self *AgreementPool) AddProposal(score float32, proposal *rest.OfferPropos
 		score:    score,
 		proposal: proposal,
 	}
+	self.received++
+	self.emptySince = time.Time{}
+	self.emptyReported = false
+	self.notify()
 }
 
-func (self *AgreementPool) UseAgreement(cbk func(*rest.Agreement, *props.NodeInfo) Task) (Task, error) {
-	self.log.Lock()
-	defer self.log.Unlock()
-	agreement, nodeInfo, err := self.getAgreement()
+// UseAgreement passes an idle agreement to `cbk` and records the returned
+// task as the agreement's worker. When the selection policy reuses none of
+// the idle agreements a new one is made from the proposal it selects, if the
+// pool is below its capacity. Otherwise it waits until an agreement is
+// released or a proposal arrives, or until `ctx` is done.
+func (self *AgreementPool) UseAgreement(ctx context.Context, cbk func(*rest.Agreement, *props.NodeInfo) Task) (Task, error) {
+	return self.UseAgreementFor(ctx, "", cbk)
+}
+
+// UseAgreementFor is UseAgreement passing the affinity `key` of the work to
+// the selection policy.
+func (self *AgreementPool) UseAgreementFor(ctx context.Context, key string, cbk func(*rest.Agreement, *props.NodeInfo) Task) (Task, error) {
+	agreementId, bufferedAgreement, err := self.getAgreement(ctx, key)
 	if err != nil {
 		return nil, err
 	}
-	task := cbk(agreement, nodeInfo)
-	self.setWorker(agreement.Id(), task)
+	task := cbk(bufferedAgreement.agreement, bufferedAgreement.nodeInfo)
+	if err := self.setWorker(agreementId, task); err != nil {
+		// The task is not tracked by the pool, so it is stopped and the
+		// agreement handed back to the callers waiting for one.
+		if task != nil {
+			task.Cancel()
+		}
+		if rerr := self.ReleaseAgreement(agreementId, true); rerr != nil {
+			self.log.Lock()
+			self.notify()
+			self.log.Unlock()
+		}
+		return nil, err
+	}
 	return task, nil
 }
 
+// AgreementInfo describes the agreement with `agreementId` for an Executor.
+func (self *AgreementPool) AgreementInfo(agreementId string) (*AgreementInfo, bool) {
+	self.log.Lock()
+	defer self.log.Unlock()
+	bufferedAgreement, ok := self.agreements[agreementId]
+	if !ok {
+		return nil, false
+	}
+	return &AgreementInfo{
+		Id:            agreementId,
+		ProviderId:    bufferedAgreement.providerId,
+		NodeInfo:      bufferedAgreement.nodeInfo,
+		Pricing:       bufferedAgreement.pricing,
+		MultiActivity: bufferedAgreement.hasMultiActivity,
+	}, true
+}
+
 func (self *AgreementPool) setWorker(agreementId string, task Task) error {
+	self.log.Lock()
+	defer self.log.Unlock()
 	bufferedAgreement, ok := self.agreements[agreementId]
 	if !ok {
-		return nil
+		return fmt.Errorf("agreement %s is not in the pool", agreementId)
 	}
 	if bufferedAgreement.workerTask != nil {
 		return fmt.Errorf("buffered agreement worker task is not nil")
@@ -104,49 +259,110 @@ func (self *AgreementPool) setWorker(agreementId string, task Task) error {
 	return nil
 }
 
-func (self *AgreementPool) getAgreement() (*rest.Agreement, *props.NodeInfo, error) {
-	emit := self.emitter
+// getAgreement marks an agreement as busy and returns it, creating a new one
+// if needed.
+func (self *AgreementPool) getAgreement(ctx context.Context, key string) (string, *bufferedAgreement, error) {
+	for {
+		self.log.Lock()
+		if agreementId, ba := self.idleAgreement(key); ba != nil {
+			ba.busy = true
+			self.log.Unlock()
+			level.Info(logger).Log("msg", "reusing agreement", "id", agreementId)
+			return agreementId, ba, nil
+		}
+		var noProposals *event.NoProposalsConfirmed
+		if self.maxAgreements <= 0 || len(self.agreements)+self.negotiating < self.maxAgreements {
+			noProposals = self.evictProposals()
+			if bp, ok := self.selectProposal(key); ok {
+				delete(self.offerBuffer, bp.proposal.Issuer())
+				self.negotiating++
+				self.log.Unlock()
+				return self.newAgreement(ctx, bp)
+			}
+		}
+		changed := self.changed
+		self.log.Unlock()
+		if noProposals != nil {
+			self.emit(noProposals)
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
 
-	rand.Seed(time.Now().Unix())
-	agreements := make([]bufferedAgreement, 0)
-	for _, a := range self.agreements {
-		agreements = append(agreements, a)
+// idleAgreement returns the agreement to reuse as selected by the policy
+// among the ones not in use, it has to be called with the lock held.
+func (self *AgreementPool) idleAgreement(key string) (string, *bufferedAgreement) {
+	idle := make([]AgreementCandidate, 0)
+	for agreementId, ba := range self.agreements {
+		if !ba.busy {
+			idle = append(idle, AgreementCandidate{
+				AgreementId: agreementId,
+				ProviderId:  ba.providerId,
+				Score:       ba.score,
+			})
+		}
 	}
-	if len(agreements) > 0 {
-		ba := agreements[rand.Intn(len(agreements))]
-		fmt.Printf("Reusing agreement. id: %s", ba.agreement.Id())
-		return ba.agreement, ba.nodeInfo, nil
+	if len(idle) == 0 {
+		return "", nil
 	}
-
-	offers := make([]bufferedProposal, 0)
-	for _, a := range self.offerBuffer {
-		offers = append(offers, a)
+	sort.Slice(idle, func(i, j int) bool { return idle[i].AgreementId < idle[j].AgreementId })
+	selected := self.policy.SelectAgreement(idle, key)
+	if selected < 0 {
+		return "", nil
 	}
+	agreementId := idle[selected].AgreementId
+	return agreementId, self.agreements[agreementId]
+}
 
-	maxScoreOffers := make(map[float32][]bufferedProposal, 0)
-	maxScore := float32(math.MinInt64)
-	for _, bp := range offers {
-		if bp.score > maxScore {
-			maxScore = bp.score
-		}
-		if len(maxScoreOffers[bp.score]) == 0 {
-			maxScoreOffers[bp.score] = []bufferedProposal{}
-		}
-		maxScoreOffers[bp.score] = append(maxScoreOffers[bp.score], bp)
+// selectProposal returns the buffered proposal selected by the policy, it has
+// to be called with the lock held after evicting the stale proposals.
+func (self *AgreementPool) selectProposal(key string) (bufferedProposal, bool) {
+	if len(self.offerBuffer) == 0 {
+		return bufferedProposal{}, false
 	}
-	var bp bufferedProposal
-	if _, ok := maxScoreOffers[maxScore]; ok {
-		bp = maxScoreOffers[maxScore][rand.Intn(len(maxScoreOffers[maxScore]))]
+	proposals := make([]ProposalCandidate, 0, len(self.offerBuffer))
+	for issuer, bp := range self.offerBuffer {
+		proposals = append(proposals, ProposalCandidate{
+			ProviderId: issuer,
+			Score:      bp.score,
+			Received:   bp.ts,
+		})
 	}
-	delete(self.offerBuffer, bp.proposal.Issuer())
-	ctx := context.TODO()
-	agreement, err := bp.proposal.CreateAgreement(ctx, 0)
-	select {
-	case <-ctx.Done():
-		return nil, nil, err
+	sort.Slice(proposals, func(i, j int) bool { return proposals[i].ProviderId < proposals[j].ProviderId })
+	selected := self.policy.SelectProposal(proposals, key)
+	if selected < 0 {
+		return bufferedProposal{}, false
 	}
+	return self.offerBuffer[proposals[selected].ProviderId], true
+}
+
+// newAgreement negotiates an agreement from `bp` without holding the lock,
+// the slot for it has already been reserved by getAgreement.
+func (self *AgreementPool) newAgreement(ctx context.Context, bp bufferedProposal) (string, *bufferedAgreement, error) {
+	ba, err := self.negotiate(ctx, bp)
+	self.log.Lock()
+	defer self.log.Unlock()
+	self.negotiating--
+	if err != nil {
+		self.notify()
+		return "", nil, err
+	}
+	ba.busy = true
+	agreementId := ba.agreement.Id()
+	delete(self.rejectedProviders, ba.providerId)
+	self.agreements[agreementId] = ba
+	self.confirmed += 1
+	return agreementId, ba, nil
+}
+
+func (self *AgreementPool) negotiate(ctx context.Context, bp bufferedProposal) (*bufferedAgreement, error) {
+	agreement, err := bp.proposal.CreateAgreement(ctx, 0)
 	if err != nil {
-		emit(&event.ProposalFailed{
+		self.emit(&event.ProposalFailed{
 			ProposalEvent: event.ProposalEvent{
 				PropId: bp.proposal.Id(),
 			},
@@ -156,30 +372,36 @@ func (self *AgreementPool) getAgreement() (*rest.Agreement, *props.NodeInfo, err
 				},
 			},
 		})
-		return nil, nil, err
+		return nil, err
 	}
 	agreementDetails, err := agreement.Details()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	providerActivty := &props.Activity{}
 	err = agreementDetails.ProviderView().Extract(providerActivty)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	requesterActivity := &props.Activity{}
 	err = agreementDetails.RequesterView().Extract(requesterActivity)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	nodeInfo := &props.NodeInfo{}
 	err = agreementDetails.ProviderView().Extract(nodeInfo)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	// The pricing is only needed to report the running cost of activities.
+	pricing := &props.ComLinear{}
+	if err = agreementDetails.ProviderView().Extract(pricing); err != nil {
+		level.Debug(logger).Log("msg", "offer without linear pricing", "id", agreement.Id(), "err", err)
+		pricing = nil
 	}
-	fmt.Printf("New agreement. id: %s, provider: %s", agreement.Id(), nodeInfo)
-	emit(&event.AgreementCreated{
+	level.Info(logger).Log("msg", "new agreement", "id", agreement.Id(), "provider", nodeInfo.Name)
+	self.emit(&event.AgreementCreated{
 		AgreementEvent: event.AgreementEvent{
 			AgrId: agreement.Id(),
 		},
@@ -187,30 +409,30 @@ func (self *AgreementPool) getAgreement() (*rest.Agreement, *props.NodeInfo, err
 		ProviderInfo: *nodeInfo,
 	})
 	if err = agreement.Confirm(); err != nil {
-		emit(&event.AgreementRejected{
+		self.emit(&event.AgreementRejected{
 			AgreementEvent: event.AgreementEvent{
 				AgrId: agreement.Id(),
 			},
 		})
-		return nil, nil, err
-	}
-	delete(self.rejectedProviders, bp.proposal.Issuer())
-	self.agreements[agreement.Id()] = bufferedAgreement{
-		agreement:        agreement,
-		nodeInfo:         nodeInfo,
-		workerTask:       nil,
-		hasMultiActivity: providerActivty.MultiActivity && requesterActivity.MultiActivity,
+		return nil, err
 	}
-	emit(&event.AgreementConfirmed{
+	self.emit(&event.AgreementConfirmed{
 		AgreementEvent: event.AgreementEvent{
 			AgrId: agreement.Id(),
 		},
 	})
-	self.confirmed += 1
-	return agreement, nodeInfo, nil
-
+	return &bufferedAgreement{
+		agreement:        agreement,
+		providerId:       bp.proposal.Issuer(),
+		nodeInfo:         nodeInfo,
+		pricing:          pricing,
+		hasMultiActivity: providerActivty.MultiActivity && requesterActivity.MultiActivity,
+		score:            bp.score,
+	}, nil
 }
 
+// ReleaseAgreement returns the agreement to the pool, it is terminated unless
+// `allowReuse` is set and the agreement allows multiple activities.
 func (self *AgreementPool) ReleaseAgreement(agreementId string, allowReuse bool) error {
 	self.log.Lock()
 	defer self.log.Unlock()
@@ -220,52 +442,39 @@ func (self *AgreementPool) ReleaseAgreement(agreementId string, allowReuse bool)
 	}
 	bufferedAgreement.workerTask = nil
 	if !allowReuse || !bufferedAgreement.hasMultiActivity {
+		// The agreement stays busy until it is removed by terminateAgreement.
 		reason := map[string]string{"message": "Work cancelled", "golem.requestor.code": "Cancelled"}
-		//TODO: is this a good idea?
 		go self.terminateAgreement(agreementId, reason)
+		return nil
 	}
+	bufferedAgreement.busy = false
+	self.notify()
 	return nil
 }
 
 // terminateAgreement will terminate the agreement with given `agreementId`.
 func (self *AgreementPool) terminateAgreement(agreementId string, reason map[string]string) {
+	self.log.Lock()
 	bufferedAgreement, ok := self.agreements[agreementId]
+	if ok {
+		delete(self.agreements, agreementId)
+		self.notify()
+	}
+	self.log.Unlock()
 	if !ok {
-		//TODO:
-		//logger.warning("Trying to terminate agreement not in the pool. id: %s", agreement_id)
+		level.Warn(logger).Log("msg", "trying to terminate agreement not in the pool", "id", agreementId)
 		return
 	}
 
 	provider := "<couldn't get provider name>"
-	agreementDetails, err := bufferedAgreement.agreement.Details()
-	if err != nil {
-		//TODO:
-		//logger.debug("Cannot get details for agreement %s", agreement_id, exc_info=True)
-	} else {
-		node := &props.NodeInfo{}
-		err = agreementDetails.ProviderView().Extract(node)
-		if err != nil {
-			provider = node.Name
-		}
+	if bufferedAgreement.nodeInfo != nil {
+		provider = bufferedAgreement.nodeInfo.Name
 	}
-
-	//TODO:
-	// logger.debug(
-	// 	"Terminating agreement. id: %s, reason: %s, provider: %s",
-	// 	agreement_id,
-	// 	reason,
-	// 	provider,
-	// )
-	fmt.Printf("provider: %v", provider)
+	level.Debug(logger).Log("msg", "terminating agreement", "id", agreementId, "reason", fmt.Sprint(reason), "provider", provider)
 
 	if bufferedAgreement.workerTask != nil && !bufferedAgreement.workerTask.Done() {
-		//TODO:
-		// logger.debug(
-		// 	"Terminating agreement that still has worker. agreement_id: %s, worker: %s",
-		// 	buffered_agreement.agreement.id,
-		// 	buffered_agreement.worker_task,
-		// )
-		bufferedAgreement.workerTask.Done()
+		level.Debug(logger).Log("msg", "terminating agreement that still has worker", "id", agreementId)
+		bufferedAgreement.workerTask.Cancel()
 	}
 
 	// Converting reason to a map[string]interface{} type.
@@ -276,31 +485,47 @@ func (self *AgreementPool) terminateAgreement(agreementId string, reason map[str
 
 	if bufferedAgreement.hasMultiActivity {
 		if err := bufferedAgreement.agreement.Terminate(r); err != nil {
-			//TODO:
-			// logger.debug(
-			// 	"Couldn't terminate agreement. id: %s, provider: %s",
-			// 	buffered_agreement.agreement.id,
-			// 	provider,
-			// )
+			level.Debug(logger).Log("msg", "couldn't terminate agreement", "id", agreementId, "provider", provider, "err", err)
 		}
 	}
 
-	delete(self.agreements, agreementId)
-	self.emitter(event.AgreementTerminated{AgreementEvent: event.AgreementEvent{AgrId: agreementId, Reason: reason}})
+	self.emit(&event.AgreementTerminated{AgreementEvent: event.AgreementEvent{AgrId: agreementId, Reason: reason}})
 }
+
+// terminateAll terminates all agreements in the pool and waits until they are
+// terminated.
 func (self *AgreementPool) terminateAll(reason map[string]string) {
 	self.log.Lock()
-	defer self.log.Unlock()
-	var frozen map[string]bufferedAgreement
-	/* Copy Content from self.agreements to frozen*/
-	for index, element := range self.agreements {
-		frozen[index] = element
+	agreementIds := make([]string, 0, len(self.agreements))
+	for agreementId := range self.agreements {
+		agreementIds = append(agreementIds, agreementId)
 	}
-	for agreementId := range frozen {
-		//TODO:
-		go self.terminateAgreement(agreementId, reason)
+	self.log.Unlock()
+	wg := &sync.WaitGroup{}
+	for _, agreementId := range agreementIds {
+		wg.Add(1)
+		go func(agreementId string) {
+			defer wg.Done()
+			self.terminateAgreement(agreementId, reason)
+		}(agreementId)
 	}
+	wg.Wait()
+}
 
+// CollectAgreementEvents follows the agreement events of the market until
+// `ctx` is done, the agreements terminated by providers are removed from the
+// pool.
+func (self *AgreementPool) CollectAgreementEvents(ctx context.Context, market *rest.Market) {
+	for agreementEvent := range market.AgreementEvents(ctx) {
+		if agreementEvent.EventType == rest.AgreementEventTerminated && agreementEvent.Terminator == rest.TerminatorProvider {
+			self.onAgreementTerminated(agreementEvent.AgreementId, agreementEvent.Reason)
+			continue
+		}
+		// Approvals and rejections are already seen by Agreement.Confirm and
+		// terminations by the requestor by terminateAgreement.
+		level.Debug(logger).Log("msg", "agreement event", "type", agreementEvent.EventType, "id", agreementEvent.AgreementId,
+			"terminator", agreementEvent.Terminator)
+	}
 }
 
 func (self *AgreementPool) onAgreementTerminated(agrId string, reason map[string]string) {
@@ -310,8 +535,12 @@ func (self *AgreementPool) onAgreementTerminated(agrId string, reason map[string
 		Should be called when AgreementTerminated event is received.
 	*/
 	self.log.Lock()
-	defer self.log.Unlock()
 	bufferedAgreement, ok := self.agreements[agrId]
+	if ok {
+		delete(self.agreements, agrId)
+		self.notify()
+	}
+	self.log.Unlock()
 	if !ok {
 		return
 	}
@@ -319,7 +548,5 @@ func (self *AgreementPool) onAgreementTerminated(agrId string, reason map[string
 	if bufferedAgreement.workerTask != nil {
 		bufferedAgreement.workerTask.Cancel()
 	}
-	delete(self.agreements, agrId)
-	self.emitter(event.AgreementTerminated{AgreementEvent: event.AgreementEvent{AgrId: agrId, Reason: reason}})
-
+	self.emit(&event.AgreementTerminated{AgreementEvent: event.AgreementEvent{AgrId: agrId, Reason: reason}})
 }
@@ -0,0 +1,313 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/testutil"
+	yam "github.com/hhio618/ya-go-client/ya-market"
+)
+
+type testTask struct {
+	lock *sync.Mutex
+	done bool
+	err  error
+}
+
+func newTestTask() *testTask {
+	return &testTask{lock: &sync.Mutex{}}
+}
+
+func (t *testTask) Done() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.done
+}
+
+func (t *testTask) Cancel() error {
+	t.finish(errors.New("cancelled"))
+	return nil
+}
+
+func (t *testTask) Error() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err
+}
+
+func (t *testTask) finish(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.done = true
+	t.err = err
+}
+
+// newTestPool returns a pool holding `n` confirmed multi-activity agreements.
+func newTestPool(n int, emitter func(interface{})) *AgreementPool {
+	pool := NewAgreementPool(emitter)
+	for i := 0; i < n; i++ {
+		pool.agreements[fmt.Sprintf("agr-%d", i)] = &bufferedAgreement{
+			agreement:        &rest.Agreement{},
+			providerId:       fmt.Sprintf("provider-%d", i),
+			nodeInfo:         &props.NodeInfo{Name: fmt.Sprintf("provider-%d", i)},
+			hasMultiActivity: true,
+		}
+	}
+	return pool
+}
+
+func useAgreement(ctx context.Context, pool *AgreementPool) (*testTask, error) {
+	task := newTestTask()
+	_, err := pool.UseAgreement(ctx, func(*rest.Agreement, *props.NodeInfo) Task {
+		return task
+	})
+	return task, err
+}
+
+func TestUseAgreementEmptyBuffer(t *testing.T) {
+	pool := newTestPool(0, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := useAgreement(ctx, pool)
+	testutil.Equals(t, context.DeadlineExceeded, err)
+}
+
+func TestUseAgreementWaitsForCapacity(t *testing.T) {
+	pool := newTestPool(1, nil)
+	pool.SetMaxAgreements(1)
+	task, err := useAgreement(context.Background(), pool)
+	testutil.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = useAgreement(ctx, pool)
+	testutil.Equals(t, context.DeadlineExceeded, err)
+
+	errCh := make(chan error)
+	go func() {
+		_, err := useAgreement(context.Background(), pool)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("agreement handed out before it was released: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	task.finish(nil)
+	pool.Cycle()
+	select {
+	case err := <-errCh:
+		testutil.Ok(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("agreement not handed out after it was released")
+	}
+}
+
+func TestUseAgreementWorkerFailure(t *testing.T) {
+	pool := newTestPool(1, nil)
+	pool.SetMaxAgreements(1)
+	errCh := make(chan error)
+	task := newTestTask()
+	_, err := pool.UseAgreement(context.Background(), func(*rest.Agreement, *props.NodeInfo) Task {
+		go func() {
+			_, err := useAgreement(context.Background(), pool)
+			errCh <- err
+		}()
+		// The agreement gets a worker before this task is recorded.
+		time.Sleep(20 * time.Millisecond)
+		pool.log.Lock()
+		pool.agreements["agr-0"].workerTask = newTestTask()
+		pool.log.Unlock()
+		return task
+	})
+	testutil.NotOk(t, err)
+	testutil.Assert(t, task.Done(), "untracked task not cancelled")
+	select {
+	case err := <-errCh:
+		testutil.Ok(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("agreement not handed out after the worker failed")
+	}
+}
+
+func TestAgreementPoolConcurrentUse(t *testing.T) {
+	var events int32
+	lock := &sync.Mutex{}
+	pool := newTestPool(3, func(interface{}) {
+		lock.Lock()
+		events++
+		lock.Unlock()
+	})
+	pool.SetMaxAgreements(3)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			task, err := useAgreement(ctx, pool)
+			if err != nil {
+				return
+			}
+			task.finish(nil)
+			pool.Cycle()
+		}()
+	}
+	wg.Wait()
+	// There is no market API behind the test agreements to terminate them.
+	pool.log.Lock()
+	for _, ba := range pool.agreements {
+		ba.hasMultiActivity = false
+	}
+	pool.log.Unlock()
+	pool.terminateAll(map[string]string{"message": "Finished"})
+	_, ok := pool.AgreementInfo("agr-0")
+	testutil.Assert(t, !ok, "agreement still in the pool after terminateAll")
+	lock.Lock()
+	defer lock.Unlock()
+	testutil.Equals(t, int32(3), events)
+}
+
+func newTestProposal(subscription *rest.Subscription, issuer string) *rest.OfferProposal {
+	return rest.NewOfferProposal(subscription, &yam.ProposalEvent{
+		Proposal: yam.Proposal{ProposalId: "proposal-" + issuer, IssuerId: issuer},
+	})
+}
+
+// cycle runs a cycle of the pool, failing if it does not return.
+func cycle(t *testing.T, pool *AgreementPool) {
+	done := make(chan struct{})
+	go func() {
+		pool.Cycle()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cycle blocked")
+	}
+}
+
+func TestEvictProposals(t *testing.T) {
+	pool := newTestPool(0, nil)
+	pool.SetOfferTTL(time.Minute)
+	open := rest.NewSubscription(log.NewNopLogger(), context.Background(), nil, "open", true, false, nil)
+	closed := rest.NewSubscription(log.NewNopLogger(), context.Background(), nil, "closed", true, false, nil)
+	pool.AddProposal(1, newTestProposal(open, "fresh"))
+	pool.AddProposal(1, newTestProposal(open, "stale"))
+	pool.AddProposal(1, newTestProposal(closed, "closed"))
+	closed.Close()
+	pool.log.Lock()
+	stale := pool.offerBuffer["stale"]
+	stale.ts = time.Now().Add(-2 * time.Minute)
+	pool.offerBuffer["stale"] = stale
+	pool.log.Unlock()
+
+	cycle(t, pool)
+	pool.log.Lock()
+	defer pool.log.Unlock()
+	testutil.Equals(t, 1, len(pool.offerBuffer))
+	_, ok := pool.offerBuffer["fresh"]
+	testutil.Assert(t, ok, "fresh proposal evicted")
+}
+
+func TestNoProposalsConfirmed(t *testing.T) {
+	var pool *AgreementPool
+	events := make([]interface{}, 0)
+	pool = newTestPool(0, func(evt interface{}) {
+		// The event is emitted without holding the lock of the pool.
+		pool.SetEmptyBufferTimeout(20 * time.Millisecond)
+		events = append(events, evt)
+	})
+	pool.SetOfferTTL(10 * time.Millisecond)
+	pool.SetEmptyBufferTimeout(20 * time.Millisecond)
+	subscription := rest.NewSubscription(log.NewNopLogger(), context.Background(), nil, "sub", true, false, nil)
+	pool.AddProposal(1, newTestProposal(subscription, "provider"))
+	cycle(t, pool)
+	time.Sleep(30 * time.Millisecond)
+	// The buffer empties once the proposal expires.
+	cycle(t, pool)
+	testutil.Equals(t, 0, len(events))
+	time.Sleep(30 * time.Millisecond)
+	cycle(t, pool)
+	testutil.Equals(t, []interface{}{&event.NoProposalsConfirmed{NumOffers: 1, Timeout: 20 * time.Millisecond}}, events)
+	// The empty buffer is reported once.
+	time.Sleep(30 * time.Millisecond)
+	cycle(t, pool)
+	testutil.Equals(t, 1, len(events))
+
+	// A new proposal starts over.
+	pool.AddProposal(1, newTestProposal(subscription, "provider"))
+	time.Sleep(30 * time.Millisecond)
+	cycle(t, pool)
+	time.Sleep(30 * time.Millisecond)
+	cycle(t, pool)
+	testutil.Equals(t, 2, len(events))
+	testutil.Equals(t, &event.NoProposalsConfirmed{NumOffers: 2, Timeout: 20 * time.Millisecond}, events[1])
+}
+
+func TestCollectAgreementEvents(t *testing.T) {
+	events := make(chan interface{}, 10)
+	pool := newTestPool(3, func(evt interface{}) {
+		events <- evt
+	})
+	workers := make([]*testTask, 3)
+	for i := range workers {
+		workers[i] = newTestTask()
+		pool.agreements[fmt.Sprintf("agr-%d", i)].workerTask = workers[i]
+	}
+	collected := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if collected || r.URL.Path != "/agreementEvents" {
+			time.Sleep(10 * time.Millisecond)
+			w.Write([]byte("[]"))
+			return
+		}
+		collected = true
+		date := time.Now().Add(time.Minute).Format(time.RFC3339Nano)
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"eventType": rest.AgreementEventApproved, "eventDate": date, "agreementId": "agr-2"},
+			{"eventType": rest.AgreementEventTerminated, "eventDate": date, "agreementId": "agr-0",
+				"terminator": rest.TerminatorRequestor, "reason": map[string]interface{}{"message": "Finished"}},
+			{"eventType": rest.AgreementEventTerminated, "eventDate": date, "agreementId": "agr-1",
+				"terminator": rest.TerminatorProvider, "reason": map[string]interface{}{"message": "Shutting down"}},
+		})
+	}))
+	defer srv.Close()
+	cfg := yam.NewConfiguration()
+	cfg.Servers = yam.ServerConfigurations{{URL: srv.URL}}
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	done := make(chan struct{})
+	go func() {
+		pool.CollectAgreementEvents(ctx, rest.NewMarket(ctx, yam.NewAPIClient(cfg), log.NewNopLogger()))
+		close(done)
+	}()
+
+	// Only the termination by the provider removes the agreement.
+	testutil.Equals(t, &event.AgreementTerminated{AgreementEvent: event.AgreementEvent{
+		AgrId: "agr-1", Reason: map[string]string{"message": "Shutting down"}}}, <-events)
+	cncl()
+	<-done
+	testutil.Equals(t, 0, len(events))
+	pool.log.Lock()
+	defer pool.log.Unlock()
+	_, ok := pool.agreements["agr-1"]
+	testutil.Assert(t, !ok, "agreement terminated by the provider kept")
+	testutil.Equals(t, 2, len(pool.agreements))
+	testutil.Assert(t, workers[1].Done(), "worker of the terminated agreement not cancelled")
+	testutil.Assert(t, !workers[0].Done(), "worker of agreement terminated by the requestor cancelled")
+}
@@ -0,0 +1,191 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/hhio618/go-golem/pkg/rest"
+)
+
+// AppTagProperty is the demand property identifying the app which subscribed
+// the demand, see DemandSubscriber.SetAppTag.
+const AppTagProperty = "golem.requestor.app-tag"
+
+const agreementStateApproved = "Approved"
+
+// paymentPlatformPrefix starts the demand properties holding the address
+// paid from on a payment platform, as in
+// golem.com.payment.platform.<platform>.address.
+const paymentPlatformPrefix = "golem.com.payment.platform."
+
+// StaleCleanup removes what crashed previous runs of the app left on the
+// node: the demands tagged with the app tag, the approved agreements made on
+// such demands and, optionally, the allocations no live demand or agreement
+// pays from. It has to run before the app subscribes its own demand.
+type StaleCleanup struct {
+	market             *rest.Market
+	payment            *rest.Payment
+	tag                string
+	releaseAllocations bool
+}
+
+func NewStaleCleanup(market *rest.Market, payment *rest.Payment, tag string) *StaleCleanup {
+	return &StaleCleanup{
+		market:  market,
+		payment: payment,
+		tag:     tag,
+	}
+}
+
+// SetReleaseAllocations enables releasing the allocations made before the
+// cleanup started. Allocations carry no tag, so those on the payment platform
+// and address of a demand or approved agreement left after the cleanup are
+// kept, other apps may still pay from them.
+func (self *StaleCleanup) SetReleaseAllocations(release bool) {
+	self.releaseAllocations = release
+}
+
+// Run removes the leftovers, the failures to remove one of them are logged
+// and the first one is returned once all were tried.
+func (self *StaleCleanup) Run(ctx context.Context) error {
+	started := time.Now()
+	var first error
+	record := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	if err := self.unsubscribeDemands(); err != nil {
+		record(err)
+	}
+	if err := self.terminateAgreements(); err != nil {
+		record(err)
+	}
+	if self.releaseAllocations {
+		if err := self.releaseAllocationsBefore(ctx, started); err != nil {
+			record(err)
+		}
+	}
+	return first
+}
+
+func (self *StaleCleanup) unsubscribeDemands() error {
+	subscriptions, err := self.market.Subscriptions()
+	if err != nil {
+		return err
+	}
+	var first error
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		if subscription.Properties()[AppTagProperty] != self.tag {
+			continue
+		}
+		level.Info(logger).Log("msg", "unsubscribing stale demand", "subscription", subscription.Id())
+		if err := subscription.Delete(); err != nil {
+			level.Warn(logger).Log("msg", "unsubscribing stale demand", "subscription", subscription.Id(), "err", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (self *StaleCleanup) terminateAgreements() error {
+	agreements, err := self.market.Agreements(agreementStateApproved)
+	if err != nil {
+		return err
+	}
+	reason := map[string]interface{}{
+		"message":              "Agreement left behind by a previous run",
+		"golem.requestor.code": "Cancelled",
+	}
+	var first error
+	for _, agreement := range agreements {
+		details, err := agreement.Details()
+		if err != nil {
+			level.Debug(logger).Log("msg", "getting agreement details", "id", agreement.Id(), "err", err)
+			continue
+		}
+		if details.RequesterView().Properties[AppTagProperty] != self.tag {
+			continue
+		}
+		level.Info(logger).Log("msg", "terminating stale agreement", "id", agreement.Id())
+		if err := agreement.Terminate(reason); err != nil {
+			level.Warn(logger).Log("msg", "terminating stale agreement", "id", agreement.Id(), "err", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// livePayers returns the payment platforms and addresses of the demands and
+// approved agreements on the node, keyed as platform/address.
+func (self *StaleCleanup) livePayers() (map[string]bool, error) {
+	payers := make(map[string]bool)
+	add := func(properties map[string]interface{}) {
+		for key, value := range properties {
+			if !strings.HasPrefix(key, paymentPlatformPrefix) || !strings.HasSuffix(key, ".address") {
+				continue
+			}
+			platform := strings.TrimSuffix(strings.TrimPrefix(key, paymentPlatformPrefix), ".address")
+			payers[fmt.Sprintf("%v/%v", platform, value)] = true
+		}
+	}
+	subscriptions, err := self.market.Subscriptions()
+	if err != nil {
+		return nil, err
+	}
+	for i := range subscriptions {
+		add(subscriptions[i].Properties())
+	}
+	agreements, err := self.market.Agreements(agreementStateApproved)
+	if err != nil {
+		return nil, err
+	}
+	for _, agreement := range agreements {
+		details, err := agreement.Details()
+		if err != nil {
+			return nil, err
+		}
+		add(details.RequesterView().Properties)
+	}
+	return payers, nil
+}
+
+func (self *StaleCleanup) releaseAllocationsBefore(ctx context.Context, before time.Time) error {
+	// The stale demands and agreements are gone by now, so the ones left
+	// belong to other apps.
+	payers, err := self.livePayers()
+	if err != nil {
+		return err
+	}
+	allocations, err := self.payment.Allocations(ctx)
+	if err != nil {
+		return err
+	}
+	var first error
+	for i := range allocations {
+		allocation := &allocations[i]
+		if !allocation.Created.Before(before) {
+			continue
+		}
+		if payers[allocation.PaymentPlatform+"/"+allocation.PaymentAddress] {
+			level.Debug(logger).Log("msg", "keeping allocation in use", "id", allocation.Id)
+			continue
+		}
+		level.Info(logger).Log("msg", "releasing stale allocation", "id", allocation.Id)
+		if err := allocation.Delete(); err != nil {
+			level.Warn(logger).Log("msg", "releasing stale allocation", "id", allocation.Id, "err", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/testutil"
+	yam "github.com/hhio618/ya-go-client/ya-market"
+	yap "github.com/hhio618/ya-go-client/ya-payment"
+)
+
+// fakeNode serves the demands, agreements and allocations left on a node.
+type fakeNode struct {
+	lock        sync.Mutex
+	demands     map[string]map[string]interface{}
+	agreements  map[string]map[string]interface{}
+	allocations []yap.Allocation
+	removed     []string
+}
+
+func newFakeNode(t *testing.T) (*fakeNode, *rest.Market, *rest.Payment) {
+	started := time.Now()
+	payer := func(tag, address string) map[string]interface{} {
+		properties := map[string]interface{}{"golem.com.payment.platform.erc20-rinkeby-tglm.address": address}
+		if tag != "" {
+			properties[AppTagProperty] = tag
+		}
+		return properties
+	}
+	allocation := func(id, address string, created time.Time) yap.Allocation {
+		platform := "erc20-rinkeby-tglm"
+		timeout := created.Add(time.Hour)
+		return yap.Allocation{AllocationId: id, Address: &address, PaymentPlatform: &platform,
+			TotalAmount: "1", Timestamp: created, Timeout: &timeout}
+	}
+	f := &fakeNode{
+		demands: map[string]map[string]interface{}{
+			"stale-demand": payer("app", "0xapp"),
+			"other-demand": payer("other", "0xother"),
+			"plain-demand": payer("", "0xplain"),
+		},
+		agreements: map[string]map[string]interface{}{
+			"stale-agreement": payer("app", "0xapp"),
+			"other-agreement": payer("other", "0xagreement"),
+		},
+		allocations: []yap.Allocation{
+			allocation("stale-allocation", "0xapp", started.Add(-time.Hour)),
+			allocation("demand-allocation", "0xother", started.Add(-time.Hour)),
+			allocation("plain-allocation", "0xplain", started.Add(-time.Hour)),
+			allocation("agreement-allocation", "0xagreement", started.Add(-time.Hour)),
+			allocation("new-allocation", "0xapp", started.Add(time.Hour)),
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	marketCfg := yam.NewConfiguration()
+	marketCfg.Servers = yam.ServerConfigurations{{URL: srv.URL}}
+	paymentCfg := yap.NewConfiguration()
+	paymentCfg.Servers = yap.ServerConfigurations{{URL: srv.URL}}
+	return f, rest.NewMarket(context.Background(), yam.NewAPIClient(marketCfg), log.NewNopLogger()),
+		rest.NewPayment(yap.NewAPIClient(paymentCfg))
+}
+
+func (f *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/demands":
+		demands := make([]yam.Demand, 0)
+		for id, properties := range f.demands {
+			demands = append(demands, yam.Demand{DemandId: id, Properties: properties})
+		}
+		json.NewEncoder(w).Encode(demands)
+	case r.Method == http.MethodGet && r.URL.Path == "/agreements":
+		entries := make([]yam.AgreementListEntry, 0)
+		for id := range f.agreements {
+			entries = append(entries, yam.AgreementListEntry{Id: id})
+		}
+		json.NewEncoder(w).Encode(entries)
+	case r.Method == http.MethodGet && parts[0] == "agreements":
+		json.NewEncoder(w).Encode(yam.Agreement{AgreementId: parts[1],
+			Demand: yam.Demand{Properties: f.agreements[parts[1]]}})
+	case r.Method == http.MethodGet && r.URL.Path == "/allocations":
+		json.NewEncoder(w).Encode(f.allocations)
+	case r.Method == http.MethodDelete && parts[0] == "demands":
+		delete(f.demands, parts[1])
+		f.removed = append(f.removed, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && parts[0] == "agreements" && parts[2] == "terminate":
+		delete(f.agreements, parts[1])
+		f.removed = append(f.removed, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && parts[0] == "allocations":
+		f.removed = append(f.removed, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Removed returns the ids of the demands, agreements and allocations removed.
+func (f *fakeNode) Removed() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	removed := append([]string{}, f.removed...)
+	sort.Strings(removed)
+	return removed
+}
+
+func TestStaleCleanup(t *testing.T) {
+	node, market, payment := newFakeNode(t)
+	testutil.Ok(t, NewStaleCleanup(market, payment, "app").Run(context.Background()))
+	// Only what is tagged with the app tag is removed.
+	testutil.Equals(t, []string{"stale-agreement", "stale-demand"}, node.Removed())
+
+	node, market, payment = newFakeNode(t)
+	cleanup := NewStaleCleanup(market, payment, "app")
+	cleanup.SetReleaseAllocations(true)
+	testutil.Ok(t, cleanup.Run(context.Background()))
+	// The allocations paying for the demands and agreements of other apps
+	// are kept, as are the ones made after the cleanup started.
+	testutil.Equals(t, []string{"stale-agreement", "stale-allocation", "stale-demand"}, node.Removed())
+}
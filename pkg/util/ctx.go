@@ -2,58 +2,93 @@ package util
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"io/ioutil"
+	"os"
 	"time"
 
 	"github.com/hhio618/go-golem/pkg/event"
 	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/script"
 	"github.com/hhio618/go-golem/pkg/storage"
 )
 
-type CommnadContainer struct {
-	Commands []map[string]interface{}
+// CommandContainer collects the commands registered by the steps of a batch.
+type CommandContainer struct {
+	Commands script.Script
+	results  []*Result
+	timeouts []*time.Duration
+	sent     time.Time
 }
 
-func KwArgs(args ...interface{}) map[string]interface{} {
-	kwargs := make(map[string]interface{})
-	if len(args)%2 != 0 {
-		panic(errors.New("invalid kwargs"))
+// AddCommand appends a command to the batch and returns its index, the given
+// result handle (if any) is resolved once the command has been executed.
+func (c *CommandContainer) AddCommand(cmd script.Command, result *Result) int {
+	if result == nil {
+		result = newResult()
 	}
-	for i := 0; i < len(args)/2; i++ {
+	result.command = cmd.Name()
+	idx := len(c.Commands)
+	c.Commands = append(c.Commands, cmd)
+	c.results = append(c.results, result)
+	c.timeouts = append(c.timeouts, nil)
+	return idx
+}
 
-		kwargs[args[2*i].(string)] = args[2*i+1]
+// setTimeout limits the execution time of the commands from index `first` on.
+func (c *CommandContainer) setTimeout(first int, timeout *time.Duration) {
+	for idx := first; idx < len(c.timeouts); idx++ {
+		c.timeouts[idx] = timeout
 	}
-	return kwargs
-
 }
 
-func (c *CommnadContainer) AddCommand(item string, kwargs map[string]interface{}) int {
-	_kwargs := make(map[string]interface{})
-	for k, v := range kwargs {
-		_kwargs[strings.TrimLeft(k, "_")] = v
+// Script returns the batch as a validated ExeScript.
+func (c *CommandContainer) Script() (script.Script, error) {
+	if err := c.Commands.Validate(); err != nil {
+		return nil, err
 	}
-	idx := len(c.Commands)
-	c.Commands = append(c.Commands, _kwargs)
-	return idx
+	return c.Commands, nil
 }
 
 type Worker interface {
 	Prepare() error
-	Register(commands CommnadContainer) error
+	Register(commands *CommandContainer) error
 	Post(ctx context.Context) error
 	Timeout() *time.Duration
 }
 
+// resultHolder is implemented by the steps which return a result handle, so
+// that the handle can be failed when the step is never registered.
+type resultHolder interface {
+	handles() []*Result
+}
+
+// work provides the no-op defaults for the optional Worker methods.
+type work struct{}
+
+func (w *work) Prepare() error {
+	return nil
+}
+
+func (w *work) Post(ctx context.Context) error {
+	return nil
+}
+
+func (w *work) Timeout() *time.Duration {
+	return nil
+}
+
 type initStep struct {
-	Worker
+	work
 }
 
-func Register(commands CommnadContainer) error {
-	commands.AddCommand("deploy", KwArgs())
-	commands.AddCommand("start", KwArgs())
+func (i *initStep) Register(commands *CommandContainer) error {
+	commands.AddCommand(&script.Deploy{}, nil)
+	commands.AddCommand(&script.Start{}, nil)
 	return nil
 }
 
@@ -67,11 +102,15 @@ type SendWorker interface {
 }
 
 type baseSendWork struct {
+	work
 	uploader Uploader
 	storage  storage.StorageProvider
 }
 
 func (i *baseSendWork) Prepare() error {
+	if i.uploader == nil {
+		return nil
+	}
 	return i.uploader.DoUpload(i.storage)
 }
 
@@ -85,37 +124,40 @@ func newBaseSendWork(uploader Uploader,
 }
 
 type sendWork struct {
-	SendWorker
 	*baseSendWork
 	destPath string
 	src      storage.Source
 	idx      int
+	result   *Result
 }
 
-func (i *sendWork) Register(commands CommnadContainer) error {
+func (i *sendWork) Register(commands *CommandContainer) error {
 	if i.src == nil {
 		return errors.New("cmd prepared")
 	}
-	i.idx = commands.AddCommand("transfer",
-		KwArgs(
-			"_from", i.src.DownloadUrl(),
-			"_to", fmt.Sprintf("container:%v", i.destPath),
-		))
+	i.idx = commands.AddCommand(&script.Transfer{
+		From: i.src.DownloadUrl(),
+		To:   fmt.Sprintf("container:%v", i.destPath),
+	}, i.result)
 	return nil
 }
 
+func (i *sendWork) handles() []*Result {
+	return []*Result{i.result}
+}
+
 func NewSendWork(storage storage.StorageProvider,
 	destPath string) *sendWork {
 	s := &sendWork{
 		destPath: destPath,
 		idx:      -1,
+		result:   newResult(),
 	}
-	s.baseSendWork = newBaseSendWork(s, storage)
+	s.baseSendWork = newBaseSendWork(nil, storage)
 	return s
 }
 
 type sendBytes struct {
-	SendWorker
 	*sendWork
 	data []byte
 }
@@ -134,6 +176,7 @@ func NewSendBytes(storage storage.StorageProvider,
 		sendWork: &sendWork{
 			destPath: destPath,
 			idx:      -1,
+			result:   newResult(),
 		},
 		data: data,
 	}
@@ -142,7 +185,6 @@ func NewSendBytes(storage storage.StorageProvider,
 }
 
 type sendJson struct {
-	SendWorker
 	*sendBytes
 }
 
@@ -154,7 +196,6 @@ func NewSendJson(storage storage.StorageProvider,
 }
 
 type sendFile struct {
-	SendWorker
 	*sendWork
 	srcPath string
 }
@@ -164,53 +205,66 @@ func (i *sendFile) DoUpload(storage storage.StorageProvider) (err error) {
 	return err
 }
 
-func NewSendFile(sendWork *sendWork, srcPath, destPath string) *sendFile {
-	sendWork.destPath = destPath
-	return &sendFile{
-		sendWork: sendWork,
-		srcPath:  srcPath,
+func NewSendFile(storage storage.StorageProvider,
+	srcPath, destPath string) *sendFile {
+	s := &sendFile{
+		sendWork: &sendWork{
+			destPath: destPath,
+			idx:      -1,
+			result:   newResult(),
+		},
+		srcPath: srcPath,
 	}
+	s.baseSendWork = newBaseSendWork(s, storage)
+	return s
 }
 
 type run struct {
-	Worker
-	cmd    string
-	args   []string
-	env    map[string]string
-	stdOut *CaptureContext
-	stdIn  *CaptureContext
-	idx    int
+	work
+	cmd     string
+	args    []string
+	env     map[string]string
+	stdOut  *script.CaptureContext
+	stdErr  *script.CaptureContext
+	timeout *time.Duration
+	idx     int
+	result  *Result
 }
 
 func NewRun(cmd string,
 	args []string,
 	env map[string]string,
-	stdOut *CaptureContext,
-	stdIn *CaptureContext) *run {
+	stdOut *script.CaptureContext,
+	stdErr *script.CaptureContext) *run {
 	return &run{
 		cmd:    cmd,
 		args:   args,
 		env:    env,
 		stdOut: stdOut,
-		stdIn:  stdIn,
+		stdErr: stdErr,
 		idx:    -1,
+		result: newResult(),
 	}
 }
 
-func (self *run) Register(commands CommnadContainer) error {
-	capture := make(map[string]interface{})
-	if self.stdOut != nil {
-		capture["stdout"] = self.stdOut.ToMap()
-	}
-	if self.stdIn != nil {
-		capture["stdint"] = self.stdOut.ToMap()
-	}
-	i.idx = commands.AddCommand("run",
-		KwArgs(
-			"entry_point", self.cmd,
-			"args", self.args,
-			"capture", capture,
-		))
+func (self *run) handles() []*Result {
+	return []*Result{self.result}
+}
+
+func (self *run) Timeout() *time.Duration {
+	return self.timeout
+}
+
+func (self *run) Register(commands *CommandContainer) error {
+	self.idx = commands.AddCommand(&script.Run{
+		EntryPoint: self.cmd,
+		Args:       self.args,
+		Env:        self.env,
+		Capture: &script.Capture{
+			Stdout: self.stdOut,
+			Stderr: self.stdErr,
+		},
+	}, self.result)
 	return nil
 }
 
@@ -225,6 +279,8 @@ type baseReceiveContent struct {
 	emitter func(*StorageEvent)
 	dstSlot storage.IDestination
 	idx     int
+	// temporary is set when the content is received into a temporary file.
+	temporary bool
 }
 
 func newBaseReceiveContent(sendWork *sendWork, srcPath string, emitter func(*StorageEvent)) *baseReceiveContent {
@@ -236,20 +292,60 @@ func newBaseReceiveContent(sendWork *sendWork, srcPath string, emitter func(*Sto
 	}
 }
 
-func (self *baseReceiveContent) Prepair() error {
+// Prepare creates the destination slot, the content downloaded to memory is
+// received into a temporary file.
+func (self *baseReceiveContent) Prepare() error {
+	if self.destPath == "" {
+		tmp, err := ioutil.TempFile("", "golem-download-*")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		self.destPath = tmp.Name()
+		self.temporary = true
+	}
 	self.dstSlot = self.storage.NewDestination(self.destPath)
 	return nil
 }
 
-func (self *baseReceiveContent) Register(commands CommnadContainer) error {
+// downloadBytes waits until the storage delivered the content of the
+// destination slot, at most `limit` bytes.
+func (self *baseReceiveContent) downloadBytes(ctx context.Context, limit int) ([]byte, error) {
+	if self.dstSlot == nil {
+		return nil, fmt.Errorf("empty destination")
+	}
+	if self.temporary {
+		defer os.Remove(self.destPath)
+	}
+	downloaded := make(chan interface{}, 1)
+	failed := make(chan error, 1)
+	self.dstSlot.DownloadBytes(ctx, limit, func(content interface{}) {
+		downloaded <- content
+	}, func(err error) {
+		failed <- err
+	})
+	select {
+	case content := <-downloaded:
+		data, ok := content.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("downloading %v: unexpected content %T", self.srcPath, content)
+		}
+		return data, nil
+	case err := <-failed:
+		return nil, fmt.Errorf("downloading %v: %v", self.srcPath, err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (self *baseReceiveContent) Register(commands *CommandContainer) error {
 	if self.dstSlot == nil {
 		return fmt.Errorf("command creation without prepare")
 	}
-	self.idx = commands.AddCommand("transfer",
-		KwArgs(
-			"_from", fmt.Sprintf("container:%v", self.srcPath),
-			"to", self.dstSlot.UploadUrl(),
-		))
+	self.idx = commands.AddCommand(&script.Transfer{
+		From: fmt.Sprintf("container:%v", self.srcPath),
+		To:   self.dstSlot.UploadUrl(),
+	}, self.result)
 	return nil
 }
 
@@ -314,10 +410,11 @@ func NewRecieveByte(b *baseReceiveContent, onDownload func(interface{})) *reciev
 
 func (self *recieveBytes) Post(ctx context.Context) error {
 	self.emitDownloadStart()
-	if self.destPath == "" || self.dstSlot == nil {
-		return fmt.Errorf("empty destination")
+	data, err := self.downloadBytes(ctx, self.limit)
+	if err != nil {
+		return err
 	}
-	self.dstSlot.DownloadBytes(ctx, self.limit, self.onDownload, func(e error) {})
+	self.onDownload(data)
 	self.emitDownloadEnd()
 	return nil
 }
@@ -338,19 +435,15 @@ func NewRecieveJson(b *baseReceiveContent, onDownload func(interface{})) *reciev
 
 func (self *recieveJson) Post(ctx context.Context) error {
 	self.emitDownloadStart()
-	if self.destPath == "" || self.dstSlot == nil {
-		return fmt.Errorf("empty destination")
+	data, err := self.downloadBytes(ctx, self.limit)
+	if err != nil {
+		return err
 	}
-	self.dstSlot.DownloadBytes(ctx, self.limit, func(b interface{}) {
-		bytes := b.([]byte)
-		var out interface{}
-		err := json.Unmarshal(bytes, out)
-		if err != nil {
-			fmt.Errorf("err: %v", err)
-			return
-		}
-		self.onDownload(out)
-	}, func(e error) {})
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return fmt.Errorf("decoding %v: %v", self.srcPath, err)
+	}
+	self.onDownload(out)
 	self.emitDownloadEnd()
 	return nil
 }
@@ -365,7 +458,7 @@ func (self *Steps) Timeout() time.Duration {
 	return self.timeout
 }
 
-func (self *Steps) Prepair() error {
+func (self *Steps) Prepare() error {
 	for _, step := range self.steps {
 		err := step.Prepare()
 		if err != nil {
@@ -375,16 +468,30 @@ func (self *Steps) Prepair() error {
 	return nil
 }
 
-func (self *Steps) Register(commands CommnadContainer) error {
+func (self *Steps) Register(commands *CommandContainer) error {
 	for _, step := range self.steps {
+		first := len(commands.Commands)
 		err := step.Register(commands)
 		if err != nil {
 			return err
 		}
+		commands.setTimeout(first, step.Timeout())
 	}
 	return nil
 }
 
+// fail resolves the result handles of all steps with `err`, the steps which
+// were never registered included.
+func (self *Steps) fail(err error) {
+	for _, step := range self.steps {
+		if holder, ok := step.(resultHolder); ok {
+			for _, result := range holder.handles() {
+				result.fail(err)
+			}
+		}
+	}
+}
+
 func (self *Steps) Post(ctx context.Context) error {
 	for _, step := range self.steps {
 		err := step.Post(ctx)
@@ -402,6 +509,9 @@ type WorkContext struct {
 	emitter      func(*StorageEvent)
 	pendingSteps []Worker
 	started      bool
+	runner       *batchRunner
+	taskId       string
+	publicKey    ed25519.PublicKey
 }
 
 func NewWorkContext(ctxId string,
@@ -426,131 +536,191 @@ func (self *WorkContext) prepare() {
 	}
 }
 
-func (self *WorkContext) ProviderName() string {
-	return self.nodeInfo.Name
+// reset drops the steps which were not committed, the runtime is deployed
+// again with the next command unless its deployment was committed already.
+func (self *WorkContext) reset() {
+	if len(self.pendingSteps) > 0 {
+		if _, ok := self.pendingSteps[0].(*initStep); ok {
+			self.started = false
+		}
+	}
+	self.pendingSteps = make([]Worker, 0)
 }
 
-func (self *WorkContext) SendJson(jsonPath string, data map[string]interface{}) {
-	self.prepare()
-	self.pendingSteps = append(self.pendingSteps,
-		NewSendJson(self.storage, jsonPath, data))
+// EnableSigning makes every committed batch end with the sign command, whose
+// signature over the script and the outputs of the batch is verified against
+// the public key published in the provider's offer. A batch whose signed
+// script or outputs fail the verification returns a SignatureError.
+func (self *WorkContext) EnableSigning() error {
+	if self.nodeInfo == nil {
+		return fmt.Errorf("provider did not publish a public key")
+	}
+	publicKey, err := parsePublicKey(self.nodeInfo.PublicKey)
+	if err != nil {
+		return err
+	}
+	self.publicKey = publicKey
+	return nil
+}
 
+func (self *WorkContext) ProviderName() string {
+	return self.nodeInfo.Name
 }
 
-func (self *WorkContext) SendBytes(destPath string, data []byte) {
+// SendJson schedules sending a JSON document to `jsonPath` on the provider.
+func (self *WorkContext) SendJson(jsonPath string, data map[string]interface{}) *Result {
 	self.prepare()
-	self.pendingSteps = append(self.pendingSteps,
-		NewSendBytes(self.storage, destPath, data))
-
+	step := NewSendJson(self.storage, jsonPath, data)
+	self.pendingSteps = append(self.pendingSteps, step)
+	return step.result
 }
 
-func (self *WorkContext) SendFile(srcPath, destPath string) {
+// SendBytes schedules sending `data` to `destPath` on the provider.
+func (self *WorkContext) SendBytes(destPath string, data []byte) *Result {
 	self.prepare()
-	self.pendingSteps = append(self.pendingSteps,
-		NewSendFile(self.storage, srcPath, destPath))
+	step := NewSendBytes(self.storage, destPath, data)
+	self.pendingSteps = append(self.pendingSteps, step)
+	return step.result
 }
 
-func (self *WorkContext) Run(cmd string, args []string, env map[string]string) {
-	stdOut := NewCaptureContext("stream")
-	stdErr := NewCaptureContext("stream")
+// SendFile schedules sending the local file `srcPath` to `destPath` on the provider.
+func (self *WorkContext) SendFile(srcPath, destPath string) *Result {
 	self.prepare()
-	self.pendingSteps = append(self.pendingSteps,
-		NewRun(cmd, args, env, stdOut, stdErr))
+	step := NewSendFile(self.storage, srcPath, destPath)
+	self.pendingSteps = append(self.pendingSteps, step)
+	return step.result
+}
+
+// CaptureOptions selects how an output stream of a Run command is captured.
+type CaptureOptions struct {
+	// Mode is one of head, tail, headTail or stream, an empty mode captures
+	// the whole output at the end of the command.
+	Mode script.CaptureMode
+	// Limit is the maximum number of bytes captured, zero means no limit.
+	Limit int
+	// Format is either str or bin, binary output is returned as []byte.
+	Format script.CaptureFormat
+}
+
+func (co *CaptureOptions) context() (*script.CaptureContext, error) {
+	var limit *int
+	if co.Limit != 0 {
+		limit = &co.Limit
+	}
+	var format *script.CaptureFormat
+	if co.Format != "" {
+		format = &co.Format
+	}
+	ctx, err := script.NewCaptureContext(co.Mode, limit, format)
+	if err != nil {
+		return nil, err
+	}
+	return ctx, ctx.Validate()
+}
+
+// RunOptions holds the optional settings of WorkContext.Run.
+type RunOptions struct {
+	// Stdout receives the command's standard output as it is streamed.
+	Stdout io.Writer
+	// Stderr receives the command's standard error as it is streamed.
+	Stderr io.Writer
+	// StdoutCapture and StderrCapture select how the output streams are
+	// captured, both default to streaming.
+	StdoutCapture *CaptureOptions
+	StderrCapture *CaptureOptions
+	// Timeout limits the execution time of the command, zero means the
+	// command is only bound by the timeout of its batch.
+	Timeout time.Duration
+}
+
+// Run schedules running `cmd` on the provider, the returned handle resolves to
+// the command's exit status and output once the batch has been executed.
+// `opts` may be nil, invalid options resolve the handle with an error without
+// scheduling the command.
+func (self *WorkContext) Run(cmd string, args []string, env map[string]string, opts *RunOptions) *Result {
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+	stdoutCapture, stderrCapture := opts.StdoutCapture, opts.StderrCapture
+	if stdoutCapture == nil {
+		stdoutCapture = &CaptureOptions{Mode: script.Stream}
+	}
+	if stderrCapture == nil {
+		stderrCapture = &CaptureOptions{Mode: script.Stream}
+	}
+	stdOut, err := stdoutCapture.context()
+	if err != nil {
+		result := newResult()
+		result.fail(fmt.Errorf("stdout: %v", err))
+		return result
+	}
+	stdErr, err := stderrCapture.context()
+	if err != nil {
+		result := newResult()
+		result.fail(fmt.Errorf("stderr: %v", err))
+		return result
+	}
+	self.prepare()
+	step := NewRun(cmd, args, env, stdOut, stdErr)
+	if opts.Timeout > 0 {
+		step.timeout = &opts.Timeout
+	}
+	step.result.stdoutWriter = opts.Stdout
+	step.result.stderrWriter = opts.Stderr
+	step.result.stdoutFormat = stdoutCapture.Format
+	step.result.stderrFormat = stderrCapture.Format
+	self.pendingSteps = append(self.pendingSteps, step)
+	return step.result
 }
 
-func (self *WorkContext) DownloadFile(srcPath, destPath string) {
+// DownloadFile schedules downloading `srcPath` from the provider to the local `destPath`.
+func (self *WorkContext) DownloadFile(srcPath, destPath string) *Result {
 	self.prepare()
 	base := newBaseReceiveContent(NewSendWork(self.storage, destPath), srcPath, self.emitter)
 	self.pendingSteps = append(self.pendingSteps,
 		NewRecieveFile(base, destPath))
+	return base.result
 }
 
-func (self *WorkContext) DownloadBytes(srcPath string, onDownload func([]interface{})) {
+// DownloadBytes schedules downloading `srcPath` from the provider and passing its content to `onDownload`.
+func (self *WorkContext) DownloadBytes(srcPath string, onDownload func(interface{})) *Result {
 	self.prepare()
 	base := newBaseReceiveContent(NewSendWork(self.storage, ""), srcPath, self.emitter)
 	self.pendingSteps = append(self.pendingSteps,
 		NewRecieveByte(base, onDownload))
+	return base.result
 }
 
-func (self *WorkContext) DownloadJson(srcPath string, onDownload func([]interface{})) {
+// DownloadJson schedules downloading `srcPath` from the provider and passing the decoded JSON to `onDownload`.
+func (self *WorkContext) DownloadJson(srcPath string, onDownload func(interface{})) *Result {
 	self.prepare()
 	base := newBaseReceiveContent(NewSendWork(self.storage, ""), srcPath, self.emitter)
 	self.pendingSteps = append(self.pendingSteps,
 		NewRecieveJson(base, onDownload))
+	return base.result
 }
 
 func (self *WorkContext) commit(timeout time.Duration) *Steps {
 	steps := make([]Worker, len(self.pendingSteps))
 	copy(steps, self.pendingSteps)
 	self.pendingSteps = make([]Worker, 0)
+	if self.publicKey != nil && len(steps) > 0 {
+		steps = append(steps, newSignStep(self.publicKey))
+	}
 	return &Steps{steps: steps,
 		timeout: timeout}
 }
 
-type CaptureMode string
-
-const (
-	Head     CaptureMode = "head"
-	Tail     CaptureMode = "tail"
-	HeadTail CaptureMode = "headTail"
-	Stream   CaptureMode = "stream"
-)
-
-type CaptureFormat string
-
-const (
-	Bin CaptureFormat = "bin"
-	Str CaptureFormat = "str"
-)
-
-type CaptureContext struct {
-	mode  CaptureMode
-	limit *int
-	fmt   *CaptureFormat
-}
-
-func NewCaptureContext(mode CaptureMode,
-	limit *int,
-	_fmt *CaptureFormat) (*CaptureContext, error) {
-	switch mode {
-	case "", "all":
-		return newCaptureContext(Head, nil, _fmt), nil
-	case Head, Tail, HeadTail, Stream:
-		return newCaptureContext(mode, limit, _fmt), nil
-	default:
-		return nil, fmt.Errorf("invalid output capture mode: %v", mode)
+// Commit sends the scheduled commands to the provider as one batch and waits
+// until it has been executed. `timeout` is the deadline of the whole batch,
+// zero selects the default of five minutes. A batch which does not finish in
+// time is interrupted and a rest.BatchTimeoutError is returned.
+func (self *WorkContext) Commit(ctx context.Context, timeout time.Duration) error {
+	steps := self.commit(timeout)
+	if self.runner == nil {
+		err := errors.New("work context is not bound to an activity")
+		steps.fail(err)
+		return err
 	}
-
-}
-
-func newCaptureContext(mode CaptureMode,
-	limit *int,
-	fmt *CaptureFormat) *CaptureContext {
-	return &CaptureContext{
-		mode:  mode,
-		limit: limit,
-		fmt:   fmt,
-	}
-}
-
-func (self *CaptureContext) ToMap() map[string]interface{} {
-	inner := make(map[string]interface{})
-	if self.limit != nil {
-		inner[string(self.mode)] = self.limit
-	}
-	if self.fmt != nil {
-		inner["format"] = string(*self.fmt)
-	}
-	out := make(map[string]interface{})
-	if self.IsStreaming() {
-		out["stream"] = inner
-	} else {
-		out["atEnd"] = inner
-	}
-	return out
-
-}
-
-func (self *CaptureContext) IsStreaming() bool {
-	return self.mode == Stream
+	return self.runner.run(ctx, self.taskId, steps)
 }
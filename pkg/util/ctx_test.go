@@ -0,0 +1,239 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/script"
+	"github.com/hhio618/go-golem/pkg/storage"
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+// chunkWriter records the chunks written to it.
+type chunkWriter struct {
+	lock   sync.Mutex
+	chunks []string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+func (w *chunkWriter) Chunks() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string{}, w.chunks...)
+}
+
+// streamOutput streams the events of every command of the batch, the run
+// commands write `output` as stdout chunks and an error line to stderr.
+func streamOutput(output ...string) func(batch *fakeBatch) []string {
+	return func(batch *fakeBatch) []string {
+		events := make([]string, 0)
+		add := func(idx int, kind string, data interface{}) {
+			events = append(events, runtimeEvent(batch, len(events), idx, kind, data))
+		}
+		for idx, name := range batch.Commands {
+			add(idx, "started", map[string]interface{}{"command": map[string]interface{}{name: map[string]interface{}{}}})
+			if name == "run" {
+				for i, chunk := range output {
+					add(idx, "stdout", chunk)
+					if i == 0 {
+						add(idx, "stderr", map[string]interface{}{"str": "warning"})
+					}
+				}
+			}
+			add(idx, "finished", map[string]interface{}{"return_code": 0})
+		}
+		return events
+	}
+}
+
+func newTestWorkContext(t *testing.T, api *fakeActivityApi, emitter func(interface{})) *WorkContext {
+	activity, err := api.service().NewActivity("agr")
+	testutil.Ok(t, err)
+	wctx := NewWorkContext(activity.Id(), &props.NodeInfo{Name: "provider"}, nil, nil)
+	wctx.runner = newBatchRunner(activity, "agr", emitter)
+	return wctx
+}
+
+func TestRunStreamsOutput(t *testing.T) {
+	api := newFakeActivityApi(t)
+	api.stream = streamOutput("hel", "lo", "\n")
+	stdout, stderr := &chunkWriter{}, &chunkWriter{}
+	executed := false
+	// The events are emitted on the goroutine committing the batch.
+	wctx := newTestWorkContext(t, api, func(evt interface{}) {
+		switch e := evt.(type) {
+		case *event.CommandStdOut:
+			chunks := stdout.Chunks()
+			testutil.Assert(t, !executed, "output streamed after the command was executed")
+			testutil.Assert(t, len(chunks) > 0 && chunks[len(chunks)-1] == e.Output,
+				"chunk %q not written before its event, got %q", e.Output, chunks)
+		case *event.CommandExecuted:
+			if e.CmdIdx == 2 {
+				executed = true
+				testutil.Equals(t, []string{"hel", "lo", "\n"}, stdout.Chunks())
+				testutil.Equals(t, []string{"warning"}, stderr.Chunks())
+			}
+		}
+	})
+	result := wctx.Run("/bin/echo", []string{"hello"}, nil, &RunOptions{Stdout: stdout, Stderr: stderr})
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	testutil.Ok(t, wctx.Commit(ctx, time.Minute))
+	testutil.Assert(t, executed, "run command not executed")
+	testutil.Equals(t, [][]string{{"deploy", "start", "run"}}, api.Scripts())
+
+	cmdResult, err := result.Get(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hello\n", cmdResult.Stdout)
+	testutil.Equals(t, "warning", cmdResult.Stderr)
+	testutil.Equals(t, "hello\n", strings.Join(stdout.Chunks(), ""))
+}
+
+func TestCaptureOptions(t *testing.T) {
+	testCases := []struct {
+		Options CaptureOptions
+		Json    string
+		Err     string
+	}{
+		{CaptureOptions{}, `{"atEnd":{}}`, ""},
+		{CaptureOptions{Mode: script.Head, Limit: 1024}, `{"atEnd":{"part":{"head":1024}}}`, ""},
+		{CaptureOptions{Mode: script.Tail, Limit: 64, Format: script.Bin}, `{"atEnd":{"format":"bin","part":{"tail":64}}}`, ""},
+		{CaptureOptions{Mode: script.HeadTail, Limit: 128, Format: script.Str}, `{"atEnd":{"format":"str","part":{"headTail":128}}}`, ""},
+		{CaptureOptions{Mode: script.Stream}, `{"stream":{}}`, ""},
+		{CaptureOptions{Mode: script.Stream, Limit: 16, Format: script.Bin}, `{"stream":{"format":"bin","limit":16}}`, ""},
+		{CaptureOptions{Mode: "middle"}, "", "invalid output capture mode: middle"},
+		{CaptureOptions{Mode: script.Tail, Limit: -1}, "", "invalid output capture limit: -1"},
+		{CaptureOptions{Format: "hex"}, "", "invalid output capture format: hex"},
+	}
+	for _, tc := range testCases {
+		ctx, err := tc.Options.context()
+		if tc.Err != "" {
+			testutil.NotOk(t, err)
+			testutil.Equals(t, tc.Err, err.Error())
+			continue
+		}
+		testutil.Ok(t, err)
+		serialized, err := json.Marshal(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, tc.Json, string(serialized))
+	}
+
+	// Invalid options resolve the handle without scheduling the command.
+	wctx := NewWorkContext("act", &props.NodeInfo{}, nil, nil)
+	result := wctx.Run("/bin/ls", nil, nil, &RunOptions{StderrCapture: &CaptureOptions{Mode: script.Head, Limit: -1}})
+	_, err := result.Get(context.Background())
+	testutil.Equals(t, "stderr: invalid output capture limit: -1", err.Error())
+	testutil.Equals(t, 0, len(wctx.pendingSteps))
+}
+
+// fakeStorage serves the items of `content` from its destinations, in the
+// order in which they are created, and records their paths.
+type fakeStorage struct {
+	content [][]byte
+	paths   []string
+}
+
+func (s *fakeStorage) UploadStream(length int, stream []byte) (storage.Source, error) {
+	return nil, errors.New("uploads are not supported")
+}
+
+func (s *fakeStorage) UploadBytes(data []byte) (storage.Source, error) {
+	return nil, errors.New("uploads are not supported")
+}
+
+func (s *fakeStorage) UploadFile(filePath string) (storage.Source, error) {
+	return nil, errors.New("uploads are not supported")
+}
+
+func (s *fakeStorage) NewDestination(destFile string) storage.IDestination {
+	content := s.content[len(s.paths)]
+	s.paths = append(s.paths, destFile)
+	return &fakeDestination{path: destFile, content: content}
+}
+
+type fakeDestination struct {
+	path    string
+	content []byte
+}
+
+func (d *fakeDestination) UploadUrl() string {
+	return "gftp://" + d.path
+}
+
+func (d *fakeDestination) DownloadStream() (*storage.Content, error) {
+	return nil, errors.New("streams are not supported")
+}
+
+func (d *fakeDestination) DownloadFile(ctx context.Context, destPath string) {}
+
+// DownloadBytes delivers the content if the file received into exists.
+func (d *fakeDestination) DownloadBytes(ctx context.Context, limit int, resultFunc func(interface{}), errFunc func(error)) {
+	if _, err := os.Stat(d.path); err != nil {
+		errFunc(err)
+		return
+	}
+	resultFunc(d.content)
+}
+
+func TestDownloadContent(t *testing.T) {
+	api := newFakeActivityApi(t)
+	store := &fakeStorage{content: [][]byte{[]byte("hello"), []byte(`{"answer": 42}`)}}
+	wctx := newTestWorkContext(t, api, nil)
+	wctx.storage = store
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	var downloaded, decoded interface{}
+	bytesResult := wctx.DownloadBytes("/golem/output/out.txt", func(content interface{}) {
+		downloaded = content
+	})
+	jsonResult := wctx.DownloadJson("/golem/output/out.json", func(content interface{}) {
+		decoded = content
+	})
+
+	testutil.Ok(t, wctx.Commit(ctx, time.Minute))
+	_, err := bytesResult.Get(ctx)
+	testutil.Ok(t, err)
+	_, err = jsonResult.Get(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []byte("hello"), downloaded)
+	testutil.Equals(t, map[string]interface{}{"answer": 42.0}, decoded)
+	testutil.Equals(t, [][]string{{"deploy", "start", "transfer", "transfer"}}, api.Scripts())
+	// The content was received into temporary files, which are removed.
+	testutil.Equals(t, 2, len(store.paths))
+	for _, path := range store.paths {
+		_, err := os.Stat(path)
+		testutil.Assert(t, os.IsNotExist(err), "temporary file %v left behind", path)
+	}
+}
+
+func TestPrepareFailure(t *testing.T) {
+	api := newFakeActivityApi(t)
+	wctx := newTestWorkContext(t, api, nil)
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	run := wctx.Run("/bin/echo", []string{"hello"}, nil, nil)
+	send := wctx.SendBytes("/golem/input/data", nil)
+
+	err := wctx.Commit(ctx, time.Minute)
+	testutil.NotOk(t, err)
+	// All handles resolve with the error, nothing is sent to the provider.
+	for _, result := range []*Result{run, send} {
+		_, resultErr := result.Get(ctx)
+		testutil.Equals(t, err, resultErr)
+	}
+	testutil.Equals(t, 0, len(api.Scripts()))
+}
@@ -0,0 +1,633 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/storage"
+)
+
+const batchTimeoutDefault = 5 * time.Minute
+
+var errBatchIncomplete = errors.New("batch ended before all commands were executed")
+
+// batchRunner executes committed steps as exe batches on an activity.
+type batchRunner struct {
+	activity    *rest.Activity
+	agreementId string
+	emitter     func(interface{})
+	// interrupted is set once a batch was stopped, which terminates the
+	// runtime, destroyed if the activity had to be destroyed to stop it.
+	interrupted bool
+	destroyed   bool
+}
+
+func newBatchRunner(activity *rest.Activity, agreementId string, emitter func(interface{})) *batchRunner {
+	return &batchRunner{
+		activity:    activity,
+		agreementId: agreementId,
+		emitter:     emitter,
+	}
+}
+
+func (self *batchRunner) emit(evt interface{}) {
+	if self.emitter != nil {
+		self.emitter(evt)
+	}
+}
+
+// run prepares the steps, sends them to the activity as one batch and routes
+// the command events back to the steps' result handles.
+func (self *batchRunner) run(ctx context.Context, taskId string, steps *Steps) error {
+	commands := &CommandContainer{}
+	err := steps.Prepare()
+	if err != nil {
+		commands.fail(err)
+		steps.fail(err)
+		return err
+	}
+	err = steps.Register(commands)
+	if err != nil {
+		commands.fail(err)
+		steps.fail(err)
+		return err
+	}
+	exeScript, err := commands.Script()
+	if err != nil {
+		commands.fail(err)
+		return err
+	}
+	scriptEvent := event.ScriptEvent{
+		AgreementEvent: event.AgreementEvent{AgrId: self.agreementId},
+		TaskId:         taskId,
+	}
+	self.emit(&event.ScriptSent{ScriptEvent: scriptEvent, Cmds: exeScript})
+	timeout := steps.Timeout()
+	if timeout <= 0 {
+		timeout = batchTimeoutDefault
+	}
+	commands.sent = time.Now()
+	deadline := commands.sent.Add(timeout)
+	poller, err := self.activity.Send(exeScript, commands.isStreaming(), deadline)
+	if err != nil {
+		commands.fail(err)
+		return err
+	}
+	eventCh, errCh := poller.Poll(ctx)
+	for !commands.finished() {
+		timer := time.NewTimer(time.Until(commands.deadline(deadline)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return self.cancelled(scriptEvent, commands, poller, ctx.Err())
+		case <-timer.C:
+			return self.cancelled(scriptEvent, commands, poller, &rest.BatchTimeoutError{})
+		case err, ok := <-errCh:
+			timer.Stop()
+			if !ok {
+				// The poller is done and all its events were delivered.
+				commands.fail(errBatchIncomplete)
+				return errBatchIncomplete
+			}
+			var cancelled *rest.BatchCancelledError
+			var timedOut *rest.BatchTimeoutError
+			if errors.As(err, &cancelled) || errors.As(err, &timedOut) {
+				return self.cancelled(scriptEvent, commands, poller, err)
+			}
+			commands.fail(err)
+			return err
+		case evt, ok := <-eventCh:
+			timer.Stop()
+			if !ok {
+				eventCh = nil
+				continue
+			}
+			commands.dispatch(evt)
+			self.emitCommandEvent(scriptEvent, commands, evt)
+			if evt.ComputationFinished(len(commands.Commands) - 1) {
+				// The exe-unit stops the batch on the first failing command.
+				commands.fail(errCommandSkipped)
+			}
+		}
+	}
+	if err := commands.err(); err != nil {
+		return err
+	}
+	self.emit(&event.GettingResults{ScriptEvent: scriptEvent})
+	err = steps.Post(ctx)
+	if err != nil {
+		return err
+	}
+	self.emit(&event.ScriptFinished{ScriptEvent: scriptEvent})
+	return nil
+}
+
+// cancelled makes sure the batch is interrupted on the activity and reports
+// the script as cancelled. An activity which does not respond to the
+// interruption is destroyed by the poller.
+func (self *batchRunner) cancelled(scriptEvent event.ScriptEvent, commands *CommandContainer, poller rest.Poller, err error) error {
+	if cerr := poller.Cancel(); cerr != nil {
+		level.Error(logger).Log("msg", "interrupting batch", "agreementId", self.agreementId, "err", cerr)
+	}
+	self.interrupted = true
+	self.destroyed = poller.Destroyed()
+	commands.fail(err)
+	self.emit(&event.ScriptFinished{ScriptEvent: scriptEvent, Cancelled: true})
+	return err
+}
+
+func (self *batchRunner) emitCommandEvent(scriptEvent event.ScriptEvent, commands *CommandContainer, evt *event.CommandEventContext) {
+	idx := evt.Idx()
+	commandEvent := event.CommandEvent{ScriptEvent: scriptEvent, CmdIdx: idx}
+	switch evt.EvtCls.(type) {
+	case event.CommandStarted:
+		self.emit(&event.CommandStarted{CommandEvent: commandEvent, Command: evt.String("command")})
+	case event.CommandStdOut:
+		self.emit(&event.CommandStdOut{CommandEvent: commandEvent, Output: evt.String("output")})
+	case event.CommandStdErr:
+		self.emit(&event.CommandStdErr{CommandEvent: commandEvent, Output: evt.String("output")})
+	case event.CommandExecuted:
+		var command interface{}
+		if idx >= 0 && idx < len(commands.Commands) {
+			command = commands.Commands[idx]
+		}
+		self.emit(&event.CommandExecuted{
+			CommandEvent: commandEvent,
+			Command:      command,
+			Failed:       !evt.Bool("success"),
+			Message:      evt.String("message"),
+		})
+	}
+}
+
+// WorkerFunc processes a single work item on a provider. It schedules commands
+// on `wctx`, executes them with WorkContext.Commit and either accepts or
+// rejects the item, an item left undecided is accepted when the function
+// returns without an error.
+type WorkerFunc func(ctx context.Context, wctx *WorkContext, item *WorkItem) error
+
+// AgreementInfo describes an agreement on which an Executor runs items.
+type AgreementInfo struct {
+	Id         string
+	ProviderId string
+	NodeInfo   *props.NodeInfo
+	// Pricing is the linear pricing model of the offer, nil if the offer is
+	// priced otherwise.
+	Pricing *props.ComLinear
+	// MultiActivity is set when both parties allow more than one activity per agreement.
+	MultiActivity bool
+}
+
+type workItemStatus int
+
+const (
+	workItemPending workItemStatus = iota
+	workItemRetrying
+	workItemAccepted
+	workItemRejected
+)
+
+// TaskRejectedError is returned for a work item which was rejected for good.
+type TaskRejectedError struct {
+	Reason string
+}
+
+func (t *TaskRejectedError) Error() string {
+	return fmt.Sprintf("task rejected: %v", t.Reason)
+}
+
+// ActivityUnavailableError is returned for an activity which can no longer run tasks.
+type ActivityUnavailableError struct {
+	ActivityId string
+	State      string
+}
+
+func (a *ActivityUnavailableError) Error() string {
+	return fmt.Sprintf("activity %v is %v", a.ActivityId, a.State)
+}
+
+// WorkItem is a piece of user work submitted to an Executor.
+type WorkItem struct {
+	Id       string
+	Data     interface{}
+	executor *Executor
+	// group is set for the replicas of an item executed redundantly.
+	group    *redundantGroup
+	lock     *sync.Mutex
+	done     chan struct{}
+	status   workItemStatus
+	attempts int
+	// The agreement and provider of the current attempt.
+	agreementId string
+	providerId  string
+	result      interface{}
+	err         error
+}
+
+func newWorkItem(executor *Executor, id string, data interface{}) *WorkItem {
+	return &WorkItem{
+		Id:       id,
+		Data:     data,
+		executor: executor,
+		lock:     &sync.Mutex{},
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept marks the item as successfully processed with `result`.
+func (self *WorkItem) Accept(result interface{}) {
+	self.lock.Lock()
+	if self.status != workItemPending {
+		self.lock.Unlock()
+		return
+	}
+	self.status = workItemAccepted
+	self.result = result
+	close(self.done)
+	self.lock.Unlock()
+	if self.group != nil {
+		// The replicas are accepted or rejected once all of them are done.
+		self.group.finish()
+		return
+	}
+	self.emitAccepted()
+}
+
+// Reject marks the item as failed, a rejected item is scheduled again if
+// `retry` is set and it has not run out of retries.
+func (self *WorkItem) Reject(reason string, retry bool) {
+	self.lock.Lock()
+	if self.status != workItemPending {
+		self.lock.Unlock()
+		return
+	}
+	retry = retry && self.attempts <= self.executor.maxRetries
+	if retry {
+		self.status = workItemRetrying
+	} else {
+		self.reject(reason)
+	}
+	self.lock.Unlock()
+	self.emitRejected(reason)
+	if retry {
+		if self.executor.requeue(self) {
+			return
+		}
+		self.lock.Lock()
+		if self.status != workItemRetrying {
+			// The item was resolved in the meantime.
+			self.lock.Unlock()
+			return
+		}
+		self.reject(reason)
+		self.lock.Unlock()
+	}
+	if self.group != nil {
+		self.group.finish()
+	}
+}
+
+// reject marks the item as rejected for good, it has to be called with the
+// lock held.
+func (self *WorkItem) reject(reason string) {
+	self.status = workItemRejected
+	self.err = &TaskRejectedError{Reason: reason}
+	close(self.done)
+}
+
+// Done returns a channel which is closed once the item was accepted or rejected for good.
+func (self *WorkItem) Done() <-chan struct{} {
+	return self.done
+}
+
+// Get blocks until the item is done or `ctx` is done.
+func (self *WorkItem) Get(ctx context.Context) (interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-self.done:
+	}
+	return self.result, self.err
+}
+
+func (self *WorkItem) pending() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.status == workItemPending
+}
+
+// resolve finishes an item which is not processed by a worker itself.
+func (self *WorkItem) resolve(result interface{}, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.status == workItemAccepted || self.status == workItemRejected {
+		return
+	}
+	self.status = workItemAccepted
+	if err != nil {
+		self.status = workItemRejected
+	}
+	self.result = result
+	self.err = err
+	close(self.done)
+}
+
+// start records the agreement on which the item is about to be processed.
+func (self *WorkItem) start(info *AgreementInfo) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.status = workItemPending
+	self.attempts++
+	self.agreementId = info.Id
+	self.providerId = info.ProviderId
+}
+
+func (self *WorkItem) taskEvent() event.TaskEvent {
+	return event.TaskEvent{TaskId: self.Id, TaskData: self.Data}
+}
+
+func (self *WorkItem) emitAccepted() {
+	self.executor.emit(&event.TaskAccepted{
+		TaskEvent:      self.taskEvent(),
+		AgreementEvent: event.AgreementEvent{AgrId: self.agreementId},
+		ProviderId:     self.providerId,
+		Result:         self.result,
+	})
+}
+
+func (self *WorkItem) emitRejected(reason string) {
+	self.executor.emit(&event.TaskRejected{
+		TaskEvent:      self.taskEvent(),
+		AgreementEvent: event.AgreementEvent{AgrId: self.agreementId},
+		ProviderId:     self.providerId,
+		Reason:         reason,
+	})
+}
+
+// Executor runs submitted work items on the activities handed to it.
+type Executor struct {
+	emitter    func(interface{})
+	storage    storage.StorageProvider
+	worker     WorkerFunc
+	maxRetries int
+	signing    bool
+	monitor    *ActivityMonitor
+	lock       *sync.Mutex
+	queue      []*WorkItem
+	lastId     int
+	// redundancyTimeout bounds the time in which the replicas of an item
+	// have to be taken by distinct providers.
+	redundancyTimeout time.Duration
+}
+
+func NewExecutor(worker WorkerFunc,
+	storage storage.StorageProvider,
+	maxRetries int,
+	emitter func(interface{})) *Executor {
+	return &Executor{
+		emitter:           emitter,
+		storage:           storage,
+		worker:            worker,
+		maxRetries:        maxRetries,
+		lock:              &sync.Mutex{},
+		redundancyTimeout: redundancyTimeoutDefault,
+	}
+}
+
+func (self *Executor) emit(evt interface{}) {
+	if self.emitter != nil {
+		self.emitter(evt)
+	}
+}
+
+// SetMonitor adds the activities created by RunAgreement to `monitor` and
+// makes the executor skip activities which it reports as terminated or
+// unresponsive.
+func (self *Executor) SetMonitor(monitor *ActivityMonitor) {
+	self.monitor = monitor
+}
+
+// SetRedundancyTimeout sets the time in which the replicas of an item
+// submitted with SubmitRedundant have to be taken by distinct providers.
+func (self *Executor) SetRedundancyTimeout(timeout time.Duration) {
+	self.redundancyTimeout = timeout
+}
+
+// SetSigning makes the executor verify every batch with the sign command, see
+// WorkContext.EnableSigning. Items whose batch fails the verification are
+// rejected and retried.
+func (self *Executor) SetSigning(signing bool) {
+	self.signing = signing
+}
+
+func (self *Executor) nextId() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastId++
+	return strconv.Itoa(self.lastId)
+}
+
+// Submit queues `data` for processing.
+func (self *Executor) Submit(data interface{}) *WorkItem {
+	item := newWorkItem(self, self.nextId(), data)
+	self.push(item)
+	return item
+}
+
+// Pending returns the number of queued items.
+func (self *Executor) Pending() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.queue)
+}
+
+func (self *Executor) push(item *WorkItem) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.queue = append(self.queue, item)
+}
+
+// requeue queues a rejected item again, unless it is a replica whose group
+// expired.
+func (self *Executor) requeue(item *WorkItem) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if item.group != nil && item.group.expired {
+		return false
+	}
+	self.queue = append(self.queue, item)
+	return true
+}
+
+// pop takes the first queued item which may run on the provider with
+// `providerId`, replicas of an item are only run on distinct providers.
+func (self *Executor) pop(providerId string) *WorkItem {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, item := range self.queue {
+		if item.group != nil && !item.group.claim(item, providerId) {
+			continue
+		}
+		self.queue = append(self.queue[:i], self.queue[i+1:]...)
+		return item
+	}
+	return nil
+}
+
+// Process runs the next queued item on `activity`, deploying and starting
+// the runtime first. It returns false if there was nothing to do, and the
+// error of the worker otherwise. An activity known to be dead yields an
+// ActivityUnavailableError without taking an item. Items whose batch timed
+// out are rejected and retried, the activity may have been destroyed in that
+// case if it did not respond to the interruption.
+func (self *Executor) Process(ctx context.Context, activity *rest.Activity, info *AgreementInfo) (bool, error) {
+	wctx, err := self.newWorkContext(activity, info)
+	if err != nil {
+		return false, err
+	}
+	return self.process(ctx, wctx, info)
+}
+
+func (self *Executor) newWorkContext(activity *rest.Activity, info *AgreementInfo) (*WorkContext, error) {
+	wctx := NewWorkContext(activity.Id(), info.NodeInfo, self.storage, nil)
+	wctx.runner = newBatchRunner(activity, info.Id, self.emitter)
+	if self.signing {
+		if err := wctx.EnableSigning(); err != nil {
+			return nil, err
+		}
+	}
+	return wctx, nil
+}
+
+// RunAgreement processes queued items until there are none left for the
+// provider, keeping one activity of the agreement alive between items so
+// that the runtime is only deployed and started once. A failed activity is
+// replaced with a new one if the agreement allows multiple activities,
+// otherwise the error of the worker is returned, as is a SignatureError. The
+// last activity is destroyed before returning.
+func (self *Executor) RunAgreement(ctx context.Context, service *rest.ActivityService, info *AgreementInfo) error {
+	var wctx *WorkContext
+	if self.signing {
+		if info.NodeInfo == nil {
+			return fmt.Errorf("provider did not publish a public key")
+		}
+		if _, err := parsePublicKey(info.NodeInfo.PublicKey); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if wctx != nil {
+			self.destroy(wctx.runner)
+		}
+	}()
+	for self.Pending() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if wctx == nil {
+			activity, err := service.NewActivity(info.Id)
+			if err != nil {
+				self.emit(&event.ActivityCreateFailed{
+					AgreementEvent: event.AgreementEvent{AgrId: info.Id},
+					HasExcInfo:     event.HasExcInfo{ExcInfo: &event.ExcInfo{Err: err}},
+				})
+				return err
+			}
+			self.emit(&event.ActivityCreated{
+				AgreementEvent: event.AgreementEvent{AgrId: info.Id},
+				ActId:          activity.Id(),
+			})
+			if self.monitor != nil {
+				self.monitor.Add(activity, info.Id, info.Pricing)
+			}
+			wctx, err = self.newWorkContext(activity, info)
+			if err != nil {
+				self.destroy(newBatchRunner(activity, info.Id, nil))
+				return err
+			}
+		}
+		// Steps left behind by the previous item are dropped.
+		wctx.reset()
+		ok, err := self.process(ctx, wctx, info)
+		if !ok && err == nil {
+			return nil
+		}
+		var invalid *SignatureError
+		if errors.As(err, &invalid) {
+			return err
+		}
+		if err == nil || self.usable(wctx.runner) {
+			continue
+		}
+		self.destroy(wctx.runner)
+		wctx = nil
+		if !info.MultiActivity {
+			return err
+		}
+	}
+	return nil
+}
+
+// usable reports whether more items can be run on the activity of `runner`
+// after an item failed, i.e. whether its runtime is still up.
+func (self *Executor) usable(runner *batchRunner) bool {
+	if runner.interrupted {
+		return false
+	}
+	if self.monitor != nil && !self.monitor.Alive(runner.activity.Id()) {
+		return false
+	}
+	state, err := runner.activity.CurrentState()
+	return err == nil && state == rest.ActivityStateReady
+}
+
+func (self *Executor) destroy(runner *batchRunner) {
+	if self.monitor != nil {
+		self.monitor.Remove(runner.activity.Id())
+	}
+	if !runner.destroyed {
+		runner.activity.DestroyActivity(nil, nil, nil)
+	}
+	self.emit(&event.ActivityDestroyed{
+		AgreementEvent: event.AgreementEvent{AgrId: runner.agreementId},
+		ActId:          runner.activity.Id(),
+	})
+}
+
+func (self *Executor) process(ctx context.Context, wctx *WorkContext, info *AgreementInfo) (bool, error) {
+	activityId := wctx.runner.activity.Id()
+	if self.monitor != nil && !self.monitor.Alive(activityId) {
+		return false, &ActivityUnavailableError{ActivityId: activityId, State: self.monitor.State(activityId)}
+	}
+	item := self.pop(info.ProviderId)
+	if item == nil {
+		return false, nil
+	}
+	item.start(info)
+	wctx.taskId = item.Id
+	self.emit(&event.TaskStarted{
+		TaskEvent:      item.taskEvent(),
+		AgreementEvent: event.AgreementEvent{AgrId: info.Id},
+	})
+	err := self.worker(ctx, wctx, item)
+	if err == nil {
+		if item.pending() {
+			item.Accept(nil)
+		}
+		return true, nil
+	}
+	if item.pending() {
+		var timedOut *rest.BatchTimeoutError
+		var invalid *SignatureError
+		item.Reject(err.Error(), errors.As(err, &timedOut) || errors.As(err, &invalid))
+	}
+	return true, err
+}
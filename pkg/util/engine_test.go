@@ -0,0 +1,338 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/testutil"
+	activity "github.com/hhio618/ya-go-client/ya-activity"
+)
+
+// eventRecorder collects the events emitted from any goroutine.
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []interface{}
+}
+
+func (r *eventRecorder) emit(evt interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, evt)
+}
+
+// Events returns the recorded events.
+func (r *eventRecorder) Events() []interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]interface{}{}, r.events...)
+}
+
+// Names returns the type names of the recorded events matching `filter`.
+func (r *eventRecorder) Names(filter ...string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := make([]string, 0)
+	for _, evt := range r.events {
+		name := fmt.Sprintf("%T", evt)
+		for _, f := range filter {
+			if name == f {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// runCommand returns a worker which runs a single command in a batch with
+// the given timeout.
+func runCommand(timeout time.Duration, opts *RunOptions) WorkerFunc {
+	return func(ctx context.Context, wctx *WorkContext, item *WorkItem) error {
+		wctx.Run("/golem/entrypoints/task", []string{fmt.Sprint(item.Data)}, nil, opts)
+		return wctx.Commit(ctx, timeout)
+	}
+}
+
+// runningResults never finishes the run commands.
+func runningResults(batch *fakeBatch) []activity.ExeScriptCommandResult {
+	results := okResults(batch)
+	for i, name := range batch.Commands {
+		if name == "run" {
+			return results[:i]
+		}
+	}
+	return results
+}
+
+func testAgreement(id string, multiActivity bool) *AgreementInfo {
+	return &AgreementInfo{
+		Id:            id,
+		ProviderId:    "provider-" + id,
+		NodeInfo:      &props.NodeInfo{Name: "node-" + id},
+		MultiActivity: multiActivity,
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cncl)
+	return ctx
+}
+
+func TestBatchDeadline(t *testing.T) {
+	api := newFakeActivityApi(t)
+	api.results = runningResults
+	recorder := &eventRecorder{}
+	wctx := newTestWorkContext(t, api, recorder.emit)
+	result := wctx.Run("/bin/sleep", []string{"60"}, nil, nil)
+	started := time.Now()
+	err := wctx.Commit(testContext(t), 50*time.Millisecond)
+	var timedOut *rest.BatchTimeoutError
+	testutil.Assert(t, errors.As(err, &timedOut), "expected a batch timeout, got %v", err)
+	testutil.Assert(t, time.Since(started) < 5*time.Second, "batch deadline not enforced")
+	_, err = result.Get(context.Background())
+	testutil.Assert(t, errors.As(err, &timedOut), "expected the result to time out, got %v", err)
+	// The runtime is terminated to stop the batch.
+	testutil.Equals(t, [][]string{{"deploy", "start", "run"}, {"terminate"}}, api.Scripts())
+	testutil.Assert(t, wctx.runner.interrupted, "runner not interrupted")
+	testutil.Assert(t, !wctx.runner.destroyed, "activity destroyed")
+	testutil.Equals(t, []string{"*event.ScriptSent", "*event.ScriptFinished"},
+		recorder.Names("*event.ScriptSent", "*event.ScriptFinished"))
+}
+
+func TestBatchCancelled(t *testing.T) {
+	api := newFakeActivityApi(t)
+	api.results = runningResults
+	recorder := &eventRecorder{}
+	wctx := newTestWorkContext(t, api, recorder.emit)
+	result := wctx.Run("/bin/sleep", []string{"60"}, nil, nil)
+	ctx, cncl := context.WithCancel(testContext(t))
+	go func() {
+		// The batch is cancelled while it is polled.
+		for len(api.Scripts()) == 0 && ctx.Err() == nil {
+			time.Sleep(time.Millisecond)
+		}
+		cncl()
+	}()
+	err := wctx.Commit(ctx, time.Minute)
+	testutil.Equals(t, context.Canceled, err)
+	_, err = result.Get(context.Background())
+	testutil.Equals(t, context.Canceled, err)
+	testutil.Equals(t, [][]string{{"deploy", "start", "run"}, {"terminate"}}, api.Scripts())
+	testutil.Assert(t, wctx.runner.interrupted, "runner not interrupted")
+	var finished *event.ScriptFinished
+	for _, evt := range recorder.Events() {
+		if evt, ok := evt.(*event.ScriptFinished); ok {
+			finished = evt
+		}
+	}
+	testutil.Assert(t, finished != nil, "script not finished")
+	testutil.Assert(t, finished.Cancelled, "script not reported as cancelled")
+}
+
+func TestCommandTimeout(t *testing.T) {
+	api := newFakeActivityApi(t)
+	api.results = runningResults
+	wctx := newTestWorkContext(t, api, nil)
+	result := wctx.Run("/bin/sleep", []string{"60"}, nil, &RunOptions{Timeout: 50 * time.Millisecond})
+	started := time.Now()
+	// The batch itself could run for a minute.
+	err := wctx.Commit(testContext(t), time.Minute)
+	var timedOut *rest.BatchTimeoutError
+	testutil.Assert(t, errors.As(err, &timedOut), "expected a batch timeout, got %v", err)
+	testutil.Assert(t, time.Since(started) < 5*time.Second, "command timeout not enforced")
+	_, err = result.Get(context.Background())
+	testutil.Assert(t, errors.As(err, &timedOut), "expected the result to time out, got %v", err)
+}
+
+func TestTimeoutRejectsAndRetries(t *testing.T) {
+	api := newFakeActivityApi(t)
+	// The first activity hangs, the second one runs the command.
+	api.results = func(batch *fakeBatch) []activity.ExeScriptCommandResult {
+		if batch.ActivityId == "act-1" {
+			return runningResults(batch)
+		}
+		return okResults(batch)
+	}
+	recorder := &eventRecorder{}
+	executor := NewExecutor(runCommand(50*time.Millisecond, nil), nil, 1, recorder.emit)
+	item := executor.Submit("task")
+	testutil.Ok(t, executor.RunAgreement(testContext(t), api.service(), testAgreement("agr", true)))
+
+	_, err := item.Get(testContext(t))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, item.attempts)
+	testutil.Equals(t, []string{"*event.TaskRejected", "*event.TaskAccepted"},
+		recorder.Names("*event.TaskRejected", "*event.TaskAccepted"))
+	// The interrupted activity is replaced.
+	testutil.Equals(t, []string{"act-1", "act-2"}, api.Created())
+	testutil.Equals(t, []string{"act-1", "act-2"}, api.Destroyed())
+	testutil.Equals(t, []string{"*event.ActivityDestroyed", "*event.ActivityDestroyed"},
+		recorder.Names("*event.ActivityDestroyed"))
+
+	// Without retries left the item is rejected for good.
+	api = newFakeActivityApi(t)
+	api.results = runningResults
+	executor = NewExecutor(runCommand(50*time.Millisecond, nil), nil, 0, nil)
+	item = executor.Submit("task")
+	err = executor.RunAgreement(testContext(t), api.service(), testAgreement("agr", false))
+	var timedOut *rest.BatchTimeoutError
+	testutil.Assert(t, errors.As(err, &timedOut), "expected a batch timeout, got %v", err)
+	_, err = item.Get(testContext(t))
+	var rejected *TaskRejectedError
+	testutil.Assert(t, errors.As(err, &rejected), "expected a rejection, got %v", err)
+}
+
+func TestRejectEmitsUnlocked(t *testing.T) {
+	var item *WorkItem
+	pending := make([]bool, 0)
+	// The emitter calls back into the rejected item.
+	executor := NewExecutor(runCommand(time.Second, nil), nil, 1, func(evt interface{}) {
+		if _, ok := evt.(*event.TaskRejected); ok {
+			pending = append(pending, item.pending())
+		}
+	})
+	item = executor.Submit("task")
+	for attempt := 0; attempt < 2; attempt++ {
+		testutil.Equals(t, item, executor.pop("provider"))
+		item.start(testAgreement("agr", false))
+		item.Reject("failed", true)
+	}
+	_, err := item.Get(testContext(t))
+	var rejected *TaskRejectedError
+	testutil.Assert(t, errors.As(err, &rejected), "expected a rejection, got %v", err)
+	testutil.Equals(t, []bool{false, false}, pending)
+	testutil.Equals(t, 0, executor.Pending())
+}
+
+func TestTimeoutDestroysUnresponsiveActivity(t *testing.T) {
+	api := newFakeActivityApi(t)
+	api.results = runningResults
+	// The activity does not accept the terminate command.
+	api.exec = func(batch *fakeBatch) int {
+		if batch.Commands[0] == "terminate" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	executor := NewExecutor(runCommand(50*time.Millisecond, nil), nil, 0, nil)
+	executor.Submit("task")
+	err := executor.RunAgreement(testContext(t), api.service(), testAgreement("agr", false))
+	var timedOut *rest.BatchTimeoutError
+	testutil.Assert(t, errors.As(err, &timedOut), "expected a batch timeout, got %v", err)
+	// The activity is destroyed by the interruption only.
+	testutil.Equals(t, []string{"act-1"}, api.Destroyed())
+}
+
+func TestMonitorTerminatedActivity(t *testing.T) {
+	api := newFakeActivityApi(t)
+	api.setUsage(10, 2)
+	recorder := &eventRecorder{}
+	monitor := NewActivityMonitor(time.Hour, recorder.emit)
+	terminated := false
+	executor := NewExecutor(func(ctx context.Context, wctx *WorkContext, item *WorkItem) error {
+		wctx.Run("/golem/entrypoints/task", nil, nil, nil)
+		if err := wctx.Commit(ctx, time.Minute); err != nil {
+			return err
+		}
+		if !terminated {
+			// The provider terminates the activity after the first item.
+			terminated = true
+			api.setState(wctx.Id, rest.ActivityStateTerminated)
+			monitor.poll()
+		}
+		return nil
+	}, nil, 0, recorder.emit)
+	executor.SetMonitor(monitor)
+	first, second := executor.Submit("first"), executor.Submit("second")
+	info := testAgreement("agr", true)
+	info.Pricing = &props.ComLinear{
+		FixedPrice:  0.5,
+		PriceFor:    map[props.Counter]float32{props.CounterTIME: 0.25, props.CounterCPU: 1},
+		UsageVector: []props.Counter{props.CounterTIME, props.CounterCPU},
+	}
+	testutil.Ok(t, executor.RunAgreement(testContext(t), api.service(), info))
+
+	for _, item := range []*WorkItem{first, second} {
+		_, err := item.Get(testContext(t))
+		testutil.Ok(t, err)
+	}
+	// The terminated activity is replaced instead of receiving the second item.
+	testutil.Equals(t, []string{"act-1", "act-2"}, api.Created())
+	testutil.Equals(t, []string{"act-1", "act-2"}, api.Destroyed())
+	testutil.Equals(t, [][]string{{"deploy", "start", "run"}, {"deploy", "start", "run"}}, api.Scripts())
+	var changed *event.ActivityStateChanged
+	var usage *event.ActivityUsage
+	for _, evt := range recorder.Events() {
+		switch e := evt.(type) {
+		case *event.ActivityStateChanged:
+			changed = e
+		case *event.ActivityUsage:
+			usage = e
+		}
+	}
+	testutil.Equals(t, &event.ActivityStateChanged{AgreementEvent: event.AgreementEvent{AgrId: "agr"},
+		ActId: "act-1", State: rest.ActivityStateTerminated}, changed)
+	testutil.Assert(t, usage != nil, "usage of the activity not reported")
+	testutil.Equals(t, map[props.Counter]float64{props.CounterTIME: 10, props.CounterCPU: 2}, usage.Usage)
+	testutil.Equals(t, 5.0, usage.Cost)
+	// Destroyed activities are no longer monitored.
+	testutil.Equals(t, 0.0, monitor.TotalCost())
+
+	// Without multiple activities the agreement can't run the second item.
+	api = newFakeActivityApi(t)
+	terminated = false
+	executor.Submit("first")
+	second = executor.Submit("second")
+	err := executor.RunAgreement(testContext(t), api.service(), testAgreement("agr", false))
+	var unavailable *ActivityUnavailableError
+	testutil.Assert(t, errors.As(err, &unavailable), "expected an unavailable activity, got %v", err)
+	testutil.Equals(t, &ActivityUnavailableError{ActivityId: "act-1", State: rest.ActivityStateTerminated}, unavailable)
+	testutil.Equals(t, 1, executor.Pending())
+	testutil.Equals(t, []string{"act-1"}, api.Created())
+}
+
+func TestRunAgreementReusesActivity(t *testing.T) {
+	api := newFakeActivityApi(t)
+	executor := NewExecutor(runCommand(time.Minute, nil), nil, 0, nil)
+	first, second := executor.Submit("first"), executor.Submit("second")
+	testutil.Ok(t, executor.RunAgreement(testContext(t), api.service(), testAgreement("agr", true)))
+	for _, item := range []*WorkItem{first, second} {
+		_, err := item.Get(testContext(t))
+		testutil.Ok(t, err)
+	}
+	// The runtime is deployed and started once for both items.
+	testutil.Equals(t, []string{"act-1"}, api.Created())
+	testutil.Equals(t, [][]string{{"deploy", "start", "run"}, {"run"}}, api.Scripts())
+	testutil.Equals(t, []string{"act-1"}, api.Destroyed())
+
+	// A failed activity is replaced with a new one.
+	api = newFakeActivityApi(t)
+	api.results = func(batch *fakeBatch) []activity.ExeScriptCommandResult {
+		results := okResults(batch)
+		if batch.ActivityId == "act-1" {
+			api.setState(batch.ActivityId, rest.ActivityStateTerminated)
+			message := "runtime crashed"
+			results[len(results)-1].Result = "Error"
+			results[len(results)-1].Message = &message
+		}
+		return results
+	}
+	first, second = executor.Submit("first"), executor.Submit("second")
+	testutil.Ok(t, executor.RunAgreement(testContext(t), api.service(), testAgreement("agr", true)))
+	_, err := first.Get(testContext(t))
+	var rejected *TaskRejectedError
+	testutil.Assert(t, errors.As(err, &rejected), "expected a rejection, got %v", err)
+	_, err = second.Get(testContext(t))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"act-1", "act-2"}, api.Created())
+	testutil.Equals(t, [][]string{{"deploy", "start", "run"}, {"deploy", "start", "run"}}, api.Scripts())
+	testutil.Equals(t, []string{"act-1", "act-2"}, api.Destroyed())
+}
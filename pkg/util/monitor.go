@@ -0,0 +1,198 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/rest"
+)
+
+const monitorIntervalDefault = 10 * time.Second
+
+type monitoredActivity struct {
+	activity    *rest.Activity
+	agreementId string
+	pricing     *props.ComLinear
+	state       string
+	usage       map[props.Counter]float64
+	cost        float64
+}
+
+// ActivityMonitor polls the state and usage of live activities and emits
+// ActivityStateChanged and ActivityUsage events.
+type ActivityMonitor struct {
+	emitter    func(interface{})
+	interval   time.Duration
+	lock       *sync.Mutex
+	activities map[string]*monitoredActivity
+}
+
+func NewActivityMonitor(interval time.Duration, emitter func(interface{})) *ActivityMonitor {
+	if interval <= 0 {
+		interval = monitorIntervalDefault
+	}
+	return &ActivityMonitor{
+		emitter:    emitter,
+		interval:   interval,
+		lock:       &sync.Mutex{},
+		activities: make(map[string]*monitoredActivity),
+	}
+}
+
+func (self *ActivityMonitor) emit(evt interface{}) {
+	if self.emitter != nil {
+		self.emitter(evt)
+	}
+}
+
+// Add starts monitoring `activity`, `pricing` may be nil in which case no
+// running cost is computed. The usage vector of the activity is taken from
+// the pricing model.
+func (self *ActivityMonitor) Add(activity *rest.Activity, agreementId string, pricing *props.ComLinear) {
+	if pricing != nil {
+		activity.SetUsageVector(pricing.UsageVector)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.activities[activity.Id()] = &monitoredActivity{
+		activity:    activity,
+		agreementId: agreementId,
+		pricing:     pricing,
+	}
+}
+
+// Remove stops monitoring the activity with `activityId`.
+func (self *ActivityMonitor) Remove(activityId string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.activities, activityId)
+}
+
+// State returns the last known state of the activity.
+func (self *ActivityMonitor) State(activityId string) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if monitored, ok := self.activities[activityId]; ok {
+		return monitored.state
+	}
+	return ""
+}
+
+// Alive reports whether the activity is neither terminated nor unresponsive,
+// as far as the monitor knows.
+func (self *ActivityMonitor) Alive(activityId string) bool {
+	switch self.State(activityId) {
+	case rest.ActivityStateTerminated, rest.ActivityStateUnresponsive:
+		return false
+	default:
+		return true
+	}
+}
+
+// Usage returns the last known usage of the activity.
+func (self *ActivityMonitor) Usage(activityId string) map[props.Counter]float64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	monitored, ok := self.activities[activityId]
+	if !ok {
+		return nil
+	}
+	usage := make(map[props.Counter]float64, len(monitored.usage))
+	for counter, value := range monitored.usage {
+		usage[counter] = value
+	}
+	return usage
+}
+
+// Cost returns the running cost of the activity.
+func (self *ActivityMonitor) Cost(activityId string) float64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if monitored, ok := self.activities[activityId]; ok {
+		return monitored.cost
+	}
+	return 0
+}
+
+// TotalCost returns the running cost of all monitored activities.
+func (self *ActivityMonitor) TotalCost() float64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	total := 0.0
+	for _, monitored := range self.activities {
+		total += monitored.cost
+	}
+	return total
+}
+
+// Run polls the monitored activities until `ctx` is done.
+func (self *ActivityMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		self.poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (self *ActivityMonitor) poll() {
+	self.lock.Lock()
+	activities := make([]*monitoredActivity, 0, len(self.activities))
+	for _, monitored := range self.activities {
+		activities = append(activities, monitored)
+	}
+	self.lock.Unlock()
+	for _, monitored := range activities {
+		self.pollActivity(monitored)
+	}
+}
+
+func (self *ActivityMonitor) pollActivity(monitored *monitoredActivity) {
+	activityId := monitored.activity.Id()
+	agreementEvent := event.AgreementEvent{AgrId: monitored.agreementId}
+	state, err := monitored.activity.State()
+	if err != nil {
+		level.Debug(logger).Log("msg", "polling activity state", "activityId", activityId, "err", err)
+	} else if states := state.GetState(); len(states) > 0 && states[0] != nil {
+		self.lock.Lock()
+		previous := monitored.state
+		monitored.state = *states[0]
+		self.lock.Unlock()
+		if previous != *states[0] {
+			self.emit(&event.ActivityStateChanged{
+				AgreementEvent: agreementEvent,
+				ActId:          activityId,
+				Previous:       previous,
+				State:          *states[0],
+				Reason:         state.GetReason(),
+			})
+		}
+	}
+	if monitored.pricing == nil {
+		return
+	}
+	usage, err := monitored.activity.Usage()
+	if err != nil {
+		level.Debug(logger).Log("msg", "polling activity usage", "activityId", activityId, "err", err)
+		return
+	}
+	cost := monitored.pricing.Cost(usage)
+	self.lock.Lock()
+	monitored.usage = usage
+	monitored.cost = cost
+	self.lock.Unlock()
+	self.emit(&event.ActivityUsage{
+		AgreementEvent: agreementEvent,
+		ActId:          activityId,
+		Usage:          usage,
+		Cost:           cost,
+	})
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redundancyTimeoutDefault is the time in which the replicas of an item
+// have to be taken by distinct providers.
+const redundancyTimeoutDefault = 30 * time.Minute
+
+// Comparator reports whether two results of a redundantly executed item agree.
+type Comparator func(a, b interface{}) bool
+
+// HashResult returns the SHA-256 digest of a result, byte slices and strings
+// are hashed as they are, other values as JSON.
+func HashResult(result interface{}) string {
+	var data []byte
+	switch x := result.(type) {
+	case []byte:
+		data = x
+	case string:
+		data = []byte(x)
+	default:
+		var err error
+		data, err = json.Marshal(x)
+		if err != nil {
+			data = []byte(fmt.Sprintf("%#v", x))
+		}
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// HashFile returns the SHA-256 digest of a downloaded output, workers accept
+// replicas with it so that their outputs can be compared with SameHash.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// SameHash is the default Comparator, it compares the digests of the results.
+func SameHash(a, b interface{}) bool {
+	return HashResult(a) == HashResult(b)
+}
+
+// redundantGroup holds the replicas of an item which is run on several
+// distinct providers and accepted with the result of the majority.
+type redundantGroup struct {
+	item     *WorkItem
+	compare  Comparator
+	lock     *sync.Mutex
+	replicas []*WorkItem
+	// providers maps the providers which took a replica to that replica.
+	providers map[string]*WorkItem
+	finished  int
+	timer     *time.Timer
+	// expired is set once the replicas may no longer be queued, it is
+	// guarded by the lock of the executor.
+	expired bool
+}
+
+// SubmitRedundant queues `data` to be processed on `k` distinct providers.
+// The returned item resolves to the result agreed on by more than half of
+// the providers according to `compare`, SameHash if nil. Replicas whose
+// results are outvoted are rejected, and so are all of them if there is no
+// majority. A replica is retried on a provider which took none of the
+// replicas, replicas left without such a provider when the redundancy
+// timeout expires are rejected and count as disagreeing, see
+// SetRedundancyTimeout.
+func (self *Executor) SubmitRedundant(data interface{}, k int, compare Comparator) *WorkItem {
+	if k <= 1 {
+		return self.Submit(data)
+	}
+	if compare == nil {
+		compare = SameHash
+	}
+	item := newWorkItem(self, self.nextId(), data)
+	group := &redundantGroup{
+		item:      item,
+		compare:   compare,
+		lock:      &sync.Mutex{},
+		replicas:  make([]*WorkItem, k),
+		providers: make(map[string]*WorkItem),
+	}
+	for i := range group.replicas {
+		replica := newWorkItem(self, item.Id+"."+strconv.Itoa(i), data)
+		replica.group = group
+		group.replicas[i] = replica
+	}
+	for _, replica := range group.replicas {
+		self.push(replica)
+	}
+	group.timer = time.AfterFunc(self.redundancyTimeout, group.expire)
+	return item
+}
+
+// claim reports whether `replica` may run on the provider with `providerId`,
+// i.e. no replica of the group, including a previous attempt of `replica`,
+// took that provider.
+func (g *redundantGroup) claim(replica *WorkItem, providerId string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.providers[providerId]; ok {
+		return false
+	}
+	g.providers[providerId] = replica
+	return true
+}
+
+// expire rejects the replicas which are still queued.
+func (g *redundantGroup) expire() {
+	executor := g.item.executor
+	executor.lock.Lock()
+	g.expired = true
+	queued := make([]*WorkItem, 0)
+	kept := executor.queue[:0]
+	for _, item := range executor.queue {
+		if item.group == g {
+			queued = append(queued, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	executor.queue = kept
+	executor.lock.Unlock()
+	for _, replica := range queued {
+		replica.resolve(nil, &TaskRejectedError{Reason: "no distinct provider took the replica"})
+		g.finish()
+	}
+}
+
+// finish is called once a replica was accepted or rejected for good, the
+// results are voted on after the last one.
+func (g *redundantGroup) finish() {
+	g.lock.Lock()
+	g.finished++
+	last := g.finished == len(g.replicas)
+	g.lock.Unlock()
+	if last {
+		g.timer.Stop()
+		g.vote()
+	}
+}
+
+func (g *redundantGroup) vote() {
+	accepted := make([]*WorkItem, 0, len(g.replicas))
+	for _, replica := range g.replicas {
+		if replica.err == nil {
+			accepted = append(accepted, replica)
+		}
+	}
+	// Find the largest set of agreeing results.
+	var majority []*WorkItem
+	for _, a := range accepted {
+		agreeing := []*WorkItem{a}
+		for _, b := range accepted {
+			if a != b && g.compare(a.result, b.result) {
+				agreeing = append(agreeing, b)
+			}
+		}
+		if len(agreeing) > len(majority) {
+			majority = agreeing
+		}
+	}
+	if 2*len(majority) <= len(g.replicas) {
+		for _, replica := range accepted {
+			replica.emitRejected("no majority among redundant results")
+		}
+		g.item.resolve(nil, &TaskRejectedError{Reason: "no majority among redundant results"})
+		return
+	}
+	inMajority := make(map[*WorkItem]bool, len(majority))
+	for _, replica := range majority {
+		inMajority[replica] = true
+	}
+	for _, replica := range accepted {
+		if inMajority[replica] {
+			replica.emitAccepted()
+		} else {
+			replica.emitRejected("result outvoted by the majority")
+		}
+	}
+	g.item.resolve(majority[0].result, nil)
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+// acceptResult returns a worker accepting the items with the result of the
+// provider, named after its agreement.
+func acceptResult(results map[string]interface{}) WorkerFunc {
+	return func(ctx context.Context, wctx *WorkContext, item *WorkItem) error {
+		item.Accept(results[wctx.ProviderName()])
+		return nil
+	}
+}
+
+// runProviders runs the queued items on one agreement per provider.
+func runProviders(t *testing.T, executor *Executor, providers ...string) {
+	api := newFakeActivityApi(t)
+	for _, provider := range providers {
+		testutil.Ok(t, executor.RunAgreement(testContext(t), api.service(), testAgreement(provider, false)))
+	}
+}
+
+func newTestReputation(t *testing.T) *ReputationStore {
+	store, err := NewReputationStore(filepath.Join(t.TempDir(), "reputation.json"))
+	testutil.Ok(t, err)
+	return store
+}
+
+func TestRedundantMajority(t *testing.T) {
+	store := newTestReputation(t)
+	executor := NewExecutor(acceptResult(map[string]interface{}{
+		"node-a": "x", "node-b": "y", "node-c": "x",
+	}), nil, 0, store.Handle)
+	item := executor.SubmitRedundant("task", 3, nil)
+	// A provider takes only one replica of the item.
+	runProviders(t, executor, "a", "a")
+	testutil.Equals(t, 2, executor.Pending())
+	runProviders(t, executor, "b", "c")
+	testutil.Equals(t, 0, executor.Pending())
+
+	result, err := item.Get(testContext(t))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "x", result)
+	// The outlier is rejected and its provider's reputation drops.
+	testutil.Equals(t, 1, store.Stats("provider-a").TasksAccepted)
+	testutil.Equals(t, 1, store.Stats("provider-c").TasksAccepted)
+	testutil.Equals(t, 0, store.Stats("provider-b").TasksAccepted)
+	testutil.Equals(t, 1, store.Stats("provider-b").TasksRejected)
+	testutil.Assert(t, store.Modify("provider-b", 1) < store.Modify("provider-a", 1),
+		"outvoted provider not ranked lower")
+}
+
+func TestRedundantTie(t *testing.T) {
+	store := newTestReputation(t)
+	executor := NewExecutor(acceptResult(map[string]interface{}{
+		"node-a": []byte("x"), "node-b": []byte("y"), "node-c": []byte("x"), "node-d": []byte("y"),
+	}), nil, 0, store.Handle)
+	item := executor.SubmitRedundant("task", 4, nil)
+	runProviders(t, executor, "a", "b", "c", "d")
+
+	_, err := item.Get(testContext(t))
+	testutil.Equals(t, &TaskRejectedError{Reason: "no majority among redundant results"}, err)
+	for _, provider := range []string{"provider-a", "provider-b", "provider-c", "provider-d"} {
+		stats := store.Stats(provider)
+		testutil.Equals(t, 0, stats.TasksAccepted)
+		testutil.Equals(t, 1, stats.TasksRejected)
+	}
+
+	// Results agree according to the comparator.
+	executor = NewExecutor(acceptResult(map[string]interface{}{
+		"node-a": 1.0, "node-b": 1.1, "node-c": 3.0,
+	}), nil, 0, nil)
+	item = executor.SubmitRedundant("task", 3, func(a, b interface{}) bool {
+		diff := a.(float64) - b.(float64)
+		return diff < 0.5 && diff > -0.5
+	})
+	runProviders(t, executor, "a", "b", "c")
+	result, err := item.Get(testContext(t))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1.0, result)
+}
+
+func TestRedundantRetryOnOtherProvider(t *testing.T) {
+	failed := false
+	executor := NewExecutor(func(ctx context.Context, wctx *WorkContext, item *WorkItem) error {
+		if wctx.ProviderName() == "node-a" && !failed {
+			failed = true
+			item.Reject("failed", true)
+			return nil
+		}
+		item.Accept("x")
+		return nil
+	}, nil, 1, nil)
+	item := executor.SubmitRedundant("task", 2, nil)
+	runProviders(t, executor, "a", "b")
+	// The failed replica is not run again on a provider of the group.
+	runProviders(t, executor, "a", "b")
+	testutil.Equals(t, 1, executor.Pending())
+	runProviders(t, executor, "c")
+	testutil.Equals(t, 0, executor.Pending())
+
+	result, err := item.Get(testContext(t))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "x", result)
+}
+
+func TestRedundantTimeout(t *testing.T) {
+	executor := NewExecutor(acceptResult(map[string]interface{}{
+		"node-a": "x", "node-b": "x",
+	}), nil, 0, nil)
+	executor.SetRedundancyTimeout(50 * time.Millisecond)
+	// Without enough providers the item fails once the timeout expires.
+	failing := executor.SubmitRedundant("failing", 3, nil)
+	runProviders(t, executor, "a")
+	_, err := failing.Get(testContext(t))
+	var rejected *TaskRejectedError
+	testutil.Assert(t, errors.As(err, &rejected), "expected a rejection, got %v", err)
+	testutil.Equals(t, 0, executor.Pending())
+
+	// A majority of the replicas is enough.
+	item := executor.SubmitRedundant("task", 3, nil)
+	runProviders(t, executor, "a", "b")
+	result, err := item.Get(testContext(t))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "x", result)
+	testutil.Equals(t, 0, executor.Pending())
+}
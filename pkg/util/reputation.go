@@ -0,0 +1,220 @@
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/rest"
+)
+
+// debitNoteTolerance is the share by which a debit note may exceed the cost
+// computed from the activity usage before it counts as a discrepancy.
+const debitNoteTolerance = 0.1
+
+// ScoreModifier adjusts the score of an offer, a market strategy applies it
+// before passing the score to AgreementPool.AddProposal.
+type ScoreModifier interface {
+	Modify(providerId string, score float32) float32
+}
+
+// ProviderStats holds the outcomes recorded for a provider.
+type ProviderStats struct {
+	TasksAccepted          int       `json:"tasks_accepted"`
+	TasksRejected          int       `json:"tasks_rejected"`
+	ActivityFailures       int       `json:"activity_failures"`
+	AgreementTerminations  int       `json:"agreement_terminations"`
+	DebitNoteDiscrepancies int       `json:"debit_note_discrepancies"`
+	TaskSeconds            float64   `json:"task_seconds"`
+	LastSeen               time.Time `json:"last_seen"`
+}
+
+// AverageTaskDuration returns the mean duration of the accepted tasks.
+func (ps *ProviderStats) AverageTaskDuration() time.Duration {
+	if ps.TasksAccepted == 0 {
+		return 0
+	}
+	return time.Duration(ps.TaskSeconds / float64(ps.TasksAccepted) * float64(time.Second))
+}
+
+// Reliability returns the share of good outcomes, smoothed so that a
+// provider without a history scores 0.5.
+func (ps *ProviderStats) Reliability() float64 {
+	failures := ps.TasksRejected + ps.ActivityFailures + ps.AgreementTerminations + ps.DebitNoteDiscrepancies
+	return float64(ps.TasksAccepted+1) / float64(ps.TasksAccepted+failures+2)
+}
+
+// ReputationStore tracks per-provider outcomes from the engine events and
+// persists them in a local JSON file.
+type ReputationStore struct {
+	path      string
+	lock      *sync.Mutex
+	providers map[string]*ProviderStats
+	// Runtime state used to attribute events to providers.
+	agreements map[string]string
+	// started maps the ids of the running tasks to their start time.
+	started map[string]time.Time
+	// costs maps the ids of the live activities to the cost of their usage.
+	costs map[string]float64
+}
+
+// NewReputationStore loads the store from `path`, a missing file yields an
+// empty store.
+func NewReputationStore(path string) (*ReputationStore, error) {
+	rs := &ReputationStore{
+		path:       path,
+		lock:       &sync.Mutex{},
+		providers:  make(map[string]*ProviderStats),
+		agreements: make(map[string]string),
+		started:    make(map[string]time.Time),
+		costs:      make(map[string]float64),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &rs.providers); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Save writes the store to its file.
+func (rs *ReputationStore) Save() error {
+	rs.lock.Lock()
+	data, err := json.MarshalIndent(rs.providers, "", "  ")
+	rs.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash does not lose the history.
+	tmp, err := ioutil.TempFile(filepath.Dir(rs.path), filepath.Base(rs.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), rs.path)
+}
+
+// Stats returns the outcomes recorded for the provider.
+func (rs *ReputationStore) Stats(providerId string) ProviderStats {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if stats, ok := rs.providers[providerId]; ok {
+		return *stats
+	}
+	return ProviderStats{}
+}
+
+// Modify scales a positive score by the reliability of the provider and
+// lowers a non-positive one by its unreliability.
+func (rs *ReputationStore) Modify(providerId string, score float32) float32 {
+	stats := rs.Stats(providerId)
+	reliability := float32(stats.Reliability())
+	if score > 0 {
+		return score * reliability
+	}
+	return score - (1 - reliability)
+}
+
+// update applies `fn` to the stats of the provider, creating them if needed.
+// It has to be called with the lock held.
+func (rs *ReputationStore) update(providerId string, fn func(*ProviderStats)) {
+	if providerId == "" {
+		return
+	}
+	stats, ok := rs.providers[providerId]
+	if !ok {
+		stats = &ProviderStats{}
+		rs.providers[providerId] = stats
+	}
+	fn(stats)
+	stats.LastSeen = time.Now()
+}
+
+// Handle records the outcome carried by an engine event, it is meant to be
+// chained into the emitter passed to the engine components.
+func (rs *ReputationStore) Handle(evt interface{}) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	switch e := evt.(type) {
+	case *event.AgreementCreated:
+		rs.agreements[e.AgrId] = e.ProviderId
+		rs.update(e.ProviderId, func(*ProviderStats) {})
+	case *event.TaskStarted:
+		rs.started[e.TaskId] = time.Now()
+	case *event.TaskAccepted:
+		providerId := rs.provider(e.ProviderId, e.AgrId)
+		started, ok := rs.started[e.TaskId]
+		delete(rs.started, e.TaskId)
+		rs.update(providerId, func(stats *ProviderStats) {
+			stats.TasksAccepted++
+			if ok {
+				stats.TaskSeconds += time.Since(started).Seconds()
+			}
+		})
+	case *event.TaskRejected:
+		delete(rs.started, e.TaskId)
+		rs.update(rs.provider(e.ProviderId, e.AgrId), func(stats *ProviderStats) {
+			stats.TasksRejected++
+		})
+	case *event.ActivityCreateFailed:
+		rs.update(rs.agreements[e.AgrId], func(stats *ProviderStats) {
+			stats.ActivityFailures++
+		})
+	case *event.ActivityStateChanged:
+		if e.State == rest.ActivityStateUnresponsive {
+			rs.update(rs.agreements[e.AgrId], func(stats *ProviderStats) {
+				stats.ActivityFailures++
+			})
+		}
+	case *event.ActivityDestroyed:
+		delete(rs.costs, e.ActId)
+	case *event.ActivityUsage:
+		rs.costs[e.ActId] = e.Cost
+	case *event.DebitNoteReceived:
+		cost, ok := rs.costs[e.ActId]
+		amount, err := strconv.ParseFloat(e.Amount, 64)
+		if ok && err == nil && amount > cost*(1+debitNoteTolerance) {
+			rs.update(rs.agreements[e.AgrId], func(stats *ProviderStats) {
+				stats.DebitNoteDiscrepancies++
+			})
+		}
+	case *event.AgreementTerminated:
+		rs.terminated(e.AgreementEvent)
+	}
+}
+
+// terminated records agreements terminated by the provider, terminations
+// initiated by the requestor carry the requestor's reason code.
+func (rs *ReputationStore) terminated(e event.AgreementEvent) {
+	if _, ok := e.Reason["golem.requestor.code"]; !ok {
+		rs.update(rs.agreements[e.AgrId], func(stats *ProviderStats) {
+			stats.AgreementTerminations++
+		})
+	}
+	delete(rs.agreements, e.AgrId)
+}
+
+func (rs *ReputationStore) provider(providerId, agreementId string) string {
+	if providerId != "" {
+		return providerId
+	}
+	return rs.agreements[agreementId]
+}
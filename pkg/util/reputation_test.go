@@ -0,0 +1,133 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+func agreementEvent(agreementId string) event.AgreementEvent {
+	return event.AgreementEvent{AgrId: agreementId}
+}
+
+func taskEvent(taskId string) event.TaskEvent {
+	return event.TaskEvent{TaskId: taskId}
+}
+
+func TestReputationCounters(t *testing.T) {
+	store := newTestReputation(t)
+	store.Handle(&event.AgreementCreated{AgreementEvent: agreementEvent("agr-1"), ProviderId: "provider"})
+	store.Handle(&event.AgreementCreated{AgreementEvent: agreementEvent("agr-2"), ProviderId: "provider"})
+	testutil.Equals(t, 0, store.Stats("provider").TasksAccepted)
+	testutil.Assert(t, !store.Stats("provider").LastSeen.IsZero(), "provider not recorded")
+
+	// Tasks run concurrently on one agreement are timed separately.
+	store.Handle(&event.TaskStarted{TaskEvent: taskEvent("1"), AgreementEvent: agreementEvent("agr-1")})
+	time.Sleep(20 * time.Millisecond)
+	store.Handle(&event.TaskStarted{TaskEvent: taskEvent("2"), AgreementEvent: agreementEvent("agr-1")})
+	store.Handle(&event.TaskStarted{TaskEvent: taskEvent("3"), AgreementEvent: agreementEvent("agr-2")})
+	store.Handle(&event.TaskAccepted{TaskEvent: taskEvent("2"), AgreementEvent: agreementEvent("agr-1")})
+	store.Handle(&event.TaskAccepted{TaskEvent: taskEvent("1"), AgreementEvent: agreementEvent("agr-1"), ProviderId: "provider"})
+	store.Handle(&event.TaskRejected{TaskEvent: taskEvent("3"), AgreementEvent: agreementEvent("agr-2")})
+	stats := store.Stats("provider")
+	testutil.Equals(t, 2, stats.TasksAccepted)
+	testutil.Equals(t, 1, stats.TasksRejected)
+	testutil.Assert(t, stats.TaskSeconds >= 0.02, "task duration %v not measured from its own start", stats.TaskSeconds)
+	testutil.Equals(t, 0, len(store.started))
+
+	store.Handle(&event.ActivityCreateFailed{AgreementEvent: agreementEvent("agr-1")})
+	store.Handle(&event.ActivityStateChanged{AgreementEvent: agreementEvent("agr-1"), State: rest.ActivityStateReady})
+	store.Handle(&event.ActivityStateChanged{AgreementEvent: agreementEvent("agr-1"), State: rest.ActivityStateUnresponsive})
+	testutil.Equals(t, 2, store.Stats("provider").ActivityFailures)
+
+	// Debit notes are checked against the cost of the usage of their activity.
+	debitNote := func(activityId, amount string) *event.DebitNoteReceived {
+		return &event.DebitNoteReceived{AgreementEvent: agreementEvent("agr-1"), ActId: activityId, Amount: amount}
+	}
+	store.Handle(debitNote("act-1", "1.5"))
+	store.Handle(&event.ActivityUsage{AgreementEvent: agreementEvent("agr-1"), ActId: "act-1", Cost: 1})
+	store.Handle(&event.ActivityUsage{AgreementEvent: agreementEvent("agr-1"), ActId: "act-2", Cost: 2})
+	store.Handle(debitNote("act-1", "1.05"))
+	store.Handle(debitNote("act-2", "1.5"))
+	store.Handle(debitNote("act-1", "1.5"))
+	store.Handle(debitNote("act-1", "not a number"))
+	testutil.Equals(t, 1, store.Stats("provider").DebitNoteDiscrepancies)
+	// The cost is dropped with the activity.
+	store.Handle(&event.ActivityDestroyed{AgreementEvent: agreementEvent("agr-1"), ActId: "act-1"})
+	store.Handle(debitNote("act-1", "1.5"))
+	testutil.Equals(t, 1, store.Stats("provider").DebitNoteDiscrepancies)
+	testutil.Equals(t, map[string]float64{"act-2": 2}, store.costs)
+
+	// Only terminations by the provider count.
+	store.Handle(&event.AgreementTerminated{AgreementEvent: event.AgreementEvent{
+		AgrId: "agr-1", Reason: map[string]string{"message": "Finished", "golem.requestor.code": "Success"}}})
+	store.Handle(&event.AgreementTerminated{AgreementEvent: event.AgreementEvent{
+		AgrId: "agr-2", Reason: map[string]string{"message": "Shutting down"}}})
+	testutil.Equals(t, 1, store.Stats("provider").AgreementTerminations)
+	testutil.Equals(t, 0, len(store.agreements))
+
+	testutil.Equals(t, ProviderStats{}, store.Stats("unknown"))
+}
+
+func TestReputationModify(t *testing.T) {
+	store := newTestReputation(t)
+	// Providers without a history are halved.
+	testutil.Equals(t, float32(0.5), store.Modify("new", 1))
+	testutil.Equals(t, float32(-0.5), store.Modify("new", 0))
+
+	for i := 0; i < 2; i++ {
+		store.Handle(&event.TaskAccepted{ProviderId: "good"})
+	}
+	for i := 0; i < 2; i++ {
+		store.Handle(&event.TaskRejected{ProviderId: "bad"})
+	}
+	good, bad := store.Stats("good"), store.Stats("bad")
+	testutil.Equals(t, 0.75, good.Reliability())
+	testutil.Equals(t, 0.25, bad.Reliability())
+	testutil.Equals(t, float32(1.5), store.Modify("good", 2))
+	testutil.Equals(t, float32(0.5), store.Modify("bad", 2))
+	testutil.Equals(t, float32(-0.25), store.Modify("good", 0))
+	testutil.Equals(t, float32(-1.75), store.Modify("bad", -1))
+}
+
+func TestReputationSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reputation.json")
+	store, err := NewReputationStore(path)
+	testutil.Ok(t, err)
+	store.Handle(&event.TaskStarted{TaskEvent: taskEvent("1")})
+	store.Handle(&event.TaskAccepted{TaskEvent: taskEvent("1"), ProviderId: "provider"})
+	store.Handle(&event.TaskRejected{ProviderId: "provider"})
+	store.Handle(&event.TaskRejected{ProviderId: "other"})
+	testutil.Ok(t, store.Save())
+
+	loaded, err := NewReputationStore(path)
+	testutil.Ok(t, err)
+	for _, providerId := range []string{"provider", "other"} {
+		expected, actual := store.Stats(providerId), loaded.Stats(providerId)
+		testutil.Assert(t, expected.LastSeen.Equal(actual.LastSeen), "last seen %v, got %v", expected.LastSeen, actual.LastSeen)
+		expected.LastSeen, actual.LastSeen = time.Time{}, time.Time{}
+		testutil.Equals(t, expected, actual)
+	}
+	// Saving again replaces the file without leaving temporary files behind.
+	loaded.Handle(&event.TaskAccepted{ProviderId: "other"})
+	testutil.Ok(t, loaded.Save())
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(files))
+	loaded, err = NewReputationStore(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, loaded.Stats("other").TasksAccepted)
+
+	testutil.Ok(t, ioutil.WriteFile(path, []byte("not json"), 0644))
+	_, err = NewReputationStore(path)
+	testutil.NotOk(t, err)
+	testutil.Ok(t, os.Remove(path))
+	_, err = NewReputationStore(path)
+	testutil.Ok(t, err)
+}
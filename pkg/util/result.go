@@ -0,0 +1,274 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/script"
+)
+
+var errCommandSkipped = errors.New("command skipped after a previous command failed")
+
+// CommandResult holds the outcome of a single executed command.
+type CommandResult struct {
+	Idx     int
+	Success bool
+	Message string
+	Stdout  string
+	Stderr  string
+	// StdoutBin and StderrBin hold the output of streams captured with the
+	// binary format, in which case Stdout and Stderr are left empty.
+	StdoutBin []byte
+	StderrBin []byte
+	Started   time.Time
+	Finished  time.Time
+}
+
+// Duration returns how long the command took to execute.
+func (cr *CommandResult) Duration() time.Duration {
+	if cr.Started.IsZero() || cr.Finished.IsZero() {
+		return 0
+	}
+	return cr.Finished.Sub(cr.Started)
+}
+
+// Result is a handle to the result of a command scheduled on a WorkContext,
+// it is resolved once the batch containing the command has been executed.
+type Result struct {
+	lock    *sync.Mutex
+	done    chan struct{}
+	command string
+	started time.Time
+	stdout  bytes.Buffer
+	stderr  bytes.Buffer
+	// Capture formats of the output streams.
+	stdoutFormat script.CaptureFormat
+	stderrFormat script.CaptureFormat
+	// Live output receivers for streamed commands.
+	stdoutWriter io.Writer
+	stderrWriter io.Writer
+	result       *CommandResult
+	err          error
+}
+
+func newResult() *Result {
+	return &Result{
+		lock: &sync.Mutex{},
+		done: make(chan struct{}),
+	}
+}
+
+// Done returns a channel which is closed when the result is available.
+func (self *Result) Done() <-chan struct{} {
+	return self.done
+}
+
+// Get blocks until the command has been executed or `ctx` is done. A command
+// which failed on the provider returns its result along with a
+// rest.CommandExecutionError.
+func (self *Result) Get(ctx context.Context) (*CommandResult, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-self.done:
+	}
+	return self.result, self.err
+}
+
+// handle updates the result with a command event of its command.
+func (self *Result) handle(evt *event.CommandEventContext, started time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.resolved() {
+		return
+	}
+	switch evt.EvtCls.(type) {
+	case event.CommandStarted:
+		self.started = time.Now()
+	case event.CommandStdOut:
+		output := evt.Bytes("output")
+		self.stdout.Write(output)
+		if self.stdoutWriter != nil {
+			self.stdoutWriter.Write(output)
+		}
+	case event.CommandStdErr:
+		output := evt.Bytes("output")
+		self.stderr.Write(output)
+		if self.stderrWriter != nil {
+			self.stderrWriter.Write(output)
+		}
+	case event.CommandExecuted:
+		if self.started.IsZero() {
+			self.started = started
+		}
+		finished, ok := evt.Kwargs["event_date"].(time.Time)
+		if !ok {
+			finished = time.Now()
+		}
+		result := &CommandResult{
+			Idx:      evt.Idx(),
+			Success:  evt.Bool("success"),
+			Message:  evt.String("message"),
+			Started:  self.started,
+			Finished: finished,
+		}
+		// Polled results carry the whole output at once.
+		stdout, stderr := self.stdout.Bytes(), self.stderr.Bytes()
+		if polled := evt.String("stdout"); polled != "" {
+			stdout = decodeOutput(polled, self.stdoutFormat)
+		}
+		if polled := evt.String("stderr"); polled != "" {
+			stderr = decodeOutput(polled, self.stderrFormat)
+		}
+		if self.stdoutFormat == script.Bin {
+			result.StdoutBin = stdout
+		} else {
+			result.Stdout = string(stdout)
+		}
+		if self.stderrFormat == script.Bin {
+			result.StderrBin = stderr
+		} else {
+			result.Stderr = string(stderr)
+		}
+		var err error
+		if !result.Success {
+			err = &rest.CommandExecutionError{Command: self.command, Message: result.Message}
+		}
+		self.resolve(result, err)
+	}
+}
+
+func (self *Result) startedAt() time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.started
+}
+
+// decodeOutput converts output returned with the batch results, binary
+// captures are base64 encoded by the API.
+func decodeOutput(output string, format script.CaptureFormat) []byte {
+	if format != script.Bin {
+		return []byte(output)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(output)
+	if err != nil {
+		return []byte(output)
+	}
+	return decoded
+}
+
+// fail resolves the result with `err` unless it was already resolved.
+func (self *Result) fail(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.resolved() {
+		self.resolve(nil, err)
+	}
+}
+
+func (self *Result) resolve(result *CommandResult, err error) {
+	self.result = result
+	self.err = err
+	close(self.done)
+}
+
+func (self *Result) resolved() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatch routes a command event to the result handle of its command.
+func (c *CommandContainer) dispatch(evt *event.CommandEventContext) {
+	idx := evt.Idx()
+	if idx < 0 || idx >= len(c.results) {
+		return
+	}
+	c.results[idx].handle(evt, c.startTime(idx))
+}
+
+// startTime estimates when the command at `idx` started, commands run one
+// after another, so a command starts when the previous one finishes.
+func (c *CommandContainer) startTime(idx int) time.Time {
+	started := c.sent
+	if idx > 0 {
+		if prev := c.results[idx-1]; prev.resolved() && prev.result != nil {
+			started = prev.result.Finished
+		}
+	}
+	return started
+}
+
+// deadline returns the time by which the running command has to finish,
+// which is the batch deadline unless the command has a shorter timeout.
+func (c *CommandContainer) deadline(batchDeadline time.Time) time.Time {
+	for idx, result := range c.results {
+		if result.resolved() {
+			continue
+		}
+		timeout := c.timeouts[idx]
+		if timeout == nil {
+			return batchDeadline
+		}
+		started := result.startedAt()
+		if started.IsZero() {
+			started = c.startTime(idx)
+		}
+		if cmdDeadline := started.Add(*timeout); cmdDeadline.Before(batchDeadline) {
+			return cmdDeadline
+		}
+		return batchDeadline
+	}
+	return batchDeadline
+}
+
+// fail resolves all pending results of the batch with `err`.
+func (c *CommandContainer) fail(err error) {
+	for _, result := range c.results {
+		result.fail(err)
+	}
+}
+
+// err returns the error of the first command which did not succeed.
+func (c *CommandContainer) err() error {
+	for _, result := range c.results {
+		if result.resolved() && result.err != nil {
+			return result.err
+		}
+	}
+	return nil
+}
+
+// finished reports whether every command of the batch has a result.
+func (c *CommandContainer) finished() bool {
+	for _, result := range c.results {
+		if !result.resolved() {
+			return false
+		}
+	}
+	return true
+}
+
+// isStreaming reports whether any command of the batch streams its output.
+func (c *CommandContainer) isStreaming() bool {
+	for _, cmd := range c.Commands {
+		run, ok := cmd.(*script.Run)
+		if !ok || run.Capture == nil {
+			continue
+		}
+		if run.Capture.Stdout.IsStreaming() || run.Capture.Stderr.IsStreaming() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/script"
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+func commandEvent(cls interface{}, idx int, kwargs map[string]interface{}) *event.CommandEventContext {
+	evt := &event.CommandEventContext{EvtCls: cls, Kwargs: map[string]interface{}{"cmd_idx": idx}}
+	for key, value := range kwargs {
+		evt.Kwargs[key] = value
+	}
+	return evt
+}
+
+func getResult(t *testing.T, result *Result) (*CommandResult, error) {
+	ctx, cncl := context.WithTimeout(context.Background(), time.Second)
+	defer cncl()
+	select {
+	case <-result.Done():
+	default:
+		t.Fatalf("result of %v is not resolved", result.command)
+	}
+	return result.Get(ctx)
+}
+
+func TestCommandContainerDispatch(t *testing.T) {
+	sent := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	commands := &CommandContainer{sent: sent}
+	deploy, first, second := newResult(), newResult(), newResult()
+	commands.AddCommand(&script.Deploy{}, deploy)
+	commands.AddCommand(&script.Run{EntryPoint: "/bin/echo"}, first)
+	commands.AddCommand(&script.Run{EntryPoint: "/bin/false"}, second)
+
+	deployed := sent.Add(time.Second)
+	firstDone := sent.Add(3 * time.Second)
+	secondDone := sent.Add(4 * time.Second)
+	for _, evt := range []*event.CommandEventContext{
+		commandEvent(event.CommandExecuted{}, 0, map[string]interface{}{"success": true, "event_date": deployed}),
+		commandEvent(event.CommandStdOut{}, 1, map[string]interface{}{"output": "hel"}),
+		commandEvent(event.CommandStdErr{}, 1, map[string]interface{}{"output": "warn"}),
+		commandEvent(event.CommandStdOut{}, 1, map[string]interface{}{"output": []byte("lo")}),
+		// Unknown indices are dropped.
+		commandEvent(event.CommandStdOut{}, 7, map[string]interface{}{"output": "lost"}),
+		commandEvent(event.CommandExecuted{}, 1, map[string]interface{}{"success": true, "message": "done", "event_date": firstDone}),
+		commandEvent(event.CommandExecuted{}, 2, map[string]interface{}{"success": false, "message": "exit 1",
+			"stdout": "polled", "stderr": "failed", "event_date": secondDone}),
+		// Events of a resolved command are ignored.
+		commandEvent(event.CommandStdOut{}, 1, map[string]interface{}{"output": "late"}),
+	} {
+		commands.dispatch(evt)
+	}
+	testutil.Assert(t, commands.finished(), "batch not finished")
+
+	result, err := getResult(t, deploy)
+	testutil.Ok(t, err)
+	testutil.Equals(t, &CommandResult{Idx: 0, Success: true, Started: sent, Finished: deployed}, result)
+
+	result, err = getResult(t, first)
+	testutil.Ok(t, err)
+	testutil.Equals(t, &CommandResult{Idx: 1, Success: true, Message: "done", Stdout: "hello", Stderr: "warn",
+		Started: deployed, Finished: firstDone}, result)
+	testutil.Equals(t, 2*time.Second, result.Duration())
+
+	result, err = getResult(t, second)
+	testutil.Equals(t, &rest.CommandExecutionError{Command: "run", Message: "exit 1"}, err)
+	testutil.Equals(t, &CommandResult{Idx: 2, Success: false, Message: "exit 1", Stdout: "polled", Stderr: "failed",
+		Started: firstDone, Finished: secondDone}, result)
+	testutil.Equals(t, err, commands.err())
+}
+
+func TestCommandContainerStartedEvent(t *testing.T) {
+	commands := &CommandContainer{sent: time.Now().Add(-time.Minute)}
+	run := newResult()
+	commands.AddCommand(&script.Run{EntryPoint: "/bin/echo"}, run)
+	before := time.Now()
+	commands.dispatch(commandEvent(event.CommandStarted{}, 0, nil))
+	commands.dispatch(commandEvent(event.CommandExecuted{}, 0, map[string]interface{}{"success": true}))
+	result, err := getResult(t, run)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !result.Started.Before(before), "start %v not taken from the started event", result.Started)
+	testutil.Assert(t, !result.Finished.Before(result.Started), "finished %v before started %v", result.Finished, result.Started)
+
+	// Pending results are failed with the error of the batch.
+	commands = &CommandContainer{}
+	pending := newResult()
+	commands.AddCommand(&script.Deploy{}, pending)
+	commands.fail(errCommandSkipped)
+	_, err = getResult(t, pending)
+	testutil.Equals(t, errCommandSkipped, err)
+}
+
+func TestDecodeOutput(t *testing.T) {
+	testCases := []struct {
+		Output  string
+		Format  script.CaptureFormat
+		Decoded []byte
+	}{
+		{"hello", script.Str, []byte("hello")},
+		{"aGVsbG8=", script.Str, []byte("aGVsbG8=")},
+		{"aGVsbG8=", "", []byte("aGVsbG8=")},
+		{"AAH/", script.Bin, []byte{0, 1, 255}},
+		// Output which is not base64 is kept as is.
+		{"not base64!", script.Bin, []byte("not base64!")},
+	}
+	for _, tc := range testCases {
+		testutil.Equals(t, tc.Decoded, decodeOutput(tc.Output, tc.Format))
+	}
+}
+
+func TestBinaryCapture(t *testing.T) {
+	commands := &CommandContainer{sent: time.Now()}
+	polled, streamed := newResult(), newResult()
+	polled.stdoutFormat = script.Bin
+	streamed.stdoutFormat = script.Bin
+	streamed.stderrFormat = script.Str
+	commands.AddCommand(&script.Run{EntryPoint: "/bin/cat"}, polled)
+	commands.AddCommand(&script.Run{EntryPoint: "/bin/cat"}, streamed)
+	commands.dispatch(commandEvent(event.CommandExecuted{}, 0, map[string]interface{}{
+		"success": true, "stdout": "AAH/", "stderr": "text"}))
+	commands.dispatch(commandEvent(event.CommandStdOut{}, 1, map[string]interface{}{"output": []byte{0, 1}}))
+	commands.dispatch(commandEvent(event.CommandStdOut{}, 1, map[string]interface{}{"output": []byte{255}}))
+	commands.dispatch(commandEvent(event.CommandStdErr{}, 1, map[string]interface{}{"output": "text"}))
+	commands.dispatch(commandEvent(event.CommandExecuted{}, 1, map[string]interface{}{"success": true}))
+
+	for _, handle := range []*Result{polled, streamed} {
+		result, err := getResult(t, handle)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []byte{0, 1, 255}, result.StdoutBin)
+		testutil.Equals(t, "", result.Stdout)
+		testutil.Equals(t, "text", result.Stderr)
+		testutil.Equals(t, []byte(nil), result.StderrBin)
+	}
+}
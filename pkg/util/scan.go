@@ -0,0 +1,266 @@
+package util
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/hhio618/go-golem/pkg/constraint"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/rest"
+)
+
+// FixedPriceCounter labels the fixed price in ScanSummary.Prices.
+const FixedPriceCounter props.Counter = "fixed"
+
+// ScannedOffer is an offer collected by MarketScanner.
+type ScannedOffer struct {
+	ProviderId string           `json:"provider_id"`
+	Name       string           `json:"name"`
+	Subnet     string           `json:"subnet"`
+	Runtime    string           `json:"runtime"`
+	Cores      int              `json:"cores"`
+	Memory     float32          `json:"memory_gib"`
+	Pricing    *props.ComLinear `json:"pricing,omitempty"`
+	// Err tells why the offer could not be parsed, the fields parsed before
+	// the failure are kept.
+	Err string `json:"error,omitempty"`
+}
+
+// PriceStats describes the distribution of the price of a usage counter.
+type PriceStats struct {
+	Counter props.Counter `json:"counter"`
+	Count   int           `json:"count"`
+	Min     float64       `json:"min"`
+	Max     float64       `json:"max"`
+	Mean    float64       `json:"mean"`
+	Median  float64       `json:"median"`
+}
+
+// ScanSummary summarizes the offers collected by MarketScanner.
+type ScanSummary struct {
+	// DurationSeconds is for how long the offers were collected, which is
+	// less than the requested duration for a scan cut short.
+	DurationSeconds float64        `json:"duration_seconds"`
+	Offers          []ScannedOffer `json:"offers"`
+	// Unparsed is the number of offers which could not be parsed.
+	Unparsed int `json:"unparsed"`
+	// Providers counts the providers by subnet and then by runtime.
+	Providers map[string]map[string]int `json:"providers"`
+	Prices    []PriceStats              `json:"prices"`
+	// Cores and Memory are histograms of the core count and of the memory,
+	// rounded down to whole GiB.
+	Cores  map[int]int `json:"cores"`
+	Memory map[int]int `json:"memory_gib"`
+}
+
+// MarketScanner subscribes a demand and collects the offers matching it
+// without responding to them, so that no agreement is ever made.
+type MarketScanner struct {
+	market  *rest.Market
+	builder *props.DemandBuilder
+	emitter func(interface{})
+}
+
+func NewMarketScanner(market *rest.Market, builder *props.DemandBuilder, emitter func(interface{})) *MarketScanner {
+	return &MarketScanner{
+		market:  market,
+		builder: builder,
+		emitter: emitter,
+	}
+}
+
+// Scan collects the offers for `duration`, or until `ctx` is done, and
+// summarizes them. The demand is unsubscribed afterwards.
+func (self *MarketScanner) Scan(ctx context.Context, duration time.Duration) (*ScanSummary, error) {
+	if _, err := constraint.Parse(self.builder.Constraints()); err != nil {
+		return nil, err
+	}
+	subscription, err := self.market.Subscribe(self.builder.Properties(), self.builder.Constraints())
+	if err != nil {
+		return nil, err
+	}
+	subscription.SetEmitter(self.emitter)
+	defer func() {
+		if err := subscription.Delete(); err != nil {
+			level.Debug(logger).Log("msg", "unsubscribing scan demand", "subscription", subscription.Id(), "err", err)
+		}
+	}()
+	start := time.Now()
+	scanCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	// Providers may send several offers, only the last one is kept.
+	offers := make(map[string]ScannedOffer)
+	for proposal := range subscription.Events(scanCtx) {
+		offers[proposal.Issuer()] = ParseOffer(proposal.Issuer(), proposal.Props())
+	}
+	elapsed := time.Since(start)
+	if err := subscription.Err(); err != nil {
+		return nil, err
+	}
+	scanned := make([]ScannedOffer, 0, len(offers))
+	for _, offer := range offers {
+		scanned = append(scanned, offer)
+	}
+	sort.Slice(scanned, func(i, j int) bool { return scanned[i].ProviderId < scanned[j].ProviderId })
+	summary := Summarize(scanned)
+	summary.DurationSeconds = elapsed.Seconds()
+	return summary, nil
+}
+
+// ParseOffer parses the properties of an offer with props.NodeInfo,
+// props.InfVm and props.ComLinear.
+func ParseOffer(providerId string, properties props.Props) ScannedOffer {
+	offer := ScannedOffer{ProviderId: providerId}
+	offer.Runtime, _ = properties[props.InfVmKeys[props.InfBaseRuntime]].(string)
+	nodeInfo := &props.NodeInfo{}
+	if err := props.FromProperties(properties, nodeInfo); err != nil {
+		offer.Err = err.Error()
+		return offer
+	}
+	offer.Name = nodeInfo.Name
+	offer.Subnet = nodeInfo.SubnetTag
+	infVm := &props.InfVm{}
+	if err := props.FromProperties(properties, infVm); err != nil {
+		offer.Err = err.Error()
+		return offer
+	}
+	offer.Cores = infVm.Cores
+	offer.Memory = infVm.Mem
+	// ComLinear only accepts the linear pricing model.
+	if properties[props.PRICE_MODEL] != string(props.PriceModelLINEAR) {
+		offer.Err = fmt.Sprintf("unsupported pricing model: %v", properties[props.PRICE_MODEL])
+		return offer
+	}
+	pricing := &props.ComLinear{}
+	if err := props.FromProperties(properties, pricing); err != nil {
+		offer.Err = err.Error()
+		return offer
+	}
+	offer.Pricing = pricing
+	return offer
+}
+
+// Summarize summarizes the scanned offers.
+func Summarize(offers []ScannedOffer) *ScanSummary {
+	summary := &ScanSummary{
+		Offers:    offers,
+		Providers: make(map[string]map[string]int),
+		Prices:    make([]PriceStats, 0),
+		Cores:     make(map[int]int),
+		Memory:    make(map[int]int),
+	}
+	prices := make(map[props.Counter][]float64)
+	for _, offer := range offers {
+		if summary.Providers[offer.Subnet] == nil {
+			summary.Providers[offer.Subnet] = make(map[string]int)
+		}
+		summary.Providers[offer.Subnet][offer.Runtime]++
+		if offer.Err != "" {
+			summary.Unparsed++
+			continue
+		}
+		summary.Cores[offer.Cores]++
+		summary.Memory[int(math.Floor(float64(offer.Memory)))]++
+		prices[FixedPriceCounter] = append(prices[FixedPriceCounter], float64(offer.Pricing.FixedPrice))
+		for counter, price := range offer.Pricing.PriceFor {
+			prices[counter] = append(prices[counter], float64(price))
+		}
+	}
+	for counter, values := range prices {
+		summary.Prices = append(summary.Prices, priceStats(counter, values))
+	}
+	sort.Slice(summary.Prices, func(i, j int) bool { return summary.Prices[i].Counter < summary.Prices[j].Counter })
+	return summary
+}
+
+func priceStats(counter props.Counter, values []float64) PriceStats {
+	sort.Float64s(values)
+	stats := PriceStats{
+		Counter: counter,
+		Count:   len(values),
+		Min:     values[0],
+		Max:     values[len(values)-1],
+	}
+	for _, value := range values {
+		stats.Mean += value
+	}
+	stats.Mean /= float64(len(values))
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		stats.Median = (values[middle-1] + values[middle]) / 2
+	} else {
+		stats.Median = values[middle]
+	}
+	return stats
+}
+
+// WriteJSON writes the summary as JSON.
+func (self *ScanSummary) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(self)
+}
+
+// WriteCSV writes the summary as CSV rows of metric, label and value.
+func (self *ScanSummary) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	rows := [][]string{{"metric", "label", "value"}}
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	rows = append(rows, []string{"duration_seconds", "", formatFloat(self.DurationSeconds)})
+	rows = append(rows, []string{"offers", "", strconv.Itoa(len(self.Offers))})
+	rows = append(rows, []string{"unparsed", "", strconv.Itoa(self.Unparsed)})
+	subnets := make([]string, 0, len(self.Providers))
+	for subnet := range self.Providers {
+		subnets = append(subnets, subnet)
+	}
+	sort.Strings(subnets)
+	for _, subnet := range subnets {
+		runtimes := make([]string, 0, len(self.Providers[subnet]))
+		for runtime := range self.Providers[subnet] {
+			runtimes = append(runtimes, runtime)
+		}
+		sort.Strings(runtimes)
+		for _, runtime := range runtimes {
+			rows = append(rows, []string{"providers", subnet + "/" + runtime, strconv.Itoa(self.Providers[subnet][runtime])})
+		}
+	}
+	for _, stats := range self.Prices {
+		counter := string(stats.Counter)
+		rows = append(rows,
+			[]string{"price_count", counter, strconv.Itoa(stats.Count)},
+			[]string{"price_min", counter, formatFloat(stats.Min)},
+			[]string{"price_max", counter, formatFloat(stats.Max)},
+			[]string{"price_mean", counter, formatFloat(stats.Mean)},
+			[]string{"price_median", counter, formatFloat(stats.Median)},
+		)
+	}
+	for _, cores := range sortedInts(self.Cores) {
+		rows = append(rows, []string{"cores", strconv.Itoa(cores), strconv.Itoa(self.Cores[cores])})
+	}
+	for _, memory := range sortedInts(self.Memory) {
+		rows = append(rows, []string{"memory_gib", strconv.Itoa(memory), strconv.Itoa(self.Memory[memory])})
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+func sortedInts(m map[int]int) []int {
+	keys := make([]int, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
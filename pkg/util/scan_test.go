@@ -0,0 +1,85 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+func testOffer(subnet string, cores, mem float64, coeffs ...interface{}) props.Props {
+	return props.Props{
+		"golem.node.id.name":                    "node",
+		"golem.node.debug.subnet":               subnet,
+		"golem.runtime.name":                    "vm",
+		"golem.inf.cpu.cores":                   cores,
+		"golem.inf.mem.gib":                     mem,
+		"golem.activity.caps.transfer.protocol": []interface{}{"http", "gftp"},
+		"golem.com.scheme":                      "payu",
+		"golem.com.pricing.model":               "linear",
+		"golem.com.pricing.model.linear.coeffs": coeffs,
+		"golem.com.usage.vector":                []interface{}{"golem.usage.cpu_sec", "golem.usage.duration_sec"},
+	}
+}
+
+func TestScanSummary(t *testing.T) {
+	offers := []ScannedOffer{
+		ParseOffer("a", testOffer("public", 4, 8.5, 0.1, 0.01, 0.0)),
+		ParseOffer("b", testOffer("public", 8, 16, 0.3, 0.02, 0.5)),
+		ParseOffer("c", testOffer("devnet", 4, 8, 0.2, 0.03, 0.0)),
+		ParseOffer("d", props.Props{"golem.node.debug.subnet": "public", "golem.runtime.name": "wasmtime"}),
+	}
+	testutil.Equals(t, "", offers[0].Err)
+	testutil.Equals(t, 4, offers[0].Cores)
+	testutil.Assert(t, offers[3].Err != "", "offer without properties parsed")
+
+	summary := Summarize(offers)
+	testutil.Equals(t, 1, summary.Unparsed)
+	testutil.Equals(t, map[string]map[string]int{
+		"public": {"vm": 2, "wasmtime": 1},
+		"devnet": {"vm": 1},
+	}, summary.Providers)
+	testutil.Equals(t, map[int]int{4: 2, 8: 1}, summary.Cores)
+	testutil.Equals(t, map[int]int{8: 2, 16: 1}, summary.Memory)
+	testutil.Equals(t, []PriceStats{
+		{Counter: FixedPriceCounter, Count: 3, Min: 0, Max: 0.5, Mean: 0.5 / 3, Median: 0},
+		{Counter: props.CounterCPU, Count: 3, Min: float64(float32(0.1)), Max: float64(float32(0.3)), Mean: (float64(float32(0.1)) + float64(float32(0.2)) + float64(float32(0.3))) / 3, Median: float64(float32(0.2))},
+		{Counter: props.CounterTIME, Count: 3, Min: float64(float32(0.01)), Max: float64(float32(0.03)), Mean: (float64(float32(0.01)) + float64(float32(0.02)) + float64(float32(0.03))) / 3, Median: float64(float32(0.02))},
+	}, summary.Prices)
+
+	summary.DurationSeconds = 90
+	buf := &bytes.Buffer{}
+	testutil.Ok(t, summary.WriteJSON(buf))
+	testutil.Assert(t, strings.Contains(buf.String(), `"duration_seconds": 90`), "duration not in seconds:\n%s", buf.String())
+	decoded := &ScanSummary{}
+	testutil.Ok(t, json.Unmarshal(buf.Bytes(), decoded))
+	testutil.Equals(t, summary.Cores, decoded.Cores)
+
+	buf.Reset()
+	testutil.Ok(t, summary.WriteCSV(buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	testutil.Equals(t, "metric,label,value", lines[0])
+	testutil.Equals(t, "duration_seconds,,90", lines[1])
+	testutil.Assert(t, strings.Contains(buf.String(), "providers,public/wasmtime,1\n"), "missing provider count:\n%s", buf.String())
+	testutil.Assert(t, strings.Contains(buf.String(), "cores,4,2\n"), "missing core histogram:\n%s", buf.String())
+}
+
+func TestScanDuration(t *testing.T) {
+	market, api := newFakeMarket(t, func(demand int, collects int) int {
+		return http.StatusOK
+	})
+	ctx, cncl := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cncl()
+	summary, err := NewMarketScanner(api, props.NewDemandBuilder(), nil).Scan(ctx, time.Minute)
+	testutil.Ok(t, err)
+	// A scan cut short reports for how long it collected offers.
+	testutil.Assert(t, summary.DurationSeconds > 0 && summary.DurationSeconds < 10,
+		"scan of %vs reported", summary.DurationSeconds)
+	testutil.Assert(t, market.Demands()[0].deleted, "scan demand not unsubscribed")
+}
@@ -0,0 +1,224 @@
+package util
+
+import (
+	"math/rand"
+	"time"
+)
+
+// AgreementCandidate describes an idle agreement which can be reused.
+type AgreementCandidate struct {
+	AgreementId string
+	ProviderId  string
+	Score       float32
+}
+
+// ProposalCandidate describes a buffered proposal an agreement can be made
+// from.
+type ProposalCandidate struct {
+	ProviderId string
+	Score      float32
+	Received   time.Time
+}
+
+// SelectionPolicy decides which agreement AgreementPool hands out. The
+// candidates are sorted by id and never empty, `key` is the affinity key
+// passed to UseAgreementFor. Calls are serialized by the pool.
+type SelectionPolicy interface {
+	// SelectAgreement returns the index of the agreement to reuse, or -1 to
+	// make a new agreement instead.
+	SelectAgreement(agreements []AgreementCandidate, key string) int
+	// SelectProposal returns the index of the proposal to make an agreement
+	// from, or -1 to wait for another one.
+	SelectProposal(proposals []ProposalCandidate, key string) int
+}
+
+func newRand(rnd *rand.Rand) *rand.Rand {
+	if rnd == nil {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return rnd
+}
+
+// HighestScorePolicy picks a random candidate among the top-score ones.
+type HighestScorePolicy struct {
+	rnd *rand.Rand
+}
+
+// NewHighestScorePolicy returns a HighestScorePolicy breaking ties with
+// `rnd`, a time-seeded source is used if it is nil.
+func NewHighestScorePolicy(rnd *rand.Rand) *HighestScorePolicy {
+	return &HighestScorePolicy{rnd: newRand(rnd)}
+}
+
+func (self *HighestScorePolicy) SelectAgreement(agreements []AgreementCandidate, key string) int {
+	scores := make([]float32, len(agreements))
+	for i, candidate := range agreements {
+		scores[i] = candidate.Score
+	}
+	return self.highest(scores)
+}
+
+func (self *HighestScorePolicy) SelectProposal(proposals []ProposalCandidate, key string) int {
+	scores := make([]float32, len(proposals))
+	for i, candidate := range proposals {
+		scores[i] = candidate.Score
+	}
+	return self.highest(scores)
+}
+
+func (self *HighestScorePolicy) highest(scores []float32) int {
+	best := make([]int, 0)
+	for i, score := range scores {
+		if len(best) > 0 && score < scores[best[0]] {
+			continue
+		}
+		if len(best) > 0 && score > scores[best[0]] {
+			best = best[:0]
+		}
+		best = append(best, i)
+	}
+	return best[self.rnd.Intn(len(best))]
+}
+
+// RoundRobinPolicy spreads the work across providers by picking the
+// candidate whose provider was selected least recently.
+type RoundRobinPolicy struct {
+	seq      int
+	lastUsed map[string]int
+}
+
+func NewRoundRobinPolicy() *RoundRobinPolicy {
+	return &RoundRobinPolicy{lastUsed: make(map[string]int)}
+}
+
+func (self *RoundRobinPolicy) SelectAgreement(agreements []AgreementCandidate, key string) int {
+	providers := make([]string, len(agreements))
+	for i, candidate := range agreements {
+		providers[i] = candidate.ProviderId
+	}
+	return self.next(providers)
+}
+
+func (self *RoundRobinPolicy) SelectProposal(proposals []ProposalCandidate, key string) int {
+	providers := make([]string, len(proposals))
+	for i, candidate := range proposals {
+		providers[i] = candidate.ProviderId
+	}
+	return self.next(providers)
+}
+
+func (self *RoundRobinPolicy) next(providers []string) int {
+	selected := 0
+	for i, providerId := range providers {
+		if self.lastUsed[providerId] < self.lastUsed[providers[selected]] {
+			selected = i
+		}
+	}
+	self.seq++
+	self.lastUsed[providers[selected]] = self.seq
+	return selected
+}
+
+// StickyPolicy keeps sending the work with the same affinity key to the
+// provider it was first sent to, as long as that provider's agreement is
+// idle. Other selections are delegated to the fallback policy.
+type StickyPolicy struct {
+	fallback  SelectionPolicy
+	providers map[string]string
+}
+
+func NewStickyPolicy(fallback SelectionPolicy) *StickyPolicy {
+	return &StickyPolicy{
+		fallback:  fallback,
+		providers: make(map[string]string),
+	}
+}
+
+func (self *StickyPolicy) SelectAgreement(agreements []AgreementCandidate, key string) int {
+	if providerId, ok := self.providers[key]; ok && key != "" {
+		for i, candidate := range agreements {
+			if candidate.ProviderId == providerId {
+				return i
+			}
+		}
+	}
+	selected := self.fallback.SelectAgreement(agreements, key)
+	if selected >= 0 {
+		self.bind(key, agreements[selected].ProviderId)
+	}
+	return selected
+}
+
+func (self *StickyPolicy) SelectProposal(proposals []ProposalCandidate, key string) int {
+	selected := self.fallback.SelectProposal(proposals, key)
+	if selected >= 0 {
+		self.bind(key, proposals[selected].ProviderId)
+	}
+	return selected
+}
+
+func (self *StickyPolicy) bind(key, providerId string) {
+	if key == "" {
+		return
+	}
+	if _, ok := self.providers[key]; !ok {
+		self.providers[key] = providerId
+	}
+}
+
+// WeightedRandomPolicy picks a candidate with a probability proportional to
+// its score, non-positive scores are never picked unless all of them are.
+type WeightedRandomPolicy struct {
+	rnd *rand.Rand
+}
+
+// NewWeightedRandomPolicy returns a WeightedRandomPolicy drawing from `rnd`,
+// a time-seeded source is used if it is nil.
+func NewWeightedRandomPolicy(rnd *rand.Rand) *WeightedRandomPolicy {
+	return &WeightedRandomPolicy{rnd: newRand(rnd)}
+}
+
+func (self *WeightedRandomPolicy) SelectAgreement(agreements []AgreementCandidate, key string) int {
+	scores := make([]float32, len(agreements))
+	for i, candidate := range agreements {
+		scores[i] = candidate.Score
+	}
+	return self.draw(scores)
+}
+
+func (self *WeightedRandomPolicy) SelectProposal(proposals []ProposalCandidate, key string) int {
+	scores := make([]float32, len(proposals))
+	for i, candidate := range proposals {
+		scores[i] = candidate.Score
+	}
+	return self.draw(scores)
+}
+
+func (self *WeightedRandomPolicy) draw(scores []float32) int {
+	total := 0.0
+	for _, score := range scores {
+		if score > 0 {
+			total += float64(score)
+		}
+	}
+	if total == 0 {
+		return self.rnd.Intn(len(scores))
+	}
+	point := self.rnd.Float64() * total
+	for i, score := range scores {
+		if score <= 0 {
+			continue
+		}
+		point -= float64(score)
+		if point < 0 {
+			return i
+		}
+	}
+	// Rounding may leave the point at the very end of the range.
+	for i := len(scores) - 1; i >= 0; i-- {
+		if scores[i] > 0 {
+			return i
+		}
+	}
+	return 0
+}
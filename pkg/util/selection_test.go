@@ -0,0 +1,112 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/testutil"
+)
+
+func testProposals(scores ...float32) []ProposalCandidate {
+	proposals := make([]ProposalCandidate, len(scores))
+	for i, score := range scores {
+		proposals[i] = ProposalCandidate{ProviderId: string(rune('a' + i)), Score: score}
+	}
+	return proposals
+}
+
+func testAgreements(providers ...string) []AgreementCandidate {
+	agreements := make([]AgreementCandidate, len(providers))
+	for i, providerId := range providers {
+		agreements[i] = AgreementCandidate{AgreementId: providerId, ProviderId: providerId, Score: 1}
+	}
+	return agreements
+}
+
+func TestHighestScorePolicy(t *testing.T) {
+	policy := NewHighestScorePolicy(rand.New(rand.NewSource(1)))
+	proposals := testProposals(1, 3, 2, 3)
+	picked := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		picked[policy.SelectProposal(proposals, "")]++
+	}
+	testutil.Equals(t, 2, len(picked))
+	testutil.Assert(t, picked[1] > 0 && picked[3] > 0, "ties not broken randomly: %v", picked)
+
+	// The same seed gives the same choices.
+	first := NewHighestScorePolicy(rand.New(rand.NewSource(7)))
+	second := NewHighestScorePolicy(rand.New(rand.NewSource(7)))
+	for i := 0; i < 10; i++ {
+		testutil.Equals(t, first.SelectProposal(proposals, ""), second.SelectProposal(proposals, ""))
+	}
+}
+
+func TestRoundRobinPolicy(t *testing.T) {
+	policy := NewRoundRobinPolicy()
+	agreements := testAgreements("a", "b", "c")
+	picked := make([]int, 0)
+	for i := 0; i < 6; i++ {
+		picked = append(picked, policy.SelectAgreement(agreements, ""))
+	}
+	testutil.Equals(t, []int{0, 1, 2, 0, 1, 2}, picked)
+
+	// A new provider is picked before the ones used already.
+	agreements = testAgreements("a", "b", "c", "d")
+	testutil.Equals(t, 3, policy.SelectAgreement(agreements, ""))
+}
+
+func TestStickyPolicy(t *testing.T) {
+	policy := NewStickyPolicy(NewRoundRobinPolicy())
+	agreements := testAgreements("a", "b", "c")
+	testutil.Equals(t, 0, policy.SelectAgreement(agreements, "task-1"))
+	testutil.Equals(t, 1, policy.SelectAgreement(agreements, "task-2"))
+	for i := 0; i < 3; i++ {
+		testutil.Equals(t, 0, policy.SelectAgreement(agreements, "task-1"))
+		testutil.Equals(t, 1, policy.SelectAgreement(agreements, "task-2"))
+	}
+	// Falls back while the bound provider is busy.
+	testutil.Equals(t, 1, policy.SelectAgreement(testAgreements("b", "c"), "task-1"))
+	testutil.Equals(t, 0, policy.SelectAgreement(agreements, "task-1"))
+}
+
+func TestWeightedRandomPolicy(t *testing.T) {
+	policy := NewWeightedRandomPolicy(rand.New(rand.NewSource(1)))
+	proposals := testProposals(1, 3, 0, -1)
+	picked := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		picked[policy.SelectProposal(proposals, "")]++
+	}
+	testutil.Equals(t, 0, picked[2])
+	testutil.Equals(t, 0, picked[3])
+	testutil.Assert(t, picked[1] > 2*picked[0], "draws not weighted by score: %v", picked)
+
+	// Uniform when no score is positive.
+	picked = make(map[int]int)
+	for i := 0; i < 100; i++ {
+		picked[policy.SelectProposal(testProposals(0, -1), "")]++
+	}
+	testutil.Equals(t, 2, len(picked))
+}
+
+func TestAgreementPoolAffinity(t *testing.T) {
+	pool := newTestPool(3, nil)
+	pool.SetSelectionPolicy(NewStickyPolicy(NewHighestScorePolicy(rand.New(rand.NewSource(1)))))
+	use := func(key string) string {
+		var provider string
+		task, err := pool.UseAgreementFor(context.Background(), key, func(agreement *rest.Agreement, nodeInfo *props.NodeInfo) Task {
+			provider = nodeInfo.Name
+			return newTestTask()
+		})
+		testutil.Ok(t, err)
+		task.(*testTask).finish(nil)
+		pool.Cycle()
+		return provider
+	}
+	first := use("task-1")
+	for i := 0; i < 5; i++ {
+		testutil.Equals(t, first, use("task-1"))
+	}
+}
@@ -0,0 +1,171 @@
+package util
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hhio618/go-golem/pkg/script"
+)
+
+// SignatureError is returned for a batch whose signed script and results do
+// not match the signature of the provider, the script which was sent or the
+// results which were received.
+type SignatureError struct {
+	Reason string
+}
+
+func (s *SignatureError) Error() string {
+	return fmt.Sprintf("invalid script signature: %v", s.Reason)
+}
+
+// SignedScript is the stdout of the sign command. Output is the exe script of
+// the batch as executed by the exe-unit and Results the outputs of its
+// commands preceding the sign command. Signature is the hex encoded signature
+// over their digest, see ScriptDigest, and PubKey the hex encoded key of the
+// signer.
+type SignedScript struct {
+	Output    string          `json:"output"`
+	Results   json.RawMessage `json:"results"`
+	PubKey    string          `json:"pubKey"`
+	Signature string          `json:"signature"`
+}
+
+// SignedResult is the output of a command as signed by the exe-unit.
+type SignedResult struct {
+	Index  int    `json:"index"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+// ScriptDigest returns the digest which the exe-unit signs: the SHA-256 of
+// the `output` of the sign command followed by its `results`, as returned.
+func ScriptDigest(output string, results []byte) []byte {
+	digest := sha256.New()
+	digest.Write([]byte(output))
+	digest.Write(results)
+	return digest.Sum(nil)
+}
+
+// VerifyScript checks the `stdout` of the sign command against the provider's
+// ed25519 `publicKey`, that the signed script is `exeScript` and that the
+// signed outputs are the `results` received for the commands preceding the
+// sign command.
+func VerifyScript(publicKey ed25519.PublicKey, exeScript script.Script, results []CommandResult, stdout string) error {
+	signed := &SignedScript{}
+	if err := json.Unmarshal([]byte(stdout), signed); err != nil {
+		return &SignatureError{Reason: fmt.Sprintf("decoding sign output: %v", err)}
+	}
+	if signed.PubKey != "" && !strings.EqualFold(signed.PubKey, hex.EncodeToString(publicKey)) {
+		return &SignatureError{Reason: "signed with a key other than the one of the offer"}
+	}
+	sig, err := hex.DecodeString(strings.TrimSpace(signed.Signature))
+	if err != nil {
+		return &SignatureError{Reason: fmt.Sprintf("decoding signature: %v", err)}
+	}
+	if !ed25519.Verify(publicKey, ScriptDigest(signed.Output, signed.Results), sig) {
+		return &SignatureError{Reason: "signature does not match the script"}
+	}
+	sent, err := json.Marshal(exeScript)
+	if err != nil {
+		return err
+	}
+	var expected, executed interface{}
+	if err := json.Unmarshal(sent, &expected); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(signed.Output), &executed); err != nil {
+		return &SignatureError{Reason: fmt.Sprintf("decoding signed script: %v", err)}
+	}
+	if !reflect.DeepEqual(expected, executed) {
+		return &SignatureError{Reason: "signed script differs from the script sent"}
+	}
+	var signedResults []SignedResult
+	if len(signed.Results) > 0 {
+		if err := json.Unmarshal(signed.Results, &signedResults); err != nil {
+			return &SignatureError{Reason: fmt.Sprintf("decoding signed results: %v", err)}
+		}
+	}
+	if len(signedResults) != len(results) {
+		return &SignatureError{Reason: fmt.Sprintf("signed %d results, received %d", len(signedResults), len(results))}
+	}
+	for i, result := range results {
+		received := SignedResult{Index: i, Stdout: result.Stdout, Stderr: result.Stderr}
+		if result.StdoutBin != nil {
+			received.Stdout = string(result.StdoutBin)
+		}
+		if result.StderrBin != nil {
+			received.Stderr = string(result.StderrBin)
+		}
+		if signedResults[i] != received {
+			return &SignatureError{Reason: fmt.Sprintf("result of command %d differs from the signed one", i)}
+		}
+	}
+	return nil
+}
+
+func parsePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	if publicKey == "" {
+		return nil, fmt.Errorf("provider did not publish a public key")
+	}
+	key, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("decoding public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size: %v", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// signStep appends the sign command to a batch and verifies its signature
+// over the script and the results of the batch.
+type signStep struct {
+	work
+	publicKey ed25519.PublicKey
+	commands  *CommandContainer
+	result    *Result
+}
+
+func newSignStep(publicKey ed25519.PublicKey) *signStep {
+	return &signStep{
+		publicKey: publicKey,
+		result:    newResult(),
+	}
+}
+
+func (self *signStep) handles() []*Result {
+	return []*Result{self.result}
+}
+
+func (self *signStep) Register(commands *CommandContainer) error {
+	self.commands = commands
+	commands.AddCommand(&script.Sign{}, self.result)
+	return nil
+}
+
+func (self *signStep) Post(ctx context.Context) error {
+	sign, err := self.result.Get(ctx)
+	if err != nil {
+		return err
+	}
+	stdout := sign.Stdout
+	if stdout == "" {
+		stdout = sign.Message
+	}
+	// The results of the commands preceding the sign command.
+	results := make([]CommandResult, 0, len(self.commands.results)-1)
+	for _, result := range self.commands.results[:len(self.commands.results)-1] {
+		executed, err := result.Get(ctx)
+		if err != nil {
+			return err
+		}
+		results = append(results, *executed)
+	}
+	return VerifyScript(self.publicKey, self.commands.Commands, results, stdout)
+}
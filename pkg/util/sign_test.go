@@ -0,0 +1,164 @@
+package util
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhio618/go-golem/pkg/script"
+	"github.com/hhio618/go-golem/pkg/testutil"
+	activity "github.com/hhio618/ya-go-client/ya-activity"
+)
+
+// testKey is the fixed key of the provider signing the scripts.
+var testKey = ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef"))
+
+func testPublicKey() ed25519.PublicKey {
+	return testKey.Public().(ed25519.PublicKey)
+}
+
+// signScript returns the stdout of the sign command for `output` and the
+// stdouts of the preceding commands.
+func signScript(key ed25519.PrivateKey, output string, stdouts ...string) string {
+	results := make([]SignedResult, len(stdouts))
+	for i, stdout := range stdouts {
+		results[i] = SignedResult{Index: i, Stdout: stdout}
+	}
+	signedResults, _ := json.Marshal(results)
+	signed, _ := json.Marshal(&SignedScript{
+		Output:    output,
+		Results:   signedResults,
+		PubKey:    hex.EncodeToString(key.Public().(ed25519.PublicKey)),
+		Signature: hex.EncodeToString(ed25519.Sign(key, ScriptDigest(output, signedResults))),
+	})
+	return string(signed)
+}
+
+func TestVerifyScript(t *testing.T) {
+	exeScript := script.Script{&script.Deploy{}, &script.Start{}, &script.Sign{}}
+	sent, err := json.Marshal(exeScript)
+	testutil.Ok(t, err)
+	output := string(sent)
+	otherKey := ed25519.NewKeyFromSeed([]byte("fedcba9876543210fedcba9876543210"))
+	signed := &SignedScript{}
+	testutil.Ok(t, json.Unmarshal([]byte(signScript(testKey, output, "deployed", "started")), signed))
+	tampered := *signed
+	tampered.Output = strings.Replace(output, "deploy", "start", 1)
+	tamperedStdout, _ := json.Marshal(&tampered)
+	tamperedResults := *signed
+	tamperedResults.Results = json.RawMessage(strings.Replace(string(signed.Results), "started", "faked", 1))
+	tamperedResultsStdout, _ := json.Marshal(&tamperedResults)
+	resigned := *signed
+	resigned.PubKey = ""
+	resignedStdout, _ := json.Marshal(&resigned)
+	received := []CommandResult{{Stdout: "deployed"}, {Stdout: "started"}}
+
+	testCases := []struct {
+		Name     string
+		Stdout   string
+		Received []CommandResult
+		Err      string
+	}{
+		{"valid", signScript(testKey, output, "deployed", "started"), received, ""},
+		{"no public key", string(resignedStdout), received, ""},
+		{"reformatted script", signScript(testKey, " "+output+"\n", "deployed", "started"), received, ""},
+		{"binary output", signScript(testKey, output, "deployed", "started"),
+			[]CommandResult{{Stdout: "deployed"}, {StdoutBin: []byte("started")}}, ""},
+		{"tampered script", string(tamperedStdout), received, "signature does not match the script"},
+		{"tampered signed results", string(tamperedResultsStdout), received, "signature does not match the script"},
+		{"tampered stdout", signScript(testKey, output, "deployed", "started"),
+			[]CommandResult{{Stdout: "deployed"}, {Stdout: "faked"}}, "result of command 1 differs from the signed one"},
+		{"missing result", signScript(testKey, output, "deployed"), received, "signed 1 results, received 2"},
+		{"other script", signScript(testKey, `[{"deploy":{}}]`, "deployed", "started"), received, "signed script differs from the script sent"},
+		{"other key", signScript(otherKey, output, "deployed", "started"), received, "signed with a key other than the one of the offer"},
+		{"not hex", `{"output":"[]","signature":"xyz"}`, received, "decoding signature: encoding/hex: invalid byte: U+0078 'x'"},
+		{"not json", "0a1b2c", received, "decoding sign output: invalid character 'a' after top-level value"},
+	}
+	for _, tc := range testCases {
+		err := VerifyScript(testPublicKey(), exeScript, tc.Received, tc.Stdout)
+		if tc.Err == "" {
+			testutil.Assert(t, err == nil, "%v: unexpected error %v", tc.Name, err)
+			continue
+		}
+		testutil.Equals(t, &SignatureError{Reason: tc.Err}, err)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	publicKey := testPublicKey()
+	key, err := parsePublicKey(hex.EncodeToString(publicKey))
+	testutil.Ok(t, err)
+	testutil.Equals(t, publicKey, key)
+
+	for publicKey, expected := range map[string]string{
+		"":                          "provider did not publish a public key",
+		"not a key":                 "decoding public key: encoding/hex: invalid byte: U+006E 'n'",
+		hex.EncodeToString(key[1:]): "invalid public key size: 31",
+	} {
+		_, err := parsePublicKey(publicKey)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, expected, err.Error())
+	}
+}
+
+func TestSignedBatch(t *testing.T) {
+	api := newFakeActivityApi(t)
+	key := testKey
+	stdout, signedStdout := "hello\n", "hello\n"
+	api.results = func(batch *fakeBatch) []activity.ExeScriptCommandResult {
+		results := okResults(batch)
+		// The run command, last before the sign command, prints the stdout.
+		stdouts := make([]string, len(results)-1)
+		stdouts[len(stdouts)-1] = signedStdout
+		results[len(stdouts)-1].Stdout = &stdout
+		output, _ := json.Marshal(batch.Script)
+		sign := signScript(key, string(output), stdouts...)
+		results[len(results)-1].Stdout = &sign
+		return results
+	}
+	wctx := newTestWorkContext(t, api, nil)
+	wctx.nodeInfo.PublicKey = hex.EncodeToString(testPublicKey())
+	testutil.Ok(t, wctx.EnableSigning())
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+
+	result := wctx.Run("/bin/echo", []string{"hello"}, nil, nil)
+	testutil.Ok(t, wctx.Commit(ctx, time.Minute))
+	testutil.Equals(t, [][]string{{"deploy", "start", "run", "sign"}}, api.Scripts())
+	executed, err := result.Get(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hello\n", executed.Stdout)
+
+	// An output other than the signed one fails the batch.
+	stdout = "faked\n"
+	wctx.Run("/bin/echo", []string{"hello"}, nil, nil)
+	err = wctx.Commit(ctx, time.Minute)
+	var invalid *SignatureError
+	testutil.Assert(t, errors.As(err, &invalid), "expected a signature error, got %v", err)
+	testutil.Equals(t, "result of command 0 differs from the signed one", invalid.Reason)
+
+	// As does a provider signing with another key.
+	stdout = signedStdout
+	key = ed25519.NewKeyFromSeed([]byte("fedcba9876543210fedcba9876543210"))
+	wctx.Run("/bin/echo", []string{"hello"}, nil, nil)
+	err = wctx.Commit(ctx, time.Minute)
+	testutil.Assert(t, errors.As(err, &invalid), "expected a signature error, got %v", err)
+	testutil.Equals(t, "signed with a key other than the one of the offer", invalid.Reason)
+}
+
+func TestEnableSigningWithoutNodeInfo(t *testing.T) {
+	wctx := NewWorkContext("activity", nil, nil, nil)
+	testutil.Equals(t, "provider did not publish a public key", wctx.EnableSigning().Error())
+
+	executor := NewExecutor(acceptResult(nil), nil, 0, nil)
+	executor.SetSigning(true)
+	executor.Submit("task")
+	err := executor.RunAgreement(testContext(t), newFakeActivityApi(t).service(), &AgreementInfo{Id: "agr"})
+	testutil.Equals(t, "provider did not publish a public key", err.Error())
+	testutil.Equals(t, 1, executor.Pending())
+}
@@ -0,0 +1,145 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/hhio618/go-golem/pkg/constraint"
+	"github.com/hhio618/go-golem/pkg/event"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/pkg/errors"
+)
+
+const (
+	demandExpirationDefault  = 30 * time.Minute
+	demandRenewMarginDefault = 2 * time.Minute
+	resubscribeDelayDefault  = 5 * time.Second
+)
+
+// DemandSubscriber keeps a demand subscribed on the market. Shortly before
+// the demand expires it is subscribed again with a refreshed expiration, the
+// old demand is left to expire so that the proposals buffered from it stay
+// valid in the AgreementPool. When the subscription dies for another reason,
+// because the market lost it or collecting keeps failing, the old demand is
+// unsubscribed before subscribing again.
+type DemandSubscriber struct {
+	market      *rest.Market
+	builder     *props.DemandBuilder
+	emitter     func(interface{})
+	expiration  time.Duration
+	renewMargin time.Duration
+	retryDelay  time.Duration
+	tag         string
+}
+
+func NewDemandSubscriber(market *rest.Market, builder *props.DemandBuilder, emitter func(interface{})) *DemandSubscriber {
+	return &DemandSubscriber{
+		market:      market,
+		builder:     builder,
+		emitter:     emitter,
+		expiration:  demandExpirationDefault,
+		renewMargin: demandRenewMarginDefault,
+		retryDelay:  resubscribeDelayDefault,
+	}
+}
+
+// SetExpiration sets for how long each subscription of the demand is valid.
+func (self *DemandSubscriber) SetExpiration(expiration time.Duration) {
+	self.expiration = expiration
+}
+
+// SetRenewMargin sets how long before its expiration the demand is
+// subscribed again, at most half of the expiration is used.
+func (self *DemandSubscriber) SetRenewMargin(margin time.Duration) {
+	self.renewMargin = margin
+}
+
+// SetAppTag sets the value of the AppTagProperty added to the demand, which
+// lets StaleCleanup find the demands left behind by crashed runs.
+func (self *DemandSubscriber) SetAppTag(tag string) {
+	self.tag = tag
+}
+
+// SetRetryDelay sets the delay between failed attempts to subscribe or to
+// collect offers.
+func (self *DemandSubscriber) SetRetryDelay(delay time.Duration) {
+	self.retryDelay = delay
+}
+
+func (self *DemandSubscriber) emit(evt interface{}) {
+	if self.emitter != nil {
+		self.emitter(evt)
+	}
+}
+
+// Run subscribes the demand and passes its offers to `handler` until `ctx` is
+// done or the current subscription is closed.
+func (self *DemandSubscriber) Run(ctx context.Context, handler func(*rest.OfferProposal)) error {
+	for {
+		subscription, err := self.subscribe()
+		if err != nil {
+			level.Warn(logger).Log("msg", "subscribing demand", "err", err)
+			self.emit(&event.SubscriptionFailed{Reason: err.Error()})
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(self.retryDelay):
+			}
+			continue
+		}
+		self.emit(&event.SubscriptionCreated{SubId: subscription.Id()})
+		for proposal := range subscription.Events(ctx) {
+			handler(proposal)
+		}
+		if err := ctx.Err(); err != nil {
+			if err := subscription.Delete(); err != nil {
+				level.Debug(logger).Log("msg", "unsubscribing demand", "subscription", subscription.Id(), "err", err)
+			}
+			return err
+		}
+		reason := subscription.Err()
+		if reason == nil {
+			// Closed by the caller.
+			return nil
+		}
+		if errors.Cause(reason) != rest.ErrSubscriptionExpired {
+			if err := subscription.Delete(); err != nil {
+				level.Debug(logger).Log("msg", "unsubscribing demand", "subscription", subscription.Id(), "err", err)
+			}
+		}
+		level.Info(logger).Log("msg", "resubscribing demand", "subscription", subscription.Id(), "reason", reason)
+	}
+}
+
+// subscribe subscribes the demand with its expiration set from now, the
+// subscription stops collecting the renew margin before the expiration.
+func (self *DemandSubscriber) subscribe() (*rest.Subscription, error) {
+	// Malformed constraints would only be reported by the market as a
+	// failed subscription.
+	if _, err := constraint.Parse(self.builder.Constraints()); err != nil {
+		return nil, err
+	}
+	expiration := time.Now().Add(self.expiration)
+	properties := props.Props{}
+	for key, value := range self.builder.Properties() {
+		properties[key] = value
+	}
+	properties[props.ActivityKeys[props.ActivityExpiration]] = expiration.UnixNano() / int64(time.Millisecond)
+	if self.tag != "" {
+		properties[AppTagProperty] = self.tag
+	}
+	subscription, err := self.market.Subscribe(properties, self.builder.Constraints())
+	if err != nil {
+		return nil, err
+	}
+	margin := self.renewMargin
+	if margin > self.expiration/2 {
+		margin = self.expiration / 2
+	}
+	subscription.SetEmitter(self.emitter)
+	subscription.SetExpiration(expiration.Add(-margin))
+	subscription.SetRetryDelay(self.retryDelay)
+	return subscription, nil
+}
@@ -0,0 +1,178 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hhio618/go-golem/pkg/props"
+	"github.com/hhio618/go-golem/pkg/rest"
+	"github.com/hhio618/go-golem/pkg/testutil"
+	yam "github.com/hhio618/ya-go-client/ya-market"
+)
+
+// fakeDemand is a demand subscribed on the fakeMarket.
+type fakeDemand struct {
+	subscribed time.Time
+	expiration time.Time
+	collects   int
+	deleted    bool
+}
+
+// fakeMarket serves the demand endpoints of the market API, `collect`
+// returns the status of each collect of a demand.
+type fakeMarket struct {
+	lock    sync.Mutex
+	demands []*fakeDemand
+	collect func(demand int, collects int) int
+}
+
+func newFakeMarket(t *testing.T, collect func(demand int, collects int) int) (*fakeMarket, *rest.Market) {
+	f := &fakeMarket{collect: collect}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	cfg := yam.NewConfiguration()
+	cfg.Servers = yam.ServerConfigurations{{URL: srv.URL}}
+	return f, rest.NewMarket(context.Background(), yam.NewAPIClient(cfg), log.NewNopLogger())
+}
+
+func (f *fakeMarket) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.Method == http.MethodPost && r.URL.Path == "/demands" {
+		var demand yam.DemandOfferBase
+		json.NewDecoder(r.Body).Decode(&demand)
+		properties, _ := demand.Properties.(map[string]interface{})
+		expiration, _ := properties[props.ActivityKeys[props.ActivityExpiration]].(float64)
+		f.demands = append(f.demands, &fakeDemand{
+			subscribed: time.Now(),
+			expiration: time.Unix(0, int64(expiration)*int64(time.Millisecond)),
+		})
+		json.NewEncoder(w).Encode(fmt.Sprintf("demand-%d", len(f.demands)-1))
+		return
+	}
+	var index int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/demands/demand-"), "%d", &index); err != nil || index >= len(f.demands) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	demand := f.demands[index]
+	if r.Method == http.MethodDelete {
+		demand.deleted = true
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	demand.collects++
+	status := f.collect(index, demand.collects)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	// Collects without offers are long polls.
+	f.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	f.lock.Lock()
+	w.Write([]byte("[]"))
+}
+
+// Demands returns a copy of the demands subscribed so far.
+func (f *fakeMarket) Demands() []fakeDemand {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	demands := make([]fakeDemand, len(f.demands))
+	for i, demand := range f.demands {
+		demands[i] = *demand
+	}
+	return demands
+}
+
+// runSubscriber runs the subscriber until `n` demands are subscribed.
+func runSubscriber(t *testing.T, market *fakeMarket, subscriber *DemandSubscriber, n int) []fakeDemand {
+	ctx, cncl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cncl()
+	done := make(chan error)
+	go func() {
+		done <- subscriber.Run(ctx, func(*rest.OfferProposal) {})
+	}()
+	for len(market.Demands()) < n && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cncl()
+	testutil.Equals(t, context.Canceled, <-done)
+	return market.Demands()
+}
+
+func TestDemandSubscriberGone(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusGone} {
+		market, api := newFakeMarket(t, func(demand int, collects int) int {
+			if demand == 0 {
+				return status
+			}
+			return http.StatusOK
+		})
+		events := make([]interface{}, 0)
+		var lock sync.Mutex
+		subscriber := NewDemandSubscriber(api, props.NewDemandBuilder(), func(evt interface{}) {
+			lock.Lock()
+			events = append(events, evt)
+			lock.Unlock()
+		})
+		demands := runSubscriber(t, market, subscriber, 2)
+
+		// The lost demand is subscribed again right away.
+		testutil.Equals(t, 1, demands[0].collects)
+		testutil.Assert(t, demands[0].deleted, "lost demand %d not unsubscribed", status)
+		lock.Lock()
+		testutil.Assert(t, len(events) >= 3, "expected the events of two subscriptions, got %v", events)
+		testutil.Equals(t, "*event.CollectFailed", fmt.Sprintf("%T", events[1]))
+		lock.Unlock()
+	}
+}
+
+func TestDemandSubscriberFailures(t *testing.T) {
+	market, api := newFakeMarket(t, func(demand int, collects int) int {
+		// The first demand recovers from a failure but keeps failing later.
+		if demand == 0 && collects != 2 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	subscriber := NewDemandSubscriber(api, props.NewDemandBuilder(), nil)
+	subscriber.SetRetryDelay(time.Millisecond)
+	demands := runSubscriber(t, market, subscriber, 2)
+
+	// The demand dies after five consecutive failures.
+	testutil.Equals(t, 2+5, demands[0].collects)
+	testutil.Assert(t, demands[0].deleted, "failing demand not unsubscribed")
+}
+
+func TestDemandSubscriberExpiry(t *testing.T) {
+	market, api := newFakeMarket(t, func(demand int, collects int) int {
+		return http.StatusOK
+	})
+	subscriber := NewDemandSubscriber(api, props.NewDemandBuilder(), nil)
+	subscriber.SetExpiration(200 * time.Millisecond)
+	demands := runSubscriber(t, market, subscriber, 3)
+
+	for i, demand := range demands {
+		// The expiration is set from the time of the subscription.
+		testutil.Assert(t, demand.expiration.Sub(demand.subscribed) > 150*time.Millisecond,
+			"demand %d expires at %v, subscribed at %v", i, demand.expiration, demand.subscribed)
+		if i == 0 {
+			continue
+		}
+		// The demand is renewed before it expires and left to expire.
+		previous := demands[i-1]
+		testutil.Assert(t, demand.subscribed.Before(previous.expiration),
+			"demand %d subscribed at %v, after the expiration %v", i, demand.subscribed, previous.expiration)
+		testutil.Assert(t, !previous.deleted, "expiring demand %d unsubscribed", i-1)
+	}
+}